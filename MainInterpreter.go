@@ -1,26 +1,10 @@
 package main
 
 import (
-	"MyInterpreter/repl"
+	"MyInterpreter/cli"
 	"os"
-	"os/user"
-	"fmt"
 )
 
-
-
-
-func main(){
-
-	
-	user, err := user.Current()
-	if err != nil{
-		panic(err)
-	}
-
-	fmt.Printf("Hello %s! This is the Monkey programming language!\n",
-	user.Username)
-	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
-
-}
\ No newline at end of file
+func main() {
+	os.Exit(cli.Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
@@ -3,12 +3,17 @@ package ast
 import (
 	"MyInterpreter/token"
 	"bytes"
+	"math/big"
 	"strings"
 )
 
+// Every Node knows where it came from, Pos is where the node starts and End is right after its last char
+// Nodes built by hand (tests, optimizations) might report a zero token.Position
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position
+	End() token.Position
 }
 
 type Statement interface {
@@ -34,6 +39,20 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
+func (p *Program) End() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[len(p.Statements)-1].End()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -54,6 +73,16 @@ func (ls *LetStatement) StatementNode() {}
 func (ls *LetStatement) TokenLiteral() string {
 	return ls.Token.Literal
 }
+func (ls *LetStatement) Pos() token.Position { return ls.Token.Span.Start }
+func (ls *LetStatement) End() token.Position {
+	if ls.Value != nil {
+		return ls.Value.End()
+	}
+	if ls.Name != nil {
+		return ls.Name.End()
+	}
+	return ls.Token.Span.End
+}
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
@@ -77,6 +106,13 @@ func (rs *ReturnStatement) StatementNode() {}
 func (rs *ReturnStatement) TokenLiteral() string {
 	return rs.Token.Literal
 }
+func (rs *ReturnStatement) Pos() token.Position { return rs.Token.Span.Start }
+func (rs *ReturnStatement) End() token.Position {
+	if rs.ReturnValue != nil {
+		return rs.ReturnValue.End()
+	}
+	return rs.Token.Span.End
+}
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -100,6 +136,13 @@ func (es *ExpressionStatement) StatementNode() {}
 func (es *ExpressionStatement) TokenLiteral() string {
 	return es.Token.Literal
 }
+func (es *ExpressionStatement) Pos() token.Position { return es.Token.Span.Start }
+func (es *ExpressionStatement) End() token.Position {
+	if es.Expression != nil {
+		return es.Expression.End()
+	}
+	return es.Token.Span.End
+}
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -118,6 +161,8 @@ func (i *Identifier) TokenLiteral() string {
 	//Implemented as a interface so any token can gets its literal,
 	//that begin identifiers, expressions, statements etc
 }
+func (i *Identifier) Pos() token.Position { return i.Token.Span.Start }
+func (i *Identifier) End() token.Position { return i.Token.Span.End }
 func (i *Identifier) String() string {
 	return i.Value
 }
@@ -125,11 +170,25 @@ func (i *Identifier) String() string {
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
+	Big   *big.Int // Only set for a literal too large for Value
 }
 
 func (il *IntegerLiteral) ExpressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Span.Start }
+func (il *IntegerLiteral) End() token.Position  { return il.Token.Span.End }
+
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) ExpressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() token.Position  { return fl.Token.Span.Start }
+func (fl *FloatLiteral) End() token.Position  { return fl.Token.Span.End }
 
 type PrefixExpression struct {
 	Token    token.Token
@@ -139,6 +198,13 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) ExpressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Span.Start }
+func (pe *PrefixExpression) End() token.Position {
+	if pe.Right != nil {
+		return pe.Right.End()
+	}
+	return pe.Token.Span.End
+}
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 
@@ -159,6 +225,18 @@ type InfixExpression struct {
 
 func (oe *InfixExpression) ExpressionNode()      {}
 func (oe *InfixExpression) TokenLiteral() string { return oe.Token.Literal }
+func (oe *InfixExpression) Pos() token.Position {
+	if oe.Left != nil {
+		return oe.Left.Pos()
+	}
+	return oe.Token.Span.Start
+}
+func (oe *InfixExpression) End() token.Position {
+	if oe.Right != nil {
+		return oe.Right.End()
+	}
+	return oe.Token.Span.End
+}
 func (oe *InfixExpression) String() string {
 	var out bytes.Buffer
 
@@ -179,16 +257,32 @@ type Boolean struct {
 func (b *Boolean) ExpressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
 func (b *Boolean) String() string       { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Span.Start }
+func (b *Boolean) End() token.Position  { return b.Token.Span.End }
 
 type IfExpression struct {
 	Token       token.Token
 	Condition   Expression
 	Consequence *BlockStatement
 	Alternative *BlockStatement
+	ElseIf      *IfExpression // Set for "else if (...) {...}", the rest of the chain hangs from it and Alternative stays nil
 }
 
 func (ie *IfExpression) ExpressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Span.Start }
+func (ie *IfExpression) End() token.Position {
+	if ie.ElseIf != nil {
+		return ie.ElseIf.End()
+	}
+	if ie.Alternative != nil {
+		return ie.Alternative.End()
+	}
+	if ie.Consequence != nil {
+		return ie.Consequence.End()
+	}
+	return ie.Token.Span.End
+}
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 
@@ -198,7 +292,11 @@ func (ie *IfExpression) String() string {
 	out.WriteString(ie.Consequence.String())
 	out.WriteString(" ")
 
-	if ie.Alternative != nil {
+	//The chain stays flat, "else if" is never written as an else block holding an if
+	if ie.ElseIf != nil {
+		out.WriteString("else ")
+		out.WriteString(ie.ElseIf.String())
+	} else if ie.Alternative != nil {
 		out.WriteString("else ")
 		out.WriteString(ie.Alternative.String())
 		out.WriteString(" ")
@@ -208,12 +306,23 @@ func (ie *IfExpression) String() string {
 }
 
 type BlockStatement struct {
-	Token      token.Token
+	Token      token.Token // "{"
 	Statements []Statement
+	Closing    token.Token // "}"
 }
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Span.Start }
+func (bs *BlockStatement) End() token.Position {
+	if bs.Closing.Span.IsValid() {
+		return bs.Closing.Span.End
+	}
+	if len(bs.Statements) > 0 {
+		return bs.Statements[len(bs.Statements)-1].End()
+	}
+	return bs.Token.Span.End
+}
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -228,10 +337,18 @@ type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Pure       bool // Set by the optimizer, a call can't print or change anything the function didn't create
 }
 
 func (fl *FunctionLiteral) ExpressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Span.Start }
+func (fl *FunctionLiteral) End() token.Position {
+	if fl.Body != nil {
+		return fl.Body.End()
+	}
+	return fl.Token.Span.End
+}
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
@@ -251,13 +368,27 @@ func (fl *FunctionLiteral) String() string {
 }
 
 type CallExpression struct {
-	Token     token.Token
+	Token     token.Token // "("
 	Function  Expression
 	Arguments []Expression
+	Closing   token.Token // ")"
+	Tail      bool        // Set by the parser, the call's value is its function's value so nothing is left for the caller to do
 }
 
 func (ce *CallExpression) ExpressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position {
+	if ce.Function != nil {
+		return ce.Function.Pos()
+	}
+	return ce.Token.Span.Start
+}
+func (ce *CallExpression) End() token.Position {
+	if ce.Closing.Span.IsValid() {
+		return ce.Closing.Span.End
+	}
+	return ce.Token.Span.End
+}
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -274,6 +405,19 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
+// InlinedCall is what the optimizer leaves of a call it inlined, Value is the function's body with the arguments in
+// it stands where the call was, an error around it points at the call while Value keeps the function's positions
+type InlinedCall struct {
+	Span  token.Span
+	Value Expression
+}
+
+func (ic *InlinedCall) ExpressionNode()      {}
+func (ic *InlinedCall) TokenLiteral() string { return ic.Value.TokenLiteral() }
+func (ic *InlinedCall) Pos() token.Position  { return ic.Span.Start }
+func (ic *InlinedCall) End() token.Position  { return ic.Span.End }
+func (ic *InlinedCall) String() string       { return ic.Value.String() }
+
 type StringLiteral struct {
 	Token token.Token
 	Value string
@@ -282,6 +426,41 @@ type StringLiteral struct {
 func (s *StringLiteral) ExpressionNode()      {}
 func (s *StringLiteral) TokenLiteral() string { return s.Token.Literal }
 func (s *StringLiteral) String() string       { return s.Token.Literal }
+func (s *StringLiteral) Pos() token.Position  { return s.Token.Span.Start }
+func (s *StringLiteral) End() token.Position  { return s.Token.Span.End }
+
+// InterpolatedString is "a ${x} b", Parts are the text and the expressions in the order they're written
+// the text is a StringLiteral, empty text (like before ${x} in "${x}") is left out
+type InterpolatedString struct {
+	Token   token.Token // STRING_HEAD
+	Parts   []Expression
+	Closing token.Token // STRING_TAIL
+}
+
+func (is *InterpolatedString) ExpressionNode()      {}
+func (is *InterpolatedString) TokenLiteral() string { return is.Token.Literal }
+func (is *InterpolatedString) Pos() token.Position  { return is.Token.Span.Start }
+func (is *InterpolatedString) End() token.Position {
+	if is.Closing.Span.IsValid() {
+		return is.Closing.Span.End
+	}
+	return is.Token.Span.End
+}
+func (is *InterpolatedString) String() string {
+	var out bytes.Buffer
+
+	for _, part := range is.Parts {
+		if text, ok := part.(*StringLiteral); ok {
+			out.WriteString(text.Value)
+			continue
+		}
+		out.WriteString("${")
+		out.WriteString(part.String())
+		out.WriteString("}")
+	}
+
+	return out.String()
+}
 
 type CompoundAssignment struct {
 	Token    token.Token
@@ -292,6 +471,13 @@ type CompoundAssignment struct {
 
 func (pe *CompoundAssignment) StatementNode()       {}
 func (pe *CompoundAssignment) TokenLiteral() string { return pe.Token.Literal }
+func (pe *CompoundAssignment) Pos() token.Position  { return pe.Token.Span.Start }
+func (pe *CompoundAssignment) End() token.Position {
+	if pe.Value != nil {
+		return pe.Value.End()
+	}
+	return pe.Token.Span.End
+}
 func (pe *CompoundAssignment) String() string {
 	var out bytes.Buffer
 
@@ -304,13 +490,61 @@ func (pe *CompoundAssignment) String() string {
 	return out.String()
 }
 
+// Assignment is "x = value", it changes the closest variable called x and never creates one
+type Assignment struct {
+	Token    token.Token // the variable
+	Variable *Identifier
+	Value    Expression
+}
+
+func (as *Assignment) StatementNode()       {}
+func (as *Assignment) TokenLiteral() string { return as.Token.Literal }
+func (as *Assignment) Pos() token.Position  { return as.Token.Span.Start }
+func (as *Assignment) End() token.Position {
+	if as.Value != nil {
+		return as.Value.End()
+	}
+	return as.Token.Span.End
+}
+func (as *Assignment) String() string {
+	return as.Variable.String() + " = " + as.Value.String()
+}
+
+// IndexAssignment is "target[index] = value", it changes the array or hash in place
+type IndexAssignment struct {
+	Token  token.Token // "="
+	Target *IndexExpression
+	Value  Expression
+}
+
+func (ia *IndexAssignment) StatementNode()       {}
+func (ia *IndexAssignment) TokenLiteral() string { return ia.Token.Literal }
+func (ia *IndexAssignment) Pos() token.Position  { return ia.Target.Pos() }
+func (ia *IndexAssignment) End() token.Position {
+	if ia.Value != nil {
+		return ia.Value.End()
+	}
+	return ia.Token.Span.End
+}
+func (ia *IndexAssignment) String() string {
+	return ia.Target.String() + " = " + ia.Value.String()
+}
+
 type ArrayLiteral struct {
-	Token    token.Token
+	Token    token.Token // "["
 	Elements []Expression
+	Closing  token.Token // "]"
 }
 
 func (al *ArrayLiteral) ExpressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Position  { return al.Token.Span.Start }
+func (al *ArrayLiteral) End() token.Position {
+	if al.Closing.Span.IsValid() {
+		return al.Closing.Span.End
+	}
+	return al.Token.Span.End
+}
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 
@@ -328,13 +562,26 @@ func (al *ArrayLiteral) String() string {
 }
 
 type IndexExpression struct {
-	Token token.Token
-	Left  Expression
-	Index Expression
+	Token   token.Token // "["
+	Left    Expression
+	Index   Expression
+	Closing token.Token // "]"
 }
 
 func (ie *IndexExpression) ExpressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position {
+	if ie.Left != nil {
+		return ie.Left.Pos()
+	}
+	return ie.Token.Span.Start
+}
+func (ie *IndexExpression) End() token.Position {
+	if ie.Closing.Span.IsValid() {
+		return ie.Closing.Span.End
+	}
+	return ie.Token.Span.End
+}
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
@@ -349,12 +596,20 @@ func (ie *IndexExpression) String() string {
 }
 
 type HashLiteral struct {
-	Token token.Token
-	Pairs map[Expression]Expression
+	Token   token.Token // "{"
+	Pairs   map[Expression]Expression
+	Closing token.Token // "}"
 }
 
 func (hl *HashLiteral) ExpressionNode()      {}
-func (hl *HashLiteral) TokenLiteral() string { return hl.TokenLiteral() }
+func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Span.Start }
+func (hl *HashLiteral) End() token.Position {
+	if hl.Closing.Span.IsValid() {
+		return hl.Closing.Span.End
+	}
+	return hl.Token.Span.End
+}
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
@@ -371,15 +626,21 @@ func (hl *HashLiteral) String() string {
 
 type WhileLoop struct {
 	Token       token.Token
+	Label       *Identifier // Set for "name: while (...) {...}", the name break and continue use to pick this loop
 	Condition   Expression
 	Consequence *BlockStatement
 }
 
 func (wl *WhileLoop) ExpressionNode()      {}
-func (wl *WhileLoop) TokenLiteral() string { return wl.TokenLiteral() }
+func (wl *WhileLoop) TokenLiteral() string { return wl.Token.Literal }
+func (wl *WhileLoop) Pos() token.Position  { return loopPos(wl.Token, wl.Label) }
+func (wl *WhileLoop) End() token.Position  { return loopEnd(wl.Token, wl.Consequence) }
 func (wl *WhileLoop) String() string {
 	var out bytes.Buffer
 
+	if wl.Label != nil {
+		out.WriteString(wl.Label.String() + ": ")
+	}
 	out.WriteString("while")
 	out.WriteString("(")
 	out.WriteString(wl.Condition.String())
@@ -389,3 +650,157 @@ func (wl *WhileLoop) String() string {
 
 	return out.String()
 }
+
+// ForLoop is the C style "for (init; condition; post) {...}", any of the three parts can be left out
+type ForLoop struct {
+	Token     token.Token
+	Label     *Identifier
+	Init      Statement  // run once before the first check, nil when missing
+	Condition Expression // nil loops until a break or a return
+	Post      Statement  // run after every iteration, continue included
+	Body      *BlockStatement
+}
+
+func (fl *ForLoop) ExpressionNode()      {}
+func (fl *ForLoop) TokenLiteral() string { return fl.Token.Literal }
+func (fl *ForLoop) Pos() token.Position  { return loopPos(fl.Token, fl.Label) }
+func (fl *ForLoop) End() token.Position  { return loopEnd(fl.Token, fl.Body) }
+func (fl *ForLoop) String() string {
+	var out bytes.Buffer
+
+	if fl.Label != nil {
+		out.WriteString(fl.Label.String() + ": ")
+	}
+	out.WriteString("for(")
+	if fl.Init != nil {
+		out.WriteString(strings.TrimSuffix(fl.Init.String(), ";"))
+	}
+	out.WriteString("; ")
+	if fl.Condition != nil {
+		out.WriteString(fl.Condition.String())
+	}
+	out.WriteString("; ")
+	if fl.Post != nil {
+		out.WriteString(strings.TrimSuffix(fl.Post.String(), ";"))
+	}
+	out.WriteString("){")
+	out.WriteString(fl.Body.String())
+	out.WriteString("}")
+
+	return out.String()
+}
+
+// ForInLoop is "for (value in iterable) {...}" or "for (key, value in iterable) {...}"
+// with one name, hashes give their keys and everything else its elements
+type ForInLoop struct {
+	Token    token.Token
+	Label    *Identifier
+	Key      *Identifier // nil for the one name form
+	Value    *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fl *ForInLoop) ExpressionNode()      {}
+func (fl *ForInLoop) TokenLiteral() string { return fl.Token.Literal }
+func (fl *ForInLoop) Pos() token.Position  { return loopPos(fl.Token, fl.Label) }
+func (fl *ForInLoop) End() token.Position  { return loopEnd(fl.Token, fl.Body) }
+func (fl *ForInLoop) String() string {
+	var out bytes.Buffer
+
+	if fl.Label != nil {
+		out.WriteString(fl.Label.String() + ": ")
+	}
+	out.WriteString("for(")
+	if fl.Key != nil {
+		out.WriteString(fl.Key.String() + ", ")
+	}
+	out.WriteString(fl.Value.String())
+	out.WriteString(" in ")
+	out.WriteString(fl.Iterable.String())
+	out.WriteString("){")
+	out.WriteString(fl.Body.String())
+	out.WriteString("}")
+
+	return out.String()
+}
+
+func loopPos(tok token.Token, label *Identifier) token.Position {
+	if label != nil {
+		return label.Pos()
+	}
+	return tok.Span.Start
+}
+
+func loopEnd(tok token.Token, body *BlockStatement) token.Position {
+	if body != nil {
+		return body.End()
+	}
+	return tok.Span.End
+}
+
+// BreakStatement leaves the innermost loop, or the enclosing loop called Label
+type BreakStatement struct {
+	Token token.Token
+	Label *Identifier // nil for a plain break
+}
+
+func (bs *BreakStatement) StatementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Position  { return bs.Token.Span.Start }
+func (bs *BreakStatement) End() token.Position  { return branchEnd(bs.Token, bs.Label) }
+func (bs *BreakStatement) String() string       { return branchString(bs.Token, bs.Label) }
+
+// ContinueStatement skips to the next iteration of the innermost loop, or of the enclosing loop called Label
+type ContinueStatement struct {
+	Token token.Token
+	Label *Identifier // nil for a plain continue
+}
+
+func (cs *ContinueStatement) StatementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() token.Position  { return cs.Token.Span.Start }
+func (cs *ContinueStatement) End() token.Position  { return branchEnd(cs.Token, cs.Label) }
+func (cs *ContinueStatement) String() string       { return branchString(cs.Token, cs.Label) }
+
+func branchEnd(tok token.Token, label *Identifier) token.Position {
+	if label != nil {
+		return label.End()
+	}
+	return tok.Span.End
+}
+
+func branchString(tok token.Token, label *Identifier) string {
+	if label != nil {
+		return tok.Literal + " " + label.String() + ";"
+	}
+	return tok.Literal + ";"
+}
+
+// SpanOf is the whole source range covered by a node
+func SpanOf(node Node) token.Span {
+	return token.Span{Start: node.Pos(), End: node.End()}
+}
+
+// BadStatement is what's left of a statement that failed to parse, it covers every token the parser skipped
+type BadStatement struct {
+	From token.Token
+	To   token.Token
+}
+
+func (bs *BadStatement) StatementNode()       {}
+func (bs *BadStatement) TokenLiteral() string { return bs.From.Literal }
+func (bs *BadStatement) String() string       { return "<bad statement>" }
+func (bs *BadStatement) Pos() token.Position  { return bs.From.Span.Start }
+func (bs *BadStatement) End() token.Position  { return bs.To.Span.End }
+
+// BadExpression fills the place of an expression that failed to parse
+type BadExpression struct {
+	Token token.Token
+}
+
+func (be *BadExpression) ExpressionNode()      {}
+func (be *BadExpression) TokenLiteral() string { return be.Token.Literal }
+func (be *BadExpression) String() string       { return "<bad expression>" }
+func (be *BadExpression) Pos() token.Position  { return be.Token.Span.Start }
+func (be *BadExpression) End() token.Position  { return be.Token.Span.End }
@@ -3,6 +3,7 @@ package ast
 
 import(
 	"testing"
+	"strings"
 	"MyInterpreter/token"
 )
 
@@ -29,4 +30,44 @@ func TestString(t *testing.T){
 		t.Errorf("program.String() wrong. got=%q", program.String())
 	}
 
-}
\ No newline at end of file
+}
+func TestInspect(t *testing.T) {
+	ident := func(name string) *Identifier { return &Identifier{Value: name} }
+
+	// let f = fn(x) { x + y }; f(z)
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Name: ident("f"),
+				Value: &FunctionLiteral{
+					Parameters: []*Identifier{ident("x")},
+					Body: &BlockStatement{Statements: []Statement{
+						&ExpressionStatement{Expression: &InfixExpression{Left: ident("x"), Operator: "+", Right: ident("y")}},
+					}},
+				},
+			},
+			&ExpressionStatement{Expression: &CallExpression{Function: ident("f"), Arguments: []Expression{ident("z")}}},
+		},
+	}
+
+	names := func(skipFunctions bool) string {
+		found := []string{}
+		Inspect(program, func(node Node) bool {
+			if _, ok := node.(*FunctionLiteral); ok && skipFunctions {
+				return false
+			}
+			if i, ok := node.(*Identifier); ok {
+				found = append(found, i.Value)
+			}
+			return true
+		})
+		return strings.Join(found, " ")
+	}
+
+	if got := names(false); got != "f x x y f z" {
+		t.Errorf("wrong identifiers. got=%q", got)
+	}
+	if got := names(true); got != "f f z" {
+		t.Errorf("wrong identifiers when skipping functions. got=%q", got)
+	}
+}
@@ -0,0 +1,122 @@
+package ast
+
+// Inspect walks the tree in depth first order calling fn on every node it finds
+// when fn returns false the children of that node are skipped, same idea as go/ast.Inspect
+func Inspect(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		for _, s := range n.Statements {
+			Inspect(s, fn)
+		}
+	case *LetStatement:
+		inspectIdent(n.Name, fn)
+		inspectExpr(n.Value, fn)
+	case *ReturnStatement:
+		inspectExpr(n.ReturnValue, fn)
+	case *ExpressionStatement:
+		inspectExpr(n.Expression, fn)
+	case *BlockStatement:
+		for _, s := range n.Statements {
+			Inspect(s, fn)
+		}
+	case *PrefixExpression:
+		inspectExpr(n.Right, fn)
+	case *InfixExpression:
+		inspectExpr(n.Left, fn)
+		inspectExpr(n.Right, fn)
+	case *IfExpression:
+		inspectExpr(n.Condition, fn)
+		inspectBlock(n.Consequence, fn)
+		inspectBlock(n.Alternative, fn)
+		if n.ElseIf != nil {
+			Inspect(n.ElseIf, fn)
+		}
+	case *FunctionLiteral:
+		for _, p := range n.Parameters {
+			inspectIdent(p, fn)
+		}
+		inspectBlock(n.Body, fn)
+	case *CallExpression:
+		inspectExpr(n.Function, fn)
+		for _, a := range n.Arguments {
+			inspectExpr(a, fn)
+		}
+	case *CompoundAssignment:
+		inspectIdent(n.Variable, fn)
+		inspectExpr(n.Value, fn)
+	case *Assignment:
+		inspectIdent(n.Variable, fn)
+		inspectExpr(n.Value, fn)
+	case *IndexAssignment:
+		if n.Target != nil {
+			Inspect(n.Target, fn)
+		}
+		inspectExpr(n.Value, fn)
+	case *InlinedCall:
+		inspectExpr(n.Value, fn)
+	case *InterpolatedString:
+		for _, part := range n.Parts {
+			inspectExpr(part, fn)
+		}
+	case *ArrayLiteral:
+		for _, e := range n.Elements {
+			inspectExpr(e, fn)
+		}
+	case *IndexExpression:
+		inspectExpr(n.Left, fn)
+		inspectExpr(n.Index, fn)
+	case *HashLiteral:
+		for key, value := range n.Pairs {
+			inspectExpr(key, fn)
+			inspectExpr(value, fn)
+		}
+	case *WhileLoop:
+		inspectIdent(n.Label, fn)
+		inspectExpr(n.Condition, fn)
+		inspectBlock(n.Consequence, fn)
+	case *ForLoop:
+		inspectIdent(n.Label, fn)
+		if n.Init != nil {
+			Inspect(n.Init, fn)
+		}
+		inspectExpr(n.Condition, fn)
+		if n.Post != nil {
+			Inspect(n.Post, fn)
+		}
+		inspectBlock(n.Body, fn)
+	case *ForInLoop:
+		inspectIdent(n.Label, fn)
+		inspectIdent(n.Key, fn)
+		inspectIdent(n.Value, fn)
+		inspectExpr(n.Iterable, fn)
+		inspectBlock(n.Body, fn)
+	case *BreakStatement:
+		inspectIdent(n.Label, fn)
+	case *ContinueStatement:
+		inspectIdent(n.Label, fn)
+	}
+}
+
+// A typed nil inside an interface is not == nil, these make sure the walk never calls fn with one
+
+func inspectExpr(e Expression, fn func(Node) bool) {
+	if e != nil {
+		Inspect(e, fn)
+	}
+}
+
+func inspectIdent(i *Identifier, fn func(Node) bool) {
+	if i != nil {
+		Inspect(i, fn)
+	}
+}
+
+func inspectBlock(b *BlockStatement, fn func(Node) bool) {
+	if b != nil {
+		Inspect(b, fn)
+	}
+}
@@ -0,0 +1,339 @@
+package bytecode
+
+import (
+	"MyInterpreter/code"
+	"MyInterpreter/compiler"
+	"MyInterpreter/object"
+	"MyInterpreter/token"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+)
+
+// A .k2mc file is a compiled module, laid out as
+//
+//	header     "K2MC", version (uint16), sha256 of the source, filename
+//	constants  count, then a tag byte and the value of each constant
+//	main       instructions and source map of the top level code
+//	names      globals and builtins, by index
+//
+// Every number after the version is a varint, strings and byte slices are a length followed by the bytes
+const Magic = "K2MC"
+
+// Version changes every time the layout or the instruction set changes, files of another version are never loaded
+const Version uint16 = 11
+
+// Constant tags
+const (
+	tagInteger    byte = 'i'
+	tagBigInteger byte = 'b'
+	tagFloat      byte = 'd'
+	tagString     byte = 's'
+	tagFunction   byte = 'f'
+)
+
+// Nothing in a real module gets near this, it only stops a corrupted length from allocating gigabytes
+const maxLength = 64 << 20
+
+var (
+	ErrBadMagic = errors.New("not a k2mc file")
+	ErrVersion  = errors.New("k2mc file was written by another version")
+)
+
+// Module is a compiled script, the Bytecode plus what's needed to tell if it's still up to date
+type Module struct {
+	Filename   string
+	SourceHash [sha256.Size]byte
+	Bytecode   *compiler.Bytecode
+}
+
+func HashSource(source string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(source))
+}
+
+func Encode(w io.Writer, m *Module) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	e.write([]byte(Magic))
+	e.write(binary.BigEndian.AppendUint16(nil, Version))
+	e.write(m.SourceHash[:])
+	e.string(m.Filename)
+
+	e.uint(len(m.Bytecode.Constants))
+	for _, constant := range m.Bytecode.Constants {
+		e.constant(constant)
+	}
+
+	e.bytes(m.Bytecode.Instructions)
+	e.sourceMap(m.Bytecode.SourceMap)
+	e.strings(m.Bytecode.Globals)
+	e.strings(m.Bytecode.Builtins)
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+func Decode(r io.Reader) (*Module, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	header := d.read(len(Magic) + 2)
+	if d.err != nil || string(header[:len(Magic)]) != Magic {
+		return nil, ErrBadMagic
+	}
+	if version := binary.BigEndian.Uint16(header[len(Magic):]); version != Version {
+		return nil, fmt.Errorf("%w: got version %d, want %d", ErrVersion, version, Version)
+	}
+
+	m := &Module{Bytecode: &compiler.Bytecode{}}
+	copy(m.SourceHash[:], d.read(sha256.Size))
+	m.Filename = d.string()
+
+	constants := d.uint()
+	for i := 0; i < constants && d.err == nil; i++ {
+		m.Bytecode.Constants = append(m.Bytecode.Constants, d.constant(m.Filename))
+	}
+
+	m.Bytecode.Instructions = d.bytes()
+	m.Bytecode.SourceMap = d.sourceMap(m.Filename)
+	m.Bytecode.Globals = d.strings()
+	m.Bytecode.Builtins = d.strings()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+// The encoder and decoder keep the first error and ignore everything after it, so the
+// code above can read like the layout instead of checking an error after every field
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uint(n int) {
+	e.write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (e *encoder) int(n int64) {
+	e.write(binary.AppendVarint(nil, n))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint(len(b))
+	e.write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) strings(list []string) {
+	e.uint(len(list))
+	for _, s := range list {
+		e.string(s)
+	}
+}
+
+func (e *encoder) ints(list []int) {
+	e.uint(len(list))
+	for _, n := range list {
+		e.uint(n)
+	}
+}
+
+func (e *encoder) position(p token.Position) {
+	e.uint(p.Offset)
+	e.uint(p.Line)
+	e.uint(p.Column)
+}
+
+func (e *encoder) sourceMap(sm code.SourceMap) {
+	e.uint(len(sm))
+	for _, entry := range sm {
+		e.uint(entry.Offset)
+		e.position(entry.Span.Start)
+		e.position(entry.Span.End)
+	}
+}
+
+func (e *encoder) constant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.write([]byte{tagInteger})
+		e.int(obj.Value)
+	case *object.BigInteger:
+		e.write([]byte{tagBigInteger})
+		e.string(obj.Value.String())
+	case *object.Float:
+		e.write([]byte{tagFloat})
+		e.write(binary.BigEndian.AppendUint64(nil, math.Float64bits(obj.Value)))
+	case *object.String:
+		e.write([]byte{tagString})
+		e.string(obj.Value)
+	case *object.CompiledFunction:
+		e.write([]byte{tagFunction})
+		e.string(obj.Name)
+		e.uint(obj.NumLocals)
+		e.uint(obj.NumParameters)
+		e.ints(obj.Cells)
+		e.strings(obj.Locals)
+		e.strings(obj.Free)
+		e.bytes(obj.Instructions)
+		e.sourceMap(obj.SourceMap)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("constant of type %s can't be written to a k2mc file", obj.Type())
+		}
+	}
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+	}
+}
+
+func (d *decoder) read(n int) []byte {
+	b := make([]byte, n)
+	if d.err != nil {
+		return b
+	}
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+	}
+	return b
+}
+
+func (d *decoder) byte() byte {
+	return d.read(1)[0]
+}
+
+func (d *decoder) uint() int {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+		return 0
+	}
+	if n > maxLength {
+		d.fail(fmt.Errorf("k2mc file is corrupted: %d is too large", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	return d.read(d.uint())
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.uint()
+	list := []string{}
+	for i := 0; i < n && d.err == nil; i++ {
+		list = append(list, d.string())
+	}
+	return list
+}
+
+func (d *decoder) ints() []int {
+	n := d.uint()
+	var list []int
+	for i := 0; i < n && d.err == nil; i++ {
+		list = append(list, d.uint())
+	}
+	return list
+}
+
+// Only the module knows the filename, every position gets it back from there
+func (d *decoder) position(filename string) token.Position {
+	p := token.Position{Offset: d.uint(), Line: d.uint(), Column: d.uint()}
+	if p.IsValid() {
+		p.Filename = filename
+	}
+	return p
+}
+
+func (d *decoder) sourceMap(filename string) code.SourceMap {
+	n := d.uint()
+	var sm code.SourceMap
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := code.SourceMapEntry{Offset: d.uint()}
+		entry.Span.Start = d.position(filename)
+		entry.Span.End = d.position(filename)
+		sm = append(sm, entry)
+	}
+	return sm
+}
+
+func (d *decoder) constant(filename string) object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.int()}
+	case tagBigInteger:
+		text := d.string()
+		value, ok := new(big.Int).SetString(text, 10)
+		if !ok {
+			d.fail(fmt.Errorf("k2mc file is corrupted: %q is not an integer", text))
+			return nil
+		}
+		return &object.BigInteger{Value: value}
+	case tagFloat:
+		return &object.Float{Value: math.Float64frombits(binary.BigEndian.Uint64(d.read(8)))}
+	case tagString:
+		return &object.String{Value: d.string()}
+	case tagFunction:
+		fn := &object.CompiledFunction{}
+		fn.Name = d.string()
+		fn.NumLocals = d.uint()
+		fn.NumParameters = d.uint()
+		fn.Cells = d.ints()
+		fn.Locals = d.strings()
+		fn.Free = d.strings()
+		fn.Instructions = d.bytes()
+		fn.SourceMap = d.sourceMap(filename)
+		return fn
+	default:
+		d.fail(fmt.Errorf("k2mc file is corrupted: unknown constant tag %q", tag))
+		return nil
+	}
+}
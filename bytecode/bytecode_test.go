@@ -0,0 +1,203 @@
+package bytecode
+
+import (
+	"MyInterpreter/object"
+	"MyInterpreter/optimizer"
+	"MyInterpreter/vm"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+const program = `let makeAdder = fn(x) {
+  fn(y) { x + y }
+};
+let greeting = "hello";
+let addTwo = makeAdder(2);
+[addTwo(40), greeting, len(greeting), 0.5, 100000000000000000000]`
+
+func compile(t *testing.T, filename, source string) *Module {
+	t.Helper()
+
+	m, diags := Compile(filename, source)
+	if len(diags) != 0 {
+		t.Fatalf("compile failed: %v", diags)
+	}
+	return m
+}
+
+func run(t *testing.T, m *Module) object.Object {
+	t.Helper()
+
+	machine := vm.New(m.Bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	return machine.Result()
+}
+
+func TestRoundTrip(t *testing.T) {
+	original := compile(t, "adder.k2m", program)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, original); err != nil {
+		t.Fatalf("encode failed: %s", err)
+	}
+
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+
+	if decoded.Filename != "adder.k2m" || decoded.SourceHash != HashSource(program) {
+		t.Errorf("wrong header. got filename=%q", decoded.Filename)
+	}
+	if decoded.Bytecode.Instructions.String() != original.Bytecode.Instructions.String() {
+		t.Errorf("instructions changed.\nwant=\n%s\ngot=\n%s", original.Bytecode.Instructions, decoded.Bytecode.Instructions)
+	}
+	if len(decoded.Bytecode.Constants) != len(original.Bytecode.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(original.Bytecode.Constants), len(decoded.Bytecode.Constants))
+	}
+
+	want := run(t, original).Inspect()
+	if got := run(t, decoded).Inspect(); got != want {
+		t.Errorf("decoded module gives another result. want=%s, got=%s", want, got)
+	}
+}
+
+func TestDecodedErrorsKeepTheirPosition(t *testing.T) {
+	original := compile(t, "broken.k2m", "let f = fn(x) {\n  x + True\n};\nf(1)")
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, original); err != nil {
+		t.Fatalf("encode failed: %s", err)
+	}
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+
+	errObj, ok := run(t, decoded).(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error")
+	}
+	if errObj.Span.Start.String() != "broken.k2m:2:3" {
+		t.Errorf("wrong position. want=broken.k2m:2:3, got=%s", errObj.Span.Start)
+	}
+}
+
+func TestDecodeRejectsBadInput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, compile(t, "a.k2m", "1")); err != nil {
+		t.Fatalf("encode failed: %s", err)
+	}
+	valid := buf.Bytes()
+
+	otherVersion := append([]byte{}, valid...)
+	binary.BigEndian.PutUint16(otherVersion[len(Magic):], Version+1)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected error
+	}{
+		{"empty", []byte{}, ErrBadMagic},
+		{"not k2mc", []byte("let x = 5;"), ErrBadMagic},
+		{"other version", otherVersion, ErrVersion},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(tt.input))
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.expected, err)
+		}
+	}
+
+	for cut := len(Magic) + 2; cut < len(valid); cut++ {
+		if _, err := Decode(bytes.NewReader(valid[:cut])); err == nil {
+			t.Errorf("file cut at %d of %d bytes was accepted", cut, len(valid))
+		}
+	}
+}
+
+func TestLoadUsesTheCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	filename := "script.k2m"
+
+	_, _, cached := Load(filename, program)
+	if cached {
+		t.Fatalf("first load can't come from the cache")
+	}
+
+	path, err := CachePath(filename)
+	if err != nil {
+		t.Fatalf("no cache path: %s", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("cache file was not written: %s", err)
+	}
+
+	m, _, cached := Load(filename, program)
+	if !cached {
+		t.Errorf("unchanged source should come from the cache")
+	}
+	if got := run(t, m).Inspect(); got != "[42,hello,5,0.5,100000000000000000000]" {
+		t.Errorf("cached module gives the wrong result. got=%s", got)
+	}
+
+	changed := strings.Replace(program, "40", "41", 1)
+	m, _, cached = Load(filename, changed)
+	if cached {
+		t.Errorf("changed source must be compiled again")
+	}
+	if got := run(t, m).Inspect(); got != "[43,hello,5,0.5,100000000000000000000]" {
+		t.Errorf("recompiled module gives the wrong result. got=%s", got)
+	}
+}
+
+func TestLoadReportsSyntaxErrors(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	m, diags, _ := Load("bad.k2m", "let = 5;")
+	if m != nil || len(diags) == 0 {
+		t.Fatalf("expected diagnostics, got module=%v diags=%v", m, diags)
+	}
+	if diags[0].Span.Start.Filename != "bad.k2m" {
+		t.Errorf("diagnostic lost the filename. got=%s", diags[0].Span.Start)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	// s is assigned at the end, a let nobody uses would be removed by the optimizer
+	// and f(2) would become 3 if f was inlined
+	source := "let s = \"hi\";\nlet f = fn(x) { x + 1 };\nf(2)\ns = \"bye\""
+	m, diags := CompileWith(optimizer.Options{}, "d.k2m", source)
+	if len(diags) != 0 {
+		t.Fatalf("compile failed: %v", diags)
+	}
+
+	var out bytes.Buffer
+	Disassemble(&out, m, source)
+
+	expected := []string{
+		"== main ==",
+		"   1 | let s = \"hi\";",
+		"0000 OpConstant 0             ; \"hi\"",
+		"0003 OpSetGlobal 0            ; s",
+		"   3 | f(2)",
+		"== fn f (constant 2) ==",
+		"   2 | let f = fn(x) { x + 1 };",
+		"0000 OpGetLocal 0             ; x",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing line %q in\n%s", line, out.String())
+		}
+	}
+}
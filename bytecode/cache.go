@@ -0,0 +1,124 @@
+package bytecode
+
+import (
+	"MyInterpreter/compiler"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/lexer"
+	"MyInterpreter/optimizer"
+	"MyInterpreter/parser"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// Compile parses and compiles a whole script, syntax and compile errors come back as diagnostics
+// globals are defined before the script's own variables, in that order, for values the host puts in the globals store
+func Compile(filename, source string, globals ...string) (*Module, []diagnostics.Diagnostic) {
+	return CompileWith(optimizer.Options{InlineSize: optimizer.DefaultInlineSize}, filename, source, globals...)
+}
+
+// CompileWith is Compile with its own optimizer options, Load never uses it because the cache doesn't know them
+func CompileWith(opts optimizer.Options, filename, source string, globals ...string) (*Module, []diagnostics.Diagnostic) {
+	p := parser.NewParser(lexer.NewFileLexer(filename, source))
+	program := p.ParseProgram()
+	if len(p.Diagnostics()) != 0 {
+		return nil, p.Diagnostics()
+	}
+
+	state := compiler.NewState()
+	for _, name := range globals {
+		state.Symbols.Define(name)
+	}
+
+	comp := compiler.NewWithState(state)
+	if err := comp.Compile(optimizer.OptimizeWith(program, opts)); err != nil {
+		return nil, []diagnostics.Diagnostic{diagnostics.FromError(err)}
+	}
+
+	return &Module{Filename: filename, SourceHash: HashSource(source), Bytecode: comp.Bytecode()}, nil
+}
+
+// Load is Compile with a cache in front of it, a script that didn't change since the last run
+// is read back from its .k2mc file without being lexed or parsed again
+// The cache is best effort, if it can't be read or written the script is just compiled
+func Load(filename, source string, globals ...string) (m *Module, diags []diagnostics.Diagnostic, cached bool) {
+	path, err := CachePath(filename)
+	if err != nil {
+		m, diags = Compile(filename, source, globals...)
+		return m, diags, false
+	}
+
+	if m, ok := readCache(path, filename, source, globals); ok {
+		return m, nil, true
+	}
+
+	m, diags = Compile(filename, source, globals...)
+	if m != nil {
+		writeCache(path, m)
+	}
+	return m, diags, false
+}
+
+// CachePath is where the compiled version of the script at filename is kept
+// one file per script, named after the hash of its absolute path
+func CachePath(filename string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "k2m", hex.EncodeToString(sum[:])+".k2mc"), nil
+}
+
+func readCache(path, filename, source string, globals []string) (*Module, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	m, err := Decode(file)
+	if err != nil || m.SourceHash != HashSource(source) || m.Filename != filename {
+		return nil, false
+	}
+
+	// Compiled for another host, its globals are in other slots
+	if len(m.Bytecode.Globals) < len(globals) {
+		return nil, false
+	}
+	for i, name := range globals {
+		if m.Bytecode.Globals[i] != name {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// writeCache writes to a temporary file first, another run reading the cache at the same time never sees half a file
+func writeCache(path string, m *Module) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := Encode(tmp, m); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,121 @@
+package bytecode
+
+import (
+	"MyInterpreter/code"
+	"MyInterpreter/object"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Disassemble prints the instructions of the main program and of every function in m
+// each source line is printed right before the first instruction that came from it
+func Disassemble(w io.Writer, m *Module, source string) {
+	d := &disassembler{w: w, module: m, lines: strings.Split(source, "\n")}
+
+	d.function("main", m.Bytecode.Instructions, m.Bytecode.SourceMap, nil)
+
+	for i, constant := range m.Bytecode.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+
+		fmt.Fprintln(w)
+		d.function(fmt.Sprintf("fn %s (constant %d)", name, i), fn.Instructions, fn.SourceMap, fn)
+	}
+}
+
+type disassembler struct {
+	w      io.Writer
+	module *Module
+	lines  []string
+}
+
+func (d *disassembler) function(title string, ins code.Instructions, sm code.SourceMap, fn *object.CompiledFunction) {
+	fmt.Fprintf(d.w, "== %s ==\n", title)
+
+	lastLine := 0
+	for ip := 0; ip < len(ins); {
+		if line := sm.Lookup(ip).Start.Line; line != lastLine && line > 0 && line <= len(d.lines) {
+			fmt.Fprintf(d.w, "%4d | %s\n", line, d.lines[line-1])
+			lastLine = line
+		}
+
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			fmt.Fprintf(d.w, "%04d ERROR: %s\n", ip, err)
+			ip++
+			continue
+		}
+
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+
+		text := def.Name
+		for _, o := range operands {
+			text += " " + strconv.Itoa(o)
+		}
+
+		if note := d.annotate(code.Opcode(ins[ip]), operands, fn); note != "" {
+			fmt.Fprintf(d.w, "%04d %-24s ; %s\n", ip, text, note)
+		} else {
+			fmt.Fprintf(d.w, "%04d %s\n", ip, text)
+		}
+
+		ip += 1 + read
+	}
+}
+
+// annotate says what an operand refers to, a constant's value or a variable's name
+func (d *disassembler) annotate(op code.Opcode, operands []int, fn *object.CompiledFunction) string {
+	bc := d.module.Bytecode
+
+	switch op {
+	case code.OpConstant, code.OpClosure:
+		return describeConstant(bc.Constants, operands[0])
+	case code.OpGetGlobal, code.OpSetGlobal:
+		return nameAt(bc.Globals, operands[0])
+	case code.OpGetBuiltin:
+		return nameAt(bc.Builtins, operands[0])
+	case code.OpGetLocal, code.OpSetLocal, code.OpGetCell, code.OpSetCell:
+		if fn != nil {
+			return nameAt(fn.Locals, operands[0])
+		}
+	case code.OpGetFree, code.OpSetFree, code.OpLoadFree:
+		if fn != nil {
+			return nameAt(fn.Free, operands[0])
+		}
+	}
+	return ""
+}
+
+func describeConstant(constants []object.Object, index int) string {
+	if index >= len(constants) {
+		return "?"
+	}
+
+	switch constant := constants[index].(type) {
+	case *object.String:
+		return strconv.Quote(constant.Value)
+	case *object.CompiledFunction:
+		if constant.Name != "" {
+			return "fn " + constant.Name
+		}
+		return "fn <anonymous>"
+	default:
+		return constant.Inspect()
+	}
+}
+
+func nameAt(names []string, index int) string {
+	if index >= len(names) {
+		return "?"
+	}
+	return names[index]
+}
@@ -0,0 +1,405 @@
+package cli
+
+import (
+	"MyInterpreter/bytecode"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/lexer"
+	"MyInterpreter/object"
+	"MyInterpreter/optimizer"
+	"MyInterpreter/parser"
+	"MyInterpreter/repl"
+	"MyInterpreter/vm"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Exit codes, the last ones are the usual sysexits.h values so shell scripts can tell what went wrong
+const (
+	ExitOK           = 0
+	ExitRuntimeError = 1  // the program raised an object.Error
+	ExitSyntaxError  = 2  // the program didn't parse or compile
+	ExitUsage        = 64 // bad command line
+	ExitNoInput      = 66 // the script can't be read
+	ExitInternal     = 70 // the vm itself broke
+	ExitCantCreate   = 73 // compile can't write the module
+)
+
+// ArgsName is the global holding the script arguments, an array of strings without the script name
+const ArgsName = "args"
+
+const usage = `usage: k2m [flags]                         start the REPL (or run stdin when it isn't a terminal)
+       k2m [flags] [run] file.k2m [args...]   run a script, or a module written by compile
+       k2m [flags] -e 'code' [args...]        run code from the command line and print its value
+       k2m [flags] - [args...]                run the program read from stdin
+       k2m [flags] disasm file.k2m            print a script's bytecode next to its source
+       k2m [flags] compile [-o out.k2mc] file.k2m
+
+flags:
+`
+
+type config struct {
+	engine  string
+	format  string
+	noCache bool
+	disasm  bool
+	checked bool
+	verbose bool
+	inline  int
+	depth   int
+	expr    string
+	output  string
+
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+func (c *config) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		io.WriteString(c.stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&c.engine, "engine", c.engine, "how code is run: eval (tree-walking evaluator) or vm (bytecode virtual machine) (default vm for scripts, which lets them load from the cache, eval otherwise)")
+	fs.StringVar(&c.format, "format", c.format, "how errors are printed: plain, color or json (default color on a terminal, plain otherwise)")
+	fs.BoolVar(&c.noCache, "no-cache", c.noCache, "always compile scripts instead of using the compiled copy from the cache")
+	fs.BoolVar(&c.disasm, "disasm", c.disasm, "print the bytecode instead of running the program")
+	fs.BoolVar(&c.checked, "checked", c.checked, "make integer overflow an error instead of switching to big numbers")
+	fs.BoolVar(&c.verbose, "verbose", c.verbose, "print a note for every piece of code the optimizer removed")
+	fs.IntVar(&c.inline, "inline-size", c.inline, "largest function body, in syntax tree nodes, the optimizer inlines at its calls (0 turns inlining off)")
+	fs.IntVar(&c.depth, "max-depth", c.depth, "most function calls that can be running at once, tail calls don't count")
+	fs.StringVar(&c.expr, "e", c.expr, "run `code` instead of a script")
+	return fs
+}
+
+// Main is the whole k2m command, it returns the process exit code
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &config{inline: optimizer.DefaultInlineSize, depth: object.DefaultMaxDepth, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	rest, code := c.parse("k2m", args)
+	if code >= 0 {
+		return code
+	}
+
+	if c.expr != "" {
+		return c.runSource("<command-line>", c.expr, rest, false)
+	}
+
+	if len(rest) == 0 {
+		if isTerminal(stdin) {
+			return c.startREPL()
+		}
+		return c.runStdin(rest)
+	}
+
+	switch rest[0] {
+	case "run":
+		rest, code = c.parse("k2m run", rest[1:])
+		if code >= 0 {
+			return code
+		}
+		if len(rest) == 0 {
+			return c.usageError("run needs a script")
+		}
+		return c.runFile(rest[0], rest[1:])
+	case "disasm":
+		rest, code = c.parse("k2m disasm", rest[1:])
+		if code >= 0 {
+			return code
+		}
+		if len(rest) != 1 {
+			return c.usageError("disasm needs exactly one script")
+		}
+		c.disasm = true
+		return c.runFile(rest[0], nil)
+	case "compile":
+		return c.compile(rest[1:])
+	case "repl":
+		return c.startREPL()
+	case "-":
+		return c.runStdin(rest[1:])
+	default:
+		// k2m file.k2m is what a shebang line runs
+		return c.runFile(rest[0], rest[1:])
+	}
+}
+
+// parse reads the flags at the start of args, a code >= 0 means Main should stop and exit with it
+func (c *config) parse(name string, args []string) ([]string, int) {
+	fs := c.flags(name)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ExitOK
+		}
+		return nil, ExitUsage
+	}
+
+	if c.engine != "" && c.engine != repl.EngineEval && c.engine != repl.EngineVM {
+		return nil, c.usageError(fmt.Sprintf("unknown engine %q, use eval or vm", c.engine))
+	}
+	if c.format != "" {
+		if _, err := diagnostics.ParseFormat(c.format); err != nil {
+			return nil, c.usageError(err.Error())
+		}
+	}
+	if c.inline < 0 {
+		return nil, c.usageError(fmt.Sprintf("-inline-size can't be negative, got %d", c.inline))
+	}
+	if c.depth < 1 {
+		return nil, c.usageError(fmt.Sprintf("-max-depth has to be at least 1, got %d", c.depth))
+	}
+	return fs.Args(), -1
+}
+
+func (c *config) usageError(message string) int {
+	fmt.Fprintf(c.stderr, "k2m: %s\n", message)
+
+	// A fresh config, so the defaults shown are the real ones and not what was just parsed
+	defaults := &config{inline: optimizer.DefaultInlineSize, depth: object.DefaultMaxDepth, stderr: c.stderr}
+	defaults.flags("k2m").Usage()
+	return ExitUsage
+}
+
+func (c *config) diagnosticsFormat() diagnostics.Format {
+	if c.format == "" {
+		return repl.DefaultFormat(c.stderr)
+	}
+	format, _ := diagnostics.ParseFormat(c.format)
+	return format
+}
+
+func (c *config) startREPL() int {
+	name := "there"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	fmt.Fprintf(c.stdout, "Hello %s! This is the Monkey programming language!\n", name)
+	fmt.Fprintf(c.stdout, "Feel free to type in commands\n")
+
+	format := repl.DefaultFormat(c.stdout)
+	if c.format != "" {
+		format = c.diagnosticsFormat()
+	}
+
+	repl.StartWithOptions(c.stdin, c.stdout, repl.Options{Format: format, Engine: c.engine, Checked: c.checked, Verbose: c.verbose, InlineSize: c.inline, MaxDepth: c.depth})
+	return ExitOK
+}
+
+func (c *config) runStdin(args []string) int {
+	source, err := io.ReadAll(c.stdin)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "k2m: cannot read stdin: %s\n", err)
+		return ExitNoInput
+	}
+	return c.runSource("<stdin>", stripShebang(string(source)), args, false)
+}
+
+func (c *config) runFile(filename string, args []string) int {
+	// Without -engine a script runs on the vm, the cache holds bytecode so only the vm can skip lexing and parsing
+	if c.engine == "" {
+		c.engine = repl.EngineVM
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "k2m: %s\n", err)
+		return ExitNoInput
+	}
+
+	if bytes.HasPrefix(content, []byte(bytecode.Magic)) {
+		module, err := bytecode.Decode(bytes.NewReader(content))
+		if err != nil {
+			fmt.Fprintf(c.stderr, "k2m: %s: %s\n", filename, err)
+			return ExitNoInput
+		}
+		return c.runModule(module, "", args)
+	}
+
+	return c.runSource(filename, stripShebang(string(content)), args, !c.noCache)
+}
+
+// stripShebang blanks out a "#!" first line, the newline stays so every position in the script is still right
+func stripShebang(source string) string {
+	if !strings.HasPrefix(source, "#!") {
+		return source
+	}
+	if newline := strings.IndexByte(source, '\n'); newline >= 0 {
+		return source[newline:]
+	}
+	return ""
+}
+
+func (c *config) runSource(filename, source string, args []string, cache bool) (code int) {
+	defer c.recoverInternal(&code)
+
+	renderer := diagnostics.NewRenderer(c.diagnosticsFormat(), source)
+
+	if c.engine == repl.EngineVM || c.disasm {
+		var module *bytecode.Module
+		var diags []diagnostics.Diagnostic
+		if cache && !c.verbose && c.inline == optimizer.DefaultInlineSize {
+			module, diags, _ = bytecode.Load(filename, source, ArgsName)
+		} else {
+			// A cached module was optimized by an earlier run with the default options, and verbose needs
+			// a fresh compile to have anything to report
+			module, diags = bytecode.CompileWith(c.optimizerOptions(renderer), filename, source, ArgsName)
+		}
+
+		if len(diags) != 0 {
+			renderer.Render(c.stderr, diags...)
+			return ExitSyntaxError
+		}
+		return c.runModule(module, source, args)
+	}
+
+	p := parser.NewParser(lexer.NewFileLexer(filename, source))
+	program := p.ParseProgram()
+	if len(p.Diagnostics()) != 0 {
+		renderer.Render(c.stderr, p.Diagnostics()...)
+		return ExitSyntaxError
+	}
+
+	env := object.NewEnvironment()
+	*env.Options() = c.runOptions()
+	env.Set(ArgsName, argsArray(args))
+
+	return c.finish(renderer, evaluator.Eval(optimizer.OptimizeWith(program, c.optimizerOptions(renderer)), env))
+}
+
+// optimizerOptions are the flags for the optimizer, its notes are printed with renderer when -verbose asked for them
+func (c *config) optimizerOptions(renderer *diagnostics.Renderer) optimizer.Options {
+	opts := optimizer.Options{InlineSize: c.inline}
+	if c.verbose {
+		opts.Report = func(note diagnostics.Diagnostic) {
+			renderer.Render(c.stderr, note)
+		}
+	}
+	return opts
+}
+
+// runOptions are the flags for the engines
+func (c *config) runOptions() object.Options {
+	return object.Options{CheckedArithmetic: c.checked, MaxDepth: c.depth}
+}
+
+func (c *config) runModule(module *bytecode.Module, source string, args []string) (code int) {
+	defer c.recoverInternal(&code)
+
+	if c.disasm {
+		bytecode.Disassemble(c.stdout, module, source)
+		return ExitOK
+	}
+
+	globals := make([]object.Object, vm.GlobalsSize)
+	for i, name := range module.Bytecode.Globals {
+		if name == ArgsName {
+			globals[i] = argsArray(args)
+		}
+	}
+
+	machine := vm.NewWithGlobalsStore(module.Bytecode, globals)
+	machine.SetOptions(c.runOptions())
+	if err := machine.Run(); err != nil {
+		fmt.Fprintf(c.stderr, "k2m: internal error: %s\n", err)
+		return ExitInternal
+	}
+
+	return c.finish(diagnostics.NewRenderer(c.diagnosticsFormat(), source), machine.Result())
+}
+
+// recoverInternal turns a panic in the interpreter into ExitInternal, Go's own exit status for it is 2 which is ExitSyntaxError
+func (c *config) recoverInternal(code *int) {
+	if r := recover(); r != nil {
+		fmt.Fprintf(c.stderr, "k2m: internal error: %v\n", r)
+		*code = ExitInternal
+	}
+}
+
+// finish reports a runtime error, a one-liner also gets its value printed
+func (c *config) finish(renderer *diagnostics.Renderer, result object.Object) int {
+	if errObj, ok := result.(*object.Error); ok {
+		renderer.Render(c.stderr, errObj.Diagnostic())
+		return ExitRuntimeError
+	}
+
+	if c.expr != "" && result != nil && result.Type() != object.VOID_OBJ {
+		io.WriteString(c.stdout, result.Inspect())
+		io.WriteString(c.stdout, "\n")
+	}
+	return ExitOK
+}
+
+func (c *config) compile(args []string) int {
+	fs := c.flags("k2m compile")
+	fs.StringVar(&c.output, "o", "", "where the module is written (default: the script name with a .k2mc extension)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if fs.NArg() != 1 {
+		return c.usageError("compile needs exactly one script")
+	}
+
+	filename := fs.Arg(0)
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "k2m: %s\n", err)
+		return ExitNoInput
+	}
+	source := stripShebang(string(content))
+
+	renderer := diagnostics.NewRenderer(c.diagnosticsFormat(), source)
+	module, diags := bytecode.CompileWith(c.optimizerOptions(renderer), filename, source, ArgsName)
+	if len(diags) != 0 {
+		renderer.Render(c.stderr, diags...)
+		return ExitSyntaxError
+	}
+
+	output := c.output
+	if output == "" {
+		output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".k2mc"
+	}
+
+	var buf bytes.Buffer
+	if err := bytecode.Encode(&buf, module); err != nil {
+		fmt.Fprintf(c.stderr, "k2m: %s\n", err)
+		return ExitInternal
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+		fmt.Fprintf(c.stderr, "k2m: %s\n", err)
+		return ExitCantCreate
+	}
+	return ExitOK
+}
+
+func argsArray(args []string) *object.Array {
+	elements := make([]object.Object, len(args))
+	for i, arg := range args {
+		elements[i] = &object.String{Value: arg}
+	}
+	return &object.Array{Elements: elements}
+}
+
+func isTerminal(in io.Reader) bool {
+	file, ok := in.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,248 @@
+package cli
+
+import (
+	"MyInterpreter/bytecode"
+	"MyInterpreter/code"
+	"MyInterpreter/compiler"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type result struct {
+	code           int
+	stdout, stderr string
+}
+
+func k2m(t *testing.T, stdin string, args ...string) result {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := Main(args, strings.NewReader(stdin), &stdout, &stderr)
+	return result{code, stdout.String(), stderr.String()}
+}
+
+func writeScript(t *testing.T, name, source string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOneLiners(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	tests := []struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"-e", "1 + 2 * 3"}, ExitOK, "7\n", ""},
+		{[]string{"-engine", "vm", "-e", "1 + 2 * 3"}, ExitOK, "7\n", ""},
+		{[]string{"-e", "let a = 1;"}, ExitOK, "", ""},
+		{[]string{"-e", "len(args)", "a", "b"}, ExitOK, "2\n", ""},
+		{[]string{"-engine", "vm", "-e", "args[1]", "a", "b"}, ExitOK, "b\n", ""},
+		{[]string{"-e", "foobar"}, ExitRuntimeError, "", "identifier not found: foobar"},
+		{[]string{"-engine", "vm", "-e", "1 + True"}, ExitRuntimeError, "", "<command-line>:1:1"},
+		{[]string{"-e", "let = 5"}, ExitSyntaxError, "", "error[E0101]"},
+		{[]string{"-engine", "vm", "-e", "let = 5"}, ExitSyntaxError, "", "error[E0101]"},
+		{[]string{"-e", "1 / 0"}, ExitRuntimeError, "", "error[E0208]: division by zero"},
+		{[]string{"-e", "2 ** 64"}, ExitOK, "18446744073709551616\n", ""},
+		{[]string{"-checked", "-e", "2 ** 64"}, ExitRuntimeError, "", "integer overflow: 2 ** 64"},
+		{[]string{"-checked", "-engine", "vm", "-e", "2 ** 64"}, ExitRuntimeError, "", "integer overflow: 2 ** 64"},
+		{[]string{"-verbose", "-e", "if (False) { 1 }; 2"}, ExitOK, "2\n", "note[N0401]: removed a branch that never runs"},
+		{[]string{"-verbose", "-engine", "vm", "-e", "let a = 1; 2"}, ExitOK, "2\n", "note[N0403]: removed unused variable a"},
+		{[]string{"-inline-size", "0", "-e", "let sq = fn(x) { x * x }; sq(3)"}, ExitOK, "9\n", ""},
+		{[]string{"-max-depth", "10", "-e", "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(20)"}, ExitRuntimeError, "", "error[E0213]: maximum recursion depth exceeded"},
+		{[]string{"-max-depth", "10", "-engine", "vm", "-e", "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(20)"}, ExitRuntimeError, "", "= note: in f, called at <command-line>:1:46"},
+		{[]string{"-max-depth", "10", "-engine", "vm", "-e", "let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(1000)"}, ExitOK, "0\n", ""},
+	}
+
+	for _, tt := range tests {
+		got := k2m(t, "", tt.args...)
+
+		if got.code != tt.code {
+			t.Errorf("%v: wrong exit code. want=%d, got=%d (stderr=%q)", tt.args, tt.code, got.code, got.stderr)
+		}
+		if got.stdout != tt.stdout {
+			t.Errorf("%v: wrong stdout. want=%q, got=%q", tt.args, tt.stdout, got.stdout)
+		}
+		if !strings.Contains(got.stderr, tt.stderr) {
+			t.Errorf("%v: stderr should contain %q, got=%q", tt.args, tt.stderr, got.stderr)
+		}
+	}
+}
+
+func TestInlineSize(t *testing.T) {
+	code := "let sq = fn(x) { x * x }; sq(3)"
+
+	if got := k2m(t, "", "-disasm", "-e", code); strings.Contains(got.stdout, "OpCall") {
+		t.Errorf("sq should be inlined by default, got=%q", got.stdout)
+	}
+	if got := k2m(t, "", "-disasm", "-inline-size", "0", "-e", code); !strings.Contains(got.stdout, "OpCall") {
+		t.Errorf("sq shouldn't be inlined with -inline-size 0, got=%q", got.stdout)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	// The shebang line is skipped but still counts, the error is on line 3
+	script := writeScript(t, "check.k2m", "#!/usr/bin/env k2m\nlet expected = 2;\nif (len(args) != expected) { wrongArgs }\n")
+
+	for _, engine := range []string{"eval", "vm"} {
+		for _, args := range [][]string{
+			{"-engine", engine, "run", script, "a", "b"},
+			{"-engine", engine, script, "a", "b"},
+			{"run", "-engine", engine, script, "a", "b"},
+		} {
+			if got := k2m(t, "", args...); got.code != ExitOK {
+				t.Errorf("%v: want success, got=%d (stderr=%q)", args, got.code, got.stderr)
+			}
+		}
+
+		got := k2m(t, "", "-engine", engine, "-format", "plain", script, "a")
+		if got.code != ExitRuntimeError {
+			t.Errorf("%s: want runtime error, got=%d", engine, got.code)
+		}
+		if !strings.Contains(got.stderr, "check.k2m:3:30") {
+			t.Errorf("%s: error should point at line 3 of the script, got=%q", engine, got.stderr)
+		}
+	}
+}
+
+// A script run without -engine goes through the cache, so the next run doesn't lex and parse it again
+func TestScriptsUseTheCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	script := writeScript(t, "cached.k2m", "if (1 + 2 != 3) { wrong }\n")
+	path, err := bytecode.CachePath(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := k2m(t, "", "run", script); got.code != ExitOK {
+			t.Fatalf("run %d: want success, got=%d (stderr=%q)", i, got.code, got.stderr)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("run %d: the script isn't in the cache: %s", i, err)
+		}
+	}
+}
+
+func TestStdin(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, ExitOK},
+		{[]string{"-"}, ExitOK},
+		{[]string{"-engine", "vm", "-", "x"}, ExitOK},
+	}
+
+	for _, tt := range tests {
+		if got := k2m(t, "let a = [1, 2];\na[0] + a[1];", tt.args...); got.code != tt.code {
+			t.Errorf("%v: want=%d, got=%d (stderr=%q)", tt.args, tt.code, got.code, got.stderr)
+		}
+	}
+
+	got := k2m(t, "let x = 1;\nx + y;", "-format", "json")
+	if got.code != ExitRuntimeError || !strings.Contains(got.stderr, `"line":2`) {
+		t.Errorf("want a json runtime error on line 2 of stdin, got code=%d stderr=%q", got.code, got.stderr)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-engine", "jit", "-e", "1"}, ExitUsage},
+		{[]string{"-format", "xml", "-e", "1"}, ExitUsage},
+		{[]string{"-inline-size", "-1", "-e", "1"}, ExitUsage},
+		{[]string{"-max-depth", "0", "-e", "1"}, ExitUsage},
+		{[]string{"-nope"}, ExitUsage},
+		{[]string{"run"}, ExitUsage},
+		{[]string{"disasm"}, ExitUsage},
+		{[]string{"compile"}, ExitUsage},
+		{[]string{"-h"}, ExitOK},
+		{[]string{"missing.k2m"}, ExitNoInput},
+		{[]string{"run", "missing.k2m"}, ExitNoInput},
+	}
+
+	for _, tt := range tests {
+		if got := k2m(t, "", tt.args...); got.code != tt.code {
+			t.Errorf("%v: want=%d, got=%d (stderr=%q)", tt.args, tt.code, got.code, got.stderr)
+		}
+	}
+}
+
+func TestCompileAndDisasm(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	script := writeScript(t, "mod.k2m", "let double = fn(x) { x * 2 };\nif (double(len(args)) != 4) { wrongArgs }\n")
+
+	if got := k2m(t, "", "compile", script); got.code != ExitOK {
+		t.Fatalf("compile failed: %d %q", got.code, got.stderr)
+	}
+
+	module := strings.TrimSuffix(script, ".k2m") + ".k2mc"
+	if got := k2m(t, "", "run", module, "a", "b"); got.code != ExitOK {
+		t.Errorf("running the compiled module failed: %d %q", got.code, got.stderr)
+	}
+	if got := k2m(t, "", "run", module, "a"); got.code != ExitRuntimeError {
+		t.Errorf("compiled module should fail with one argument, got=%d", got.code)
+	}
+
+	got := k2m(t, "", "disasm", script)
+	if got.code != ExitOK {
+		t.Fatalf("disasm failed: %d %q", got.code, got.stderr)
+	}
+	for _, want := range []string{"== main ==", "   1 | let double = fn(x) { x * 2 };", "== fn double (constant 1) ==", "OpMul"} {
+		if !strings.Contains(got.stdout, want) {
+			t.Errorf("disasm output is missing %q:\n%s", want, got.stdout)
+		}
+	}
+}
+
+// A module can hold bytecode the compiler would never write, the vm panicking on it is an internal error
+func TestInternalErrors(t *testing.T) {
+	broken := &bytecode.Module{
+		Filename: "broken.k2m",
+		Bytecode: &compiler.Bytecode{Instructions: code.Make(code.OpConstant, 7)},
+	}
+	var buf bytes.Buffer
+	if err := bytecode.Encode(&buf, broken); err != nil {
+		t.Fatal(err)
+	}
+
+	got := k2m(t, "", "run", writeScript(t, "broken.k2mc", buf.String()))
+	if got.code != ExitInternal || !strings.HasPrefix(got.stderr, "k2m: internal error: ") {
+		t.Errorf("want exit %d with an internal error, got=%d %q", ExitInternal, got.code, got.stderr)
+	}
+}
+
+func TestStripShebang(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"#!/usr/bin/env k2m\nlet a = 1;", "\nlet a = 1;"},
+		{"#!/usr/bin/env k2m", ""},
+		{"let a = 1;", "let a = 1;"},
+		{"# not a shebang", "# not a shebang"},
+	}
+
+	for _, tt := range tests {
+		if got := stripShebang(tt.input); got != tt.expected {
+			t.Errorf("stripShebang(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
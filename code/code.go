@@ -0,0 +1,260 @@
+package code
+
+import (
+	"MyInterpreter/token"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Instructions are the flat bytecode the vm runs, an opcode byte followed by its operands (big endian)
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota // Push constants[operand]
+	OpPop                    // Drop the top of the stack, expression statements leave nothing behind
+	OpDrop                   // Drop the top of the stack without making it the program's value
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpPow
+	OpEqual
+	OpNotEqual
+	OpGreaterThan
+	OpLessThan
+	OpGreaterEqual
+	OpLessEqual
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpShiftLeft
+	OpShiftRight
+
+	OpMinus
+	OpBang
+	OpBitNot
+
+	OpTrue
+	OpFalse
+	OpNull
+
+	OpJump          // Jump to operand
+	OpJumpNotTruthy // Pop, jump to operand if the value is not truthy
+
+	OpIter     // Replace the top of the stack with an iterator over it, the operand is 1 when the loop also wants the keys
+	OpIterNext // Push the next value and then key (if it was asked for) of the iterator on top, or jump to operand once it's done
+
+	OpGetGlobal
+	OpSetGlobal
+	OpGetLocal // Push the local slot as is, for captured locals that's the cell itself
+	OpSetLocal
+	OpGetCell // Push the value inside the cell stored in a local slot
+	OpSetCell
+	OpGetFree // Push the value inside one of the closure's captured cells
+	OpSetFree
+	OpLoadFree // Push one of the closure's captured cells as is, used to capture it again
+	OpGetBuiltin
+	OpUndefined // Fail like a read of a variable nothing declared, for an assignment to the builtin operand names
+
+	OpArray       // Build an array out of the top operand values
+	OpHash        // Build a hash out of the top operand values (key, value, key, value...)
+	OpInterpolate // Join the top operand values into one string
+	OpIndex
+	OpSetIndex // Pop value, index and the array or hash, then store the value at that index
+
+	OpCall        // Call the function below the top operand arguments
+	OpTailCall    // OpCall whose value is returned right away, a function being called takes over the caller's frame
+	OpReturnValue // Return the top of the stack
+	OpReturn      // Return Null
+	OpClosure     // Wrap constants[first operand] with the top second operand cells
+)
+
+type Definition struct {
+	Name          string
+	OperandWidths []int // in bytes
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant: {"OpConstant", []int{2}},
+	OpPop:      {"OpPop", []int{}},
+	OpDrop:     {"OpDrop", []int{}},
+
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpPow:          {"OpPow", []int{}},
+	OpEqual:        {"OpEqual", []int{}},
+	OpNotEqual:     {"OpNotEqual", []int{}},
+	OpGreaterThan:  {"OpGreaterThan", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpBitAnd:       {"OpBitAnd", []int{}},
+	OpBitOr:        {"OpBitOr", []int{}},
+	OpBitXor:       {"OpBitXor", []int{}},
+	OpShiftLeft:    {"OpShiftLeft", []int{}},
+	OpShiftRight:   {"OpShiftRight", []int{}},
+
+	OpMinus:  {"OpMinus", []int{}},
+	OpBang:   {"OpBang", []int{}},
+	OpBitNot: {"OpBitNot", []int{}},
+
+	OpTrue:  {"OpTrue", []int{}},
+	OpFalse: {"OpFalse", []int{}},
+	OpNull:  {"OpNull", []int{}},
+
+	OpJump:          {"OpJump", []int{2}},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
+
+	OpIter:     {"OpIter", []int{1}},
+	OpIterNext: {"OpIterNext", []int{2}},
+
+	OpGetGlobal:  {"OpGetGlobal", []int{2}},
+	OpSetGlobal:  {"OpSetGlobal", []int{2}},
+	OpGetLocal:   {"OpGetLocal", []int{1}},
+	OpSetLocal:   {"OpSetLocal", []int{1}},
+	OpGetCell:    {"OpGetCell", []int{1}},
+	OpSetCell:    {"OpSetCell", []int{1}},
+	OpGetFree:    {"OpGetFree", []int{1}},
+	OpSetFree:    {"OpSetFree", []int{1}},
+	OpLoadFree:   {"OpLoadFree", []int{1}},
+	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
+	OpUndefined:  {"OpUndefined", []int{1}},
+
+	OpArray:       {"OpArray", []int{2}},
+	OpHash:        {"OpHash", []int{2}},
+	OpInterpolate: {"OpInterpolate", []int{2}},
+	OpIndex:       {"OpIndex", []int{}},
+	OpSetIndex:    {"OpSetIndex", []int{}},
+
+	OpCall:        {"OpCall", []int{1}},
+	OpTailCall:    {"OpTailCall", []int{1}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+	OpClosure:     {"OpClosure", []int{2, 1}},
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// Make encodes one instruction, unknown opcodes give an empty instruction
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	instructionLen := 1
+	for _, w := range def.OperandWidths {
+		instructionLen += w
+	}
+
+	instruction := make([]byte, instructionLen)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		switch width {
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
+		}
+		offset += width
+	}
+
+	return instruction
+}
+
+// ReadOperands is the inverse of Make, it also says how many bytes the operands took
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
+		}
+		offset += width
+	}
+
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 { return binary.BigEndian.Uint16(ins) }
+func ReadUint8(ins Instructions) uint8   { return uint8(ins[0]) }
+
+// String disassembles the instructions, one "offset opcode operands" per line
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			i++
+			continue
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
+
+func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
+	operandCount := len(def.OperandWidths)
+
+	if len(operands) != operandCount {
+		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
+	}
+
+	switch operandCount {
+	case 0:
+		return def.Name
+	case 1:
+		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+	}
+
+	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+}
+
+// SourceMap tells which piece of source code an instruction came from, so the vm can point at it when something goes wrong
+// Entries are sorted by Offset, an entry covers every instruction up to the next one
+type SourceMap []SourceMapEntry
+
+type SourceMapEntry struct {
+	Offset int
+	Span   token.Span
+}
+
+func (sm SourceMap) Lookup(offset int) token.Span {
+	i := sort.Search(len(sm), func(i int) bool { return sm[i].Offset > offset })
+	if i == 0 {
+		return token.Span{}
+	}
+	return sm[i-1].Span
+}
@@ -0,0 +1,894 @@
+package compiler
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/code"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/object"
+	"MyInterpreter/token"
+	"fmt"
+	"sort"
+)
+
+// Bytecode is everything the vm needs to run a program
+type Bytecode struct {
+	Instructions code.Instructions
+	Constants    []object.Object
+	SourceMap    code.SourceMap
+	Globals      []string // Global names by index, for error messages
+	Builtins     []string // Builtin names by the index OpGetBuiltin uses
+}
+
+// State is what has to survive between two compilations for the REPL, every line is compiled on its own
+// but the variables and functions of the previous lines must still be there
+type State struct {
+	Symbols   *SymbolTable
+	Constants []object.Object
+	Builtins  []string
+}
+
+func NewState() *State {
+	return &State{Symbols: NewSymbolTable()}
+}
+
+type EmittedInstruction struct {
+	Opcode   code.Opcode
+	Position int
+}
+
+// CompilationScope holds the instructions of the function being compiled, the main program is a scope too
+type CompilationScope struct {
+	instructions        code.Instructions
+	sourceMap           code.SourceMap
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+
+	loops []*loop // Loops around the code being compiled, innermost last
+}
+
+// loop is a loop being compiled, breaks and continues are jumps patched once the loop knows where they go
+type loop struct {
+	label     string
+	breaks    []int
+	continues []int
+	iterator  bool // for-in loops keep their iterator on the stack
+}
+
+type Compiler struct {
+	constants   []object.Object
+	symbolTable *SymbolTable
+	builtins    []string
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	span token.Span // Source of the node being compiled, every emitted instruction is mapped to it
+
+	tooLarge error // The first operand that didn't fit its width, Compile stops with it
+}
+
+func New() *Compiler {
+	return NewWithState(NewState())
+}
+
+func NewWithState(s *State) *Compiler {
+	return &Compiler{
+		constants:   s.Constants,
+		symbolTable: s.Symbols,
+		builtins:    s.Builtins,
+		scopes:      []CompilationScope{{}},
+	}
+}
+
+// State gives back the compiler's state so the next compilation can continue where this one stopped
+func (c *Compiler) State() *State {
+	return &State{Symbols: c.symbolTable, Constants: c.constants, Builtins: c.builtins}
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	return &Bytecode{
+		Instructions: c.currentInstructions(),
+		Constants:    c.constants,
+		SourceMap:    c.scopes[c.scopeIndex].sourceMap,
+		Globals:      c.symbolTable.Global().Names(),
+		Builtins:     c.builtins,
+	}
+}
+
+// Compile returns a diagnostics.Diagnostic when the program can't be compiled
+func (c *Compiler) Compile(node ast.Node) (err error) {
+	previous := c.span
+	if span := ast.SpanOf(node); span.IsValid() {
+		c.span = span
+	}
+	defer func() {
+		c.span = previous
+		if err == nil {
+			err = c.tooLarge
+		}
+	}()
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+
+	case *ast.ExpressionStatement:
+		if err := c.Compile(node.Expression); err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+
+	case *ast.LetStatement:
+		// Functions already have their lets declared (see declareLets), for them Define just finds the slot
+		symbol := c.symbolTable.Define(node.Name.Value)
+
+		if fl, ok := node.Value.(*ast.FunctionLiteral); ok {
+			if err := c.compileFunction(fl, node.Name.Value); err != nil {
+				return err
+			}
+		} else if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+
+	case *ast.Assignment:
+		symbol := c.resolve(node.Variable.Value)
+		if symbol.Scope == BuiltinScope {
+			return c.assignBuiltin(symbol, node.Value)
+		}
+
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+
+		// Reading the variable first makes assigning to one that was never set an error, like in the evaluator
+		// OpDrop and not OpPop, the value read isn't the program's result
+		c.loadSymbol(symbol)
+		c.emit(code.OpDrop)
+		c.storeSymbol(symbol)
+
+	case *ast.IndexAssignment:
+		if err := c.Compile(node.Target.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Target.Index); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.emit(code.OpSetIndex)
+
+	case *ast.ReturnStatement:
+		if err := c.Compile(node.ReturnValue); err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+
+	case *ast.CompoundAssignment:
+		symbol := c.resolve(node.Variable.Value)
+		if symbol.Scope == BuiltinScope {
+			return c.assignBuiltin(symbol, node.Value)
+		}
+
+		op, ok := compoundOperators[node.Operator]
+		if !ok {
+			return c.errorf("unknown operator %s", node.Operator)
+		}
+
+		c.loadSymbol(symbol)
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.emit(op)
+		c.storeSymbol(symbol)
+
+	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogical(node)
+		}
+
+		op, ok := infixOperators[node.Operator]
+		if !ok {
+			return c.errorf("unknown operator %s", node.Operator)
+		}
+
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+		c.emit(op)
+
+	case *ast.PrefixExpression:
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(code.OpBang)
+		case "-":
+			c.emit(code.OpMinus)
+		case "~":
+			c.emit(code.OpBitNot)
+		default:
+			return c.errorf("unknown operator %s", node.Operator)
+		}
+
+	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			c.emit(code.OpConstant, c.addConstant(&object.BigInteger{Value: node.Big}))
+		} else {
+			c.emit(code.OpConstant, c.addConstant(&object.Integer{Value: node.Value}))
+		}
+
+	case *ast.FloatLiteral:
+		c.emit(code.OpConstant, c.addConstant(&object.Float{Value: node.Value}))
+
+	case *ast.StringLiteral:
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: node.Value}))
+
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+
+	case *ast.Identifier:
+		c.loadSymbol(c.resolve(node.Value))
+
+	case *ast.IfExpression:
+		// Every branch of an else if chain jumps straight to the end of the whole chain
+		var jumps []int
+		for ie := node; ie != nil; ie = ie.ElseIf {
+			if err := c.Compile(ie.Condition); err != nil {
+				return err
+			}
+
+			jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+			if err := c.compileBlockValue(ie.Consequence); err != nil {
+				return err
+			}
+
+			jumps = append(jumps, c.emit(code.OpJump, 9999))
+			c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+
+			if ie.ElseIf != nil {
+				continue
+			}
+			if ie.Alternative == nil {
+				c.emit(code.OpNull)
+			} else if err := c.compileBlockValue(ie.Alternative); err != nil {
+				return err
+			}
+		}
+
+		for _, pos := range jumps {
+			c.changeOperand(pos, len(c.currentInstructions()))
+		}
+
+	case *ast.WhileLoop:
+		loopStart := len(c.currentInstructions())
+		if err := c.Compile(node.Condition); err != nil {
+			return err
+		}
+
+		exitPos := c.emit(code.OpJumpNotTruthy, 9999)
+		l := c.enterLoop(node.Label)
+		if err := c.Compile(node.Consequence); err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStart)
+		c.leaveLoop(l, loopStart, len(c.currentInstructions()))
+
+		c.changeOperand(exitPos, len(c.currentInstructions()))
+		c.emit(code.OpNull)
+
+	case *ast.ForLoop:
+		if node.Init != nil {
+			if err := c.Compile(node.Init); err != nil {
+				return err
+			}
+		}
+
+		loopStart := len(c.currentInstructions())
+		exitPos := -1
+		if node.Condition != nil {
+			if err := c.Compile(node.Condition); err != nil {
+				return err
+			}
+			exitPos = c.emit(code.OpJumpNotTruthy, 9999)
+		}
+
+		l := c.enterLoop(node.Label)
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+
+		// continue still runs the post statement
+		postPos := len(c.currentInstructions())
+		if node.Post != nil {
+			if err := c.Compile(node.Post); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpJump, loopStart)
+		c.leaveLoop(l, postPos, len(c.currentInstructions()))
+
+		if exitPos >= 0 {
+			c.changeOperand(exitPos, len(c.currentInstructions()))
+		}
+		c.emit(code.OpNull)
+
+	case *ast.ForInLoop:
+		if err := c.Compile(node.Iterable); err != nil {
+			return err
+		}
+
+		// The iterator stays on the stack for the whole loop, break jumps to the OpPop that takes it off
+		withKeys := 0
+		if node.Key != nil {
+			withKeys = 1
+		}
+		c.emit(code.OpIter, withKeys)
+
+		loopStart := len(c.currentInstructions())
+		exitPos := c.emit(code.OpIterNext, 9999)
+
+		l := c.enterLoop(node.Label)
+		l.iterator = true
+		if node.Key != nil {
+			c.storeSymbol(c.symbolTable.Define(node.Key.Value))
+		}
+		c.storeSymbol(c.symbolTable.Define(node.Value.Value))
+
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStart)
+
+		exit := len(c.currentInstructions())
+		c.leaveLoop(l, loopStart, exit)
+		c.changeOperand(exitPos, exit)
+		c.emit(code.OpPop)
+		c.emit(code.OpNull)
+
+	case *ast.BreakStatement:
+		l, err := c.findLoop(node.Token.Literal, node.Label)
+		if err != nil {
+			return err
+		}
+		c.dropIterators(l)
+		l.breaks = append(l.breaks, c.emit(code.OpJump, 9999))
+
+	case *ast.ContinueStatement:
+		l, err := c.findLoop(node.Token.Literal, node.Label)
+		if err != nil {
+			return err
+		}
+		c.dropIterators(l)
+		l.continues = append(l.continues, c.emit(code.OpJump, 9999))
+
+	case *ast.FunctionLiteral:
+		return c.compileFunction(node, "")
+
+	case *ast.CallExpression:
+		if err := c.Compile(node.Function); err != nil {
+			return err
+		}
+		for _, a := range node.Arguments {
+			if err := c.Compile(a); err != nil {
+				return err
+			}
+		}
+		if node.Tail {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+
+	case *ast.InlinedCall:
+		return c.Compile(node.Value)
+
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			if err := c.Compile(e); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpArray, len(node.Elements))
+
+	case *ast.InterpolatedString:
+		for _, part := range node.Parts {
+			if err := c.Compile(part); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpInterpolate, len(node.Parts))
+
+	case *ast.HashLiteral:
+		// Go maps have no order, sorting the keys keeps the bytecode the same from one compilation to the next
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		for _, k := range keys {
+			if err := c.Compile(k); err != nil {
+				return err
+			}
+			if err := c.Compile(node.Pairs[k]); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpHash, len(node.Pairs)*2)
+
+	case *ast.IndexExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Index); err != nil {
+			return err
+		}
+		c.emit(code.OpIndex)
+
+	case *ast.BadStatement, *ast.BadExpression:
+		return c.errorf("cannot compile code that failed to parse")
+
+	default:
+		return c.errorf("cannot compile %T", node)
+	}
+
+	return nil
+}
+
+var infixOperators = map[string]code.Opcode{
+	"+":  code.OpAdd,
+	"-":  code.OpSub,
+	"*":  code.OpMul,
+	"/":  code.OpDiv,
+	"%":  code.OpMod,
+	"**": code.OpPow,
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	">":  code.OpGreaterThan,
+	"<":  code.OpLessThan,
+	">=": code.OpGreaterEqual,
+	"<=": code.OpLessEqual,
+	"&":  code.OpBitAnd,
+	"|":  code.OpBitOr,
+	"^":  code.OpBitXor,
+	"<<": code.OpShiftLeft,
+	">>": code.OpShiftRight,
+}
+
+var compoundOperators = map[string]code.Opcode{
+	"+=":  code.OpAdd,
+	"-=":  code.OpSub,
+	"*=":  code.OpMul,
+	"/=":  code.OpDiv,
+	"&=":  code.OpBitAnd,
+	"|=":  code.OpBitOr,
+	"^=":  code.OpBitXor,
+	"<<=": code.OpShiftLeft,
+	">>=": code.OpShiftRight,
+}
+
+func (c *Compiler) errorf(format string, a ...interface{}) error {
+	return diagnostics.Diagnostic{
+		Severity: diagnostics.Error,
+		Code:     diagnostics.CompileError,
+		Message:  fmt.Sprintf(format, a...),
+		Span:     c.span,
+	}
+}
+
+func (c *Compiler) enterLoop(label *ast.Identifier) *loop {
+	l := &loop{}
+	if label != nil {
+		l.label = label.Value
+	}
+
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, l)
+	return l
+}
+
+// leaveLoop points every continue of l at next and every break at end
+func (c *Compiler) leaveLoop(l *loop, next, end int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range l.continues {
+		c.changeOperand(pos, next)
+	}
+	for _, pos := range l.breaks {
+		c.changeOperand(pos, end)
+	}
+}
+
+// findLoop is the loop a break or continue belongs to, the parser already rejects the ones that have none
+// but an AST built by hand could still have them
+func (c *Compiler) findLoop(keyword string, label *ast.Identifier) (*loop, error) {
+	loops := c.scopes[c.scopeIndex].loops
+
+	for i := len(loops) - 1; i >= 0; i-- {
+		if label == nil || loops[i].label == label.Value {
+			return loops[i], nil
+		}
+	}
+
+	if label != nil {
+		return nil, c.errorf("%s to unknown label %s", keyword, label.Value)
+	}
+	return nil, c.errorf("%s outside of a loop", keyword)
+}
+
+// dropIterators pops the iterators of the for-in loops a break or continue to l jumps out of
+// l's own iterator stays, its exit pops it
+func (c *Compiler) dropIterators(l *loop) {
+	loops := c.scopes[c.scopeIndex].loops
+
+	for i := len(loops) - 1; i >= 0 && loops[i] != l; i-- {
+		if loops[i].iterator {
+			c.emit(code.OpPop)
+		}
+	}
+}
+
+// compileLogical compiles && and || as jumps, so the right side only runs when the left one didn't decide the result
+// the value left on the stack is True or False
+func (c *Compiler) compileLogical(node *ast.InfixExpression) error {
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	// False jumps are where the value is False, true jumps where it's True
+	var falseJumps, trueJumps []int
+	if node.Operator == "&&" {
+		falseJumps = append(falseJumps, c.emit(code.OpJumpNotTruthy, 9999))
+	} else {
+		rightPos := c.emit(code.OpJumpNotTruthy, 9999)
+		trueJumps = append(trueJumps, c.emit(code.OpJump, 9999))
+		c.changeOperand(rightPos, len(c.currentInstructions()))
+	}
+
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+	falseJumps = append(falseJumps, c.emit(code.OpJumpNotTruthy, 9999))
+
+	for _, pos := range trueJumps {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	c.emit(code.OpTrue)
+	endPos := c.emit(code.OpJump, 9999)
+
+	for _, pos := range falseJumps {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	c.emit(code.OpFalse)
+	c.changeOperand(endPos, len(c.currentInstructions()))
+	return nil
+}
+
+// compileBlockValue compiles the block of an if, which is an expression so the block has to leave its value on the stack
+// that's the last expression statement, or Null when the block doesn't end with one
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	if err := c.Compile(block); err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+	return nil
+}
+
+func (c *Compiler) compileFunction(fl *ast.FunctionLiteral, name string) error {
+	c.enterScope()
+
+	c.symbolTable.markCaptured(capturedNames(fl.Body))
+	for _, p := range fl.Parameters {
+		c.symbolTable.Define(p.Value)
+	}
+	c.declareLets(fl.Body)
+
+	if err := c.Compile(fl.Body); err != nil {
+		c.leaveScope()
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+
+	table := c.symbolTable
+	instructions, sourceMap := c.leaveScope()
+
+	fn := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     table.NumDefinitions(),
+		NumParameters: len(fl.Parameters),
+		Locals:        table.Names(),
+		Name:          name,
+		SourceMap:     sourceMap,
+	}
+	for i, local := range fn.Locals {
+		if table.store[local].Cell {
+			fn.Cells = append(fn.Cells, i)
+		}
+	}
+
+	// Captured cells go on the stack so OpClosure can grab them
+	for _, free := range table.FreeSymbols {
+		fn.Free = append(fn.Free, free.Name)
+		c.loadCell(free)
+	}
+
+	c.emit(code.OpClosure, c.addConstant(fn), len(table.FreeSymbols))
+	return nil
+}
+
+// declareLets gives every let of a function its slot before compiling the body
+// so a closure created before the let still captures the same variable the let assigns
+func (c *Compiler) declareLets(body *ast.BlockStatement) {
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FunctionLiteral:
+			return false
+		case *ast.LetStatement:
+			c.symbolTable.Define(node.Name.Value)
+		case *ast.ForInLoop:
+			if node.Key != nil {
+				c.symbolTable.Define(node.Key.Value)
+			}
+			c.symbolTable.Define(node.Value.Value)
+		}
+		return true
+	})
+}
+
+// capturedNames are the names used inside the functions nested in body, a local with one of these names
+// may be shared with a closure so it lives in a Cell
+func capturedNames(body *ast.BlockStatement) map[string]bool {
+	names := map[string]bool{}
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		fl, ok := node.(*ast.FunctionLiteral)
+		if !ok {
+			return true
+		}
+
+		ast.Inspect(fl.Body, func(inner ast.Node) bool {
+			if ident, ok := inner.(*ast.Identifier); ok {
+				names[ident.Value] = true
+			}
+			return true
+		})
+		return false
+	})
+
+	return names
+}
+
+// resolve never fails, a name nobody defined becomes a global that is never set
+// reading it is then an "identifier not found" error at runtime, just like in the evaluator
+func (c *Compiler) resolve(name string) Symbol {
+	if symbol, ok := c.symbolTable.Resolve(name); ok {
+		return symbol
+	}
+
+	global := c.symbolTable.Global()
+	if _, ok := evaluator.LookupBuiltin(name); ok {
+		c.builtins = append(c.builtins, name)
+		return global.defineBuiltin(len(c.builtins)-1, name)
+	}
+
+	return global.Define(name)
+}
+
+// assignBuiltin compiles an assignment to a builtin no let declared, like in the evaluator
+// the value is worked out and then the assignment fails at runtime, as if the name didn't exist
+func (c *Compiler) assignBuiltin(s Symbol, value ast.Expression) error {
+	if err := c.Compile(value); err != nil {
+		return err
+	}
+	c.emit(code.OpUndefined, s.Index)
+	return nil
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		if s.Cell {
+			c.emit(code.OpGetCell, s.Index)
+		} else {
+			c.emit(code.OpGetLocal, s.Index)
+		}
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		if s.Cell {
+			c.emit(code.OpSetCell, s.Index)
+		} else {
+			c.emit(code.OpSetLocal, s.Index)
+		}
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// loadCell pushes the cell itself instead of its value, s is a symbol of the enclosing function
+func (c *Compiler) loadCell(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpLoadFree, s.Index)
+	}
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1
+}
+
+func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	c.checkOperands(op, operands)
+	ins := code.Make(op, operands...)
+	pos := c.addInstruction(ins)
+
+	if c.span.IsValid() {
+		scope := &c.scopes[c.scopeIndex]
+		scope.sourceMap = append(scope.sourceMap, code.SourceMapEntry{Offset: pos, Span: c.span})
+	}
+
+	c.setLastInstruction(op, pos)
+	return pos
+}
+
+func (c *Compiler) addInstruction(ins []byte) int {
+	posNewInstruction := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].instructions = append(c.currentInstructions(), ins...)
+	return posNewInstruction
+}
+
+func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.previousInstruction = scope.lastInstruction
+	scope.lastInstruction = EmittedInstruction{Opcode: op, Position: pos}
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+}
+
+func (c *Compiler) removeLastPop() {
+	scope := &c.scopes[c.scopeIndex]
+	last := scope.lastInstruction
+
+	scope.instructions = scope.instructions[:last.Position]
+	for len(scope.sourceMap) > 0 && scope.sourceMap[len(scope.sourceMap)-1].Offset >= last.Position {
+		scope.sourceMap = scope.sourceMap[:len(scope.sourceMap)-1]
+	}
+	scope.lastInstruction = scope.previousInstruction
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+	copy(ins[pos:], newInstruction)
+}
+
+// changeOperand backpatches a jump once we know where it lands
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	c.checkOperands(op, []int{operand})
+	c.replaceInstruction(opPos, code.Make(op, operand))
+}
+
+// operandCounts says what each operand of an instruction counts, for the error when a program has too many of them
+var operandCounts = map[code.Opcode][]string{
+	code.OpConstant:      {"constants"},
+	code.OpJump:          {"bytes of code in one function"},
+	code.OpJumpNotTruthy: {"bytes of code in one function"},
+	code.OpIterNext:      {"bytes of code in one function"},
+	code.OpGetGlobal:     {"global variables"},
+	code.OpSetGlobal:     {"global variables"},
+	code.OpGetLocal:      {"local variables"},
+	code.OpSetLocal:      {"local variables"},
+	code.OpGetCell:       {"local variables"},
+	code.OpSetCell:       {"local variables"},
+	code.OpGetFree:       {"captured variables"},
+	code.OpSetFree:       {"captured variables"},
+	code.OpLoadFree:      {"captured variables"},
+	code.OpGetBuiltin:    {"builtins"},
+	code.OpUndefined:     {"builtins"},
+	code.OpArray:         {"array elements"},
+	code.OpHash:          {"hash keys and values"},
+	code.OpInterpolate:   {"parts in an interpolated string"},
+	code.OpCall:          {"arguments"},
+	code.OpTailCall:      {"arguments"},
+	code.OpClosure:       {"constants", "captured variables"},
+}
+
+// checkOperands keeps the first operand of op that doesn't fit its width, code.Make would silently cut it
+func (c *Compiler) checkOperands(op code.Opcode, operands []int) {
+	def, err := code.Lookup(byte(op))
+	if err != nil || c.tooLarge != nil {
+		return
+	}
+
+	for i, operand := range operands {
+		max := 1<<(8*def.OperandWidths[i]) - 1
+		if operand > max {
+			what := "operands"
+			if counts := operandCounts[op]; i < len(counts) {
+				what = counts[i]
+			}
+			c.tooLarge = c.errorf("too many %s for the bytecode, %d is more than %d", what, operand, max)
+			return
+		}
+	}
+}
+
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, CompilationScope{})
+	c.scopeIndex++
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() (code.Instructions, code.SourceMap) {
+	scope := c.scopes[c.scopeIndex]
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+	c.symbolTable = c.symbolTable.Outer
+
+	return scope.instructions, scope.sourceMap
+}
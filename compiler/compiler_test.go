@@ -0,0 +1,713 @@
+package compiler
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/code"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/lexer"
+	"MyInterpreter/object"
+	"MyInterpreter/parser"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type compilerTestCase struct {
+	input                string
+	expectedConstants    []interface{}
+	expectedInstructions []code.Instructions
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"mon" + "key"`, // 1 + 2 would already be folded by the parser
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1; 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-1 < 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "a && b",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),      // 0000
+				code.Make(code.OpJumpNotTruthy, 16), // 0003
+				code.Make(code.OpGetGlobal, 1),      // 0006
+				code.Make(code.OpJumpNotTruthy, 16), // 0009
+				code.Make(code.OpTrue),              // 0012
+				code.Make(code.OpJump, 17),          // 0013
+				code.Make(code.OpFalse),             // 0016
+				code.Make(code.OpPop),               // 0017
+			},
+		},
+		{
+			input:             "a || b",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),      // 0000
+				code.Make(code.OpJumpNotTruthy, 9),  // 0003
+				code.Make(code.OpJump, 15),          // 0006
+				code.Make(code.OpGetGlobal, 1),      // 0009
+				code.Make(code.OpJumpNotTruthy, 19), // 0012
+				code.Make(code.OpTrue),              // 0015
+				code.Make(code.OpJump, 20),          // 0016
+				code.Make(code.OpFalse),             // 0019
+				code.Make(code.OpPop),               // 0020
+			},
+		},
+		{
+			input:             "a % b <= a",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpLessEqual),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "a & b | ~a ^ b",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x <<= 4; x >> 2",
+			expectedConstants: []interface{}{1, 4, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 1; "x is ${x}!"`,
+			expectedConstants: []interface{}{1, "x is ", "!"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpInterpolate, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (True) { 10 }; 3333;",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpJump, 11),          // 0007
+				code.Make(code.OpNull),              // 0010
+				code.Make(code.OpPop),               // 0011
+				code.Make(code.OpConstant, 1),       // 0012
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+		{
+			input:             "if (True) { let a = 1; }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 14), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpSetGlobal, 0),      // 0007
+				code.Make(code.OpNull),              // 0010
+				code.Make(code.OpJump, 15),          // 0011
+				code.Make(code.OpNull),              // 0014
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+		{
+			// Both branches jump past the whole chain
+			input:             "if (True) { 10 } else if (False) { 20 } else { 30 }",
+			expectedConstants: []interface{}{10, 20, 30},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpJump, 23),          // 0007
+				code.Make(code.OpFalse),             // 0010
+				code.Make(code.OpJumpNotTruthy, 20), // 0011
+				code.Make(code.OpConstant, 1),       // 0014
+				code.Make(code.OpJump, 23),          // 0017
+				code.Make(code.OpConstant, 2),       // 0020
+				code.Make(code.OpPop),               // 0023
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "while (True) { 1 }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 11), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpPop),               // 0007
+				code.Make(code.OpJump, 0),           // 0008
+				code.Make(code.OpNull),              // 0011
+				code.Make(code.OpPop),               // 0012
+			},
+		},
+		{
+			input:             "while (True) { break; continue; }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 13), // 0001
+				code.Make(code.OpJump, 13),          // 0004
+				code.Make(code.OpJump, 0),           // 0007
+				code.Make(code.OpJump, 0),           // 0010
+				code.Make(code.OpNull),              // 0013
+				code.Make(code.OpPop),               // 0014
+			},
+		},
+		{
+			input:             "a: while (True) { while (False) { break a; } }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 19), // 0001
+				code.Make(code.OpFalse),             // 0004
+				code.Make(code.OpJumpNotTruthy, 14), // 0005
+				code.Make(code.OpJump, 19),          // 0008
+				code.Make(code.OpJump, 4),           // 0011
+				code.Make(code.OpNull),              // 0014
+				code.Make(code.OpPop),               // 0015
+				code.Make(code.OpJump, 0),           // 0016
+				code.Make(code.OpNull),              // 0019
+				code.Make(code.OpPop),               // 0020
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "for (let i = 0; i < 3; i += 1) { continue }",
+			expectedConstants: []interface{}{0, 3, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpSetGlobal, 0),      // 0003
+				code.Make(code.OpGetGlobal, 0),      // 0006
+				code.Make(code.OpConstant, 1),       // 0009
+				code.Make(code.OpLessThan),          // 0012
+				code.Make(code.OpJumpNotTruthy, 32), // 0013
+				code.Make(code.OpJump, 19),          // 0016
+				code.Make(code.OpGetGlobal, 0),      // 0019
+				code.Make(code.OpConstant, 2),       // 0022
+				code.Make(code.OpAdd),               // 0025
+				code.Make(code.OpSetGlobal, 0),      // 0026
+				code.Make(code.OpJump, 6),           // 0029
+				code.Make(code.OpNull),              // 0032
+				code.Make(code.OpPop),               // 0033
+			},
+		},
+		{
+			input:             "for (x in [1]) { break }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),  // 0000
+				code.Make(code.OpArray, 1),     // 0003
+				code.Make(code.OpIter, 0),      // 0006
+				code.Make(code.OpIterNext, 20), // 0008
+				code.Make(code.OpSetGlobal, 0), // 0011
+				code.Make(code.OpJump, 20),     // 0014
+				code.Make(code.OpJump, 8),      // 0017
+				code.Make(code.OpPop),          // 0020
+				code.Make(code.OpNull),         // 0021
+				code.Make(code.OpPop),          // 0022
+			},
+		},
+		{
+			// continue a leaves the inner loop, so its iterator is popped first
+			input:             "a: for (k, v in {}) { for (x in k) { continue a } }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),      // 0000
+				code.Make(code.OpIter, 1),      // 0003
+				code.Make(code.OpIterNext, 38), // 0005
+				code.Make(code.OpSetGlobal, 0), // 0008
+				code.Make(code.OpSetGlobal, 1), // 0011
+				code.Make(code.OpGetGlobal, 0), // 0014
+				code.Make(code.OpIter, 0),      // 0017
+				code.Make(code.OpIterNext, 32), // 0019
+				code.Make(code.OpSetGlobal, 2), // 0022
+				code.Make(code.OpPop),          // 0025
+				code.Make(code.OpJump, 5),      // 0026
+				code.Make(code.OpJump, 19),     // 0029
+				code.Make(code.OpPop),          // 0032
+				code.Make(code.OpNull),         // 0033
+				code.Make(code.OpPop),          // 0034
+				code.Make(code.OpJump, 5),      // 0035
+				code.Make(code.OpPop),          // 0038
+				code.Make(code.OpNull),         // 0039
+				code.Make(code.OpPop),          // 0040
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let one = 1; let two = one; two += 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			// Not defined anywhere, the vm reports it when it's read
+			input:             "foobar",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The read before the store is what reports a variable that was never set
+			input:             "let x = 1; x = 2;",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpDrop),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] = 2;",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a) { let b = a; b }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { len([]) }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpArray, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Both branches give the function its value, the argument f() doesn't
+			input: "fn(f) { if (f) { f() } else { return f(f()) } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 12),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 0),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// f is captured before its let runs, both must share the same cell
+			input: "fn(a) { let f = fn() { a + b }; let b = 1; f }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpClosure, 0, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetCell, 2),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { fn() { fn() { a } } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpLoadFree, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	program := parse("fn(a, b) { let c = fn() { a }; c }")
+	comp := New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn := comp.Bytecode().Constants[1].(*object.CompiledFunction)
+	if fn.NumLocals != 3 || fn.NumParameters != 2 {
+		t.Errorf("wrong locals. want 3 locals 2 parameters, got=%d locals %d parameters", fn.NumLocals, fn.NumParameters)
+	}
+	if len(fn.Cells) != 1 || fn.Cells[0] != 0 {
+		t.Errorf("only a should be a cell. got=%v", fn.Cells)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	program := parse("1;\nTrue + 2;")
+	comp := New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	add := len(code.Make(code.OpConstant, 0))*2 + len(code.Make(code.OpPop)) + len(code.Make(code.OpTrue))
+
+	if code.Opcode(bytecode.Instructions[add]) != code.OpAdd {
+		t.Fatalf("expected OpAdd at %d, got\n%s", add, bytecode.Instructions)
+	}
+
+	span := bytecode.SourceMap.Lookup(add)
+	if span.Start.String() != "2:1" || span.End.String() != "2:9" {
+		t.Errorf("wrong span for OpAdd. want=2:1-2:9, got=%s-%s", span.Start, span.End)
+	}
+}
+
+func TestCompilerState(t *testing.T) {
+	comp := New()
+	if err := comp.Compile(parse("let a = 1;")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	comp = NewWithState(comp.State())
+	if err := comp.Compile(parse("a + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	testInstructions(t, []code.Instructions{
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+	}, bytecode.Instructions)
+
+	if len(bytecode.Globals) != 1 || bytecode.Globals[0] != "a" {
+		t.Errorf("wrong globals. got=%v", bytecode.Globals)
+	}
+}
+
+// Operands that don't fit their width are an error instead of wrapping around, each case is right at its limit
+func TestOperandLimits(t *testing.T) {
+	repeat := func(n int, sep string, part func(int) string) string {
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = part(i)
+		}
+		return strings.Join(parts, sep)
+	}
+	x := func(int) string { return "x" }
+	// names made of letters only, identifiers can't hold digits
+	name := func(i int) string {
+		return string([]byte{byte('a' + i%26), byte('a' + i/26%26), byte('a' + i/676%26)})
+	}
+	locals := func(n int) string {
+		var b strings.Builder
+		b.WriteString("fn() { ")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "let %s = %d; ", name(i), i)
+		}
+		b.WriteString("}")
+		return b.String()
+	}
+
+	tests := []struct {
+		input    string
+		expected string // the error, empty when it compiles
+	}{
+		{repeat(65536, "; ", strconv.Itoa), ""},
+		{repeat(65537, "; ", strconv.Itoa), "too many constants for the bytecode, 65536 is more than 65535"},
+		{"let x = 1; [" + repeat(65535, ", ", x) + "]", ""},
+		{"let x = 1; [" + repeat(65536, ", ", x) + "]", "too many array elements for the bytecode, 65536 is more than 65535"},
+		{locals(256), ""},
+		{locals(257), "too many local variables for the bytecode, 256 is more than 255"},
+		// every x; is 4 bytes, the if's jumps land after 4n+14 and 4n+15 bytes
+		{"let x = 1; if (x) { " + repeat(16380, "; ", x) + " }", ""},
+		{"let x = 1; if (x) { " + repeat(16381, "; ", x) + " }", "too many bytes of code in one function for the bytecode, 65538 is more than 65535"},
+	}
+
+	for i, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		switch {
+		case tt.expected == "" && err != nil:
+			t.Errorf("test %d: compiler error: %s", i, err)
+		case tt.expected != "" && (err == nil || err.(diagnostics.Diagnostic).Message != tt.expected):
+			t.Errorf("test %d: expected error %q, got=%v", i, tt.expected, err)
+		}
+	}
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	return p.ParseProgram()
+}
+
+func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if !testInstructions(t, tt.expectedInstructions, bytecode.Instructions) {
+			t.Errorf("for input %q", tt.input)
+		}
+		testConstants(t, tt.expectedConstants, bytecode.Constants)
+	}
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+	return out
+}
+
+func testInstructions(t *testing.T, expected []code.Instructions, actual code.Instructions) bool {
+	t.Helper()
+
+	concatted := concatInstructions(expected)
+	if concatted.String() != actual.String() {
+		t.Errorf("wrong instructions.\nwant=\n%s\ngot=\n%s", concatted, actual)
+		return false
+	}
+	return true
+}
+
+func testConstants(t *testing.T, expected []interface{}, actual []object.Object) {
+	t.Helper()
+
+	if len(expected) != len(actual) {
+		t.Errorf("wrong number of constants. got=%d, want=%d", len(actual), len(expected))
+		return
+	}
+
+	for i, constant := range expected {
+		switch constant := constant.(type) {
+		case int:
+			integer, ok := actual[i].(*object.Integer)
+			if !ok || integer.Value != int64(constant) {
+				t.Errorf("constant %d - wrong integer. want=%d, got=%s", i, constant, actual[i].Inspect())
+			}
+		case string:
+			str, ok := actual[i].(*object.String)
+			if !ok || str.Value != constant {
+				t.Errorf("constant %d - wrong string. want=%q, got=%s", i, constant, actual[i].Inspect())
+			}
+		case []code.Instructions:
+			fn, ok := actual[i].(*object.CompiledFunction)
+			if !ok {
+				t.Errorf("constant %d - not a function: %T", i, actual[i])
+				continue
+			}
+			testInstructions(t, constant, fn.Instructions)
+		}
+	}
+}
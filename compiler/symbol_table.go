@@ -0,0 +1,121 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope  SymbolScope = "GLOBAL"
+	LocalScope   SymbolScope = "LOCAL"
+	BuiltinScope SymbolScope = "BUILTIN"
+	FreeScope    SymbolScope = "FREE"
+)
+
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+	Cell  bool // Local captured by an inner function, lives in a Cell instead of straight in its slot
+}
+
+// SymbolTable resolves names to slots at compile time, one table per function plus the global one
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store       map[string]Symbol
+	names       []string // Defined names by index
+	FreeSymbols []Symbol // Symbols of the enclosing functions this function captures, by free index
+	captured    map[string]bool
+	builtins    map[string]Symbol // Only used by the global table, checked after the globals just like the evaluator does
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{store: make(map[string]Symbol), captured: map[string]bool{}, builtins: map[string]Symbol{}}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+// Define binds name in this table, defining a name twice gives back the same symbol
+// just like a second let in the evaluator overwrites the variable in the same Environment
+func (s *SymbolTable) Define(name string) Symbol {
+	if symbol, ok := s.store[name]; ok && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		return symbol
+	}
+
+	symbol := Symbol{Name: name, Index: len(s.names), Cell: s.captured[name]}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+		symbol.Cell = false
+	} else {
+		symbol.Scope = LocalScope
+	}
+
+	s.store[name] = symbol
+	s.names = append(s.names, name)
+	return symbol
+}
+
+// Resolve finds name in this table or one of the enclosing ones
+// Locals of an enclosing function become free symbols of this one
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	symbol, ok := s.store[name]
+	if ok {
+		return symbol, ok
+	}
+
+	if s.Outer == nil {
+		symbol, ok = s.builtins[name]
+		return symbol, ok
+	}
+
+	symbol, ok = s.Outer.Resolve(name)
+	if !ok {
+		return symbol, ok
+	}
+
+	if symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol, ok
+	}
+
+	return s.defineFree(symbol), true
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1, Cell: true}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
+	s.builtins[name] = symbol
+	return symbol
+}
+
+// markCaptured flags names used by inner functions, locals defined afterwards with those names become cells
+func (s *SymbolTable) markCaptured(names map[string]bool) {
+	for name := range names {
+		s.captured[name] = true
+	}
+}
+
+// Global walks up to the global table
+func (s *SymbolTable) Global() *SymbolTable {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	return s
+}
+
+func (s *SymbolTable) NumDefinitions() int { return len(s.names) }
+
+// Names are the names defined in this table, by index
+func (s *SymbolTable) Names() []string {
+	names := make([]string, len(s.names))
+	copy(names, s.names)
+	return names
+}
@@ -0,0 +1,68 @@
+package compiler
+
+import "testing"
+
+func TestSymbolTable(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+	global.defineBuiltin(0, "len")
+
+	local := NewEnclosedSymbolTable(global)
+	local.markCaptured(map[string]bool{"c": true})
+	b := local.Define("b")
+	c := local.Define("c")
+
+	nested := NewEnclosedSymbolTable(local)
+	d := nested.Define("d")
+
+	tests := []struct {
+		table    *SymbolTable
+		name     string
+		expected Symbol
+	}{
+		{global, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{global, "len", Symbol{Name: "len", Scope: BuiltinScope, Index: 0}},
+		{local, "a", a},
+		{local, "b", b},
+		{local, "c", Symbol{Name: "c", Scope: LocalScope, Index: 1, Cell: true}},
+		{nested, "len", Symbol{Name: "len", Scope: BuiltinScope, Index: 0}},
+		{nested, "d", d},
+		{nested, "c", Symbol{Name: "c", Scope: FreeScope, Index: 0, Cell: true}},
+		{nested, "b", Symbol{Name: "b", Scope: FreeScope, Index: 1, Cell: true}},
+	}
+
+	for _, tt := range tests {
+		got, ok := tt.table.Resolve(tt.name)
+		if !ok {
+			t.Errorf("name %s not resolvable", tt.name)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", tt.name, tt.expected, got)
+		}
+	}
+
+	if len(nested.FreeSymbols) != 2 || nested.FreeSymbols[0] != c {
+		t.Errorf("wrong free symbols. got=%+v", nested.FreeSymbols)
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("local b should not be visible from the global scope")
+	}
+}
+
+func TestDefineTwice(t *testing.T) {
+	global := NewSymbolTable()
+	global.defineBuiltin(0, "len")
+
+	first := global.Define("a")
+	if second := global.Define("a"); second != first {
+		t.Errorf("defining a twice should give back the same slot. got=%+v and %+v", first, second)
+	}
+
+	// A global with a builtin's name hides the builtin, just like in the evaluator
+	shadow := global.Define("len")
+	if got, _ := global.Resolve("len"); got != shadow || got.Scope != GlobalScope {
+		t.Errorf("len should resolve to the global. got=%+v", got)
+	}
+}
@@ -0,0 +1,35 @@
+package diagnostics
+
+// Every diagnostic gets a stable code, so it can be looked up (and grepped for) no matter how the message is worded
+// E01xx are syntax errors reported by the lexer or the parser, E02xx are runtime errors reported by the evaluator or the vm
+// E03xx are errors reported by the compiler, N04xx are notes from the optimizer about code it removed
+const (
+	UnexpectedToken     = "E0101"
+	ExpectedExpr        = "E0102"
+	InvalidNumber       = "E0103"
+	ExpectedIdent       = "E0104"
+	OutsideLoop         = "E0105"
+	BadLabel            = "E0106"
+	BadAssignment       = "E0107"
+	UnterminatedString  = "E0108"
+	InvalidEscape       = "E0109"
+	UnterminatedComment = "E0110"
+	RuntimeError        = "E0200"
+	TypeMismatch        = "E0201"
+	UnknownOperator     = "E0202"
+	UndefinedIdent      = "E0203"
+	WrongArguments      = "E0204"
+	NotCallable         = "E0205"
+	UnusableHashKey     = "E0206"
+	UnsupportedIndex    = "E0207"
+	DivisionByZero      = "E0208"
+	IntegerOverflow     = "E0209"
+	InvalidExponent     = "E0210"
+	NotIterable         = "E0211"
+	InvalidShift        = "E0212"
+	RecursionLimit      = "E0213"
+	CompileError        = "E0300"
+	DeadCode            = "N0401"
+	UnreachableCode     = "N0402"
+	UnusedVariable      = "N0403"
+)
@@ -0,0 +1,234 @@
+package diagnostics
+
+import (
+	"MyInterpreter/token"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Diagnostic is anything the interpreter wants to tell the user about a piece of source code
+// The lexer, the parser and the evaluator all speak this language, so every problem gets rendered the same way
+type Diagnostic struct {
+	Severity Severity
+	Code     string // See codes.go
+	Message  string
+	Span     token.Span
+	Notes    []string
+}
+
+// Error makes a Diagnostic usable as a plain go error, "line:col: message"
+func (d Diagnostic) Error() string {
+	if d.Span.IsValid() {
+		return d.Span.Start.String() + ": " + d.Message
+	}
+	return d.Message
+}
+
+// FromError is err as a Diagnostic, an error that isn't one (a bug somewhere) becomes a compile error without a position
+func FromError(err error) Diagnostic {
+	var d Diagnostic
+	if errors.As(err, &d) {
+		return d
+	}
+	return Diagnostic{Severity: Error, Code: CompileError, Message: err.Error()}
+}
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Note
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Note:
+		return "note"
+	default:
+		return "error"
+	}
+}
+
+type Format int
+
+const (
+	Plain Format = iota // Source line + ^~~~ underline, no escape codes
+	Color               // Plain, but painted with ANSI escape codes for terminals
+	JSON                // One JSON object per line, for editors and other tools
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "plain":
+		return Plain, nil
+	case "color":
+		return Color, nil
+	case "json":
+		return JSON, nil
+	default:
+		return Plain, fmt.Errorf("unknown diagnostics format %q, want plain, color or json", name)
+	}
+}
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiYell  = "\x1b[33m"
+	ansiBlue  = "\x1b[34m"
+	ansiCyan  = "\x1b[36m"
+)
+
+// Renderer prints diagnostics that point into Source
+type Renderer struct {
+	Format Format
+	Source string
+	lines  []string
+}
+
+func NewRenderer(format Format, source string) *Renderer {
+	return &Renderer{Format: format, Source: source, lines: strings.Split(source, "\n")}
+}
+
+func (r *Renderer) Render(out io.Writer, diags ...Diagnostic) {
+	for _, d := range diags {
+		if r.Format == JSON {
+			r.renderJSON(out, d)
+		} else {
+			io.WriteString(out, r.renderText(d))
+		}
+	}
+}
+
+// renderText draws something like
+//
+//	error[E0101]: expected next token to be ), got ; instead
+//	 --> script.k2m:1:9
+//	  |
+//	1 | add(1, 2;
+//	  |         ^
+//	  = note: ...
+func (r *Renderer) renderText(d Diagnostic) string {
+	var out bytes.Buffer
+
+	header := d.Severity.String()
+	if d.Code != "" {
+		header += "[" + d.Code + "]"
+	}
+	out.WriteString(r.paint(ansiBold+severityColor(d.Severity), header))
+	out.WriteString(r.paint(ansiBold, ": "+d.Message))
+	out.WriteString("\n")
+
+	start := d.Span.Start
+	if !start.IsValid() || start.Line > len(r.lines) {
+		//Nothing to point at, the message has to stand on its own
+		if d.Span.IsValid() {
+			out.WriteString(" --> " + start.String() + "\n")
+		}
+		r.writeNotes(&out, "", d.Notes)
+		return out.String()
+	}
+
+	lineNumber := fmt.Sprintf("%d", start.Line)
+	gutter := strings.Repeat(" ", len(lineNumber))
+	line := strings.TrimRight(r.lines[start.Line-1], "\r")
+
+	out.WriteString(gutter + r.paint(ansiBlue, "--> ") + start.String() + "\n")
+	out.WriteString(gutter + r.paint(ansiBlue, " |") + "\n")
+	out.WriteString(r.paint(ansiBlue, lineNumber+" | ") + line + "\n")
+	out.WriteString(gutter + r.paint(ansiBlue, " | ") + padding(line, start.Column) +
+		r.paint(ansiBold+severityColor(d.Severity), underline(line, d.Span)) + "\n")
+
+	r.writeNotes(&out, gutter, d.Notes)
+	return out.String()
+}
+
+func (r *Renderer) writeNotes(out *bytes.Buffer, gutter string, notes []string) {
+	for _, note := range notes {
+		out.WriteString(gutter + r.paint(ansiBlue, " = ") + r.paint(ansiBold, "note") + ": " + note + "\n")
+	}
+}
+
+func (r *Renderer) paint(color, text string) string {
+	if r.Format != Color {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+func severityColor(s Severity) string {
+	switch s {
+	case Warning:
+		return ansiYell
+	case Note:
+		return ansiCyan
+	default:
+		return ansiRed
+	}
+}
+
+// padding lines the underline up with the source, tabs are kept as tabs so they take the same room
+// columns count characters, so é before the span is one space like it's one column
+func padding(line string, column int) string {
+	var out bytes.Buffer
+	chars := []rune(line)
+	for i := 0; i < column-1; i++ {
+		if i < len(chars) && chars[i] == '\t' {
+			out.WriteByte('\t')
+		} else {
+			out.WriteByte(' ')
+		}
+	}
+	return out.String()
+}
+
+// underline is "^" under the first char of the span and "~" under the rest of it
+// Spans that go past the end of the line are cut there, empty spans (like EOF) still get their "^"
+func underline(line string, span token.Span) string {
+	width := 1
+	if span.End.Line == span.Start.Line {
+		width = span.End.Column - span.Start.Column
+	} else if span.End.Line > span.Start.Line {
+		width = utf8.RuneCountInString(line) - span.Start.Column + 1
+	}
+	if width < 1 {
+		width = 1
+	}
+	return "^" + strings.Repeat("~", width-1)
+}
+
+type jsonDiagnostic struct {
+	Severity  string   `json:"severity"`
+	Code      string   `json:"code,omitempty"`
+	Message   string   `json:"message"`
+	File      string   `json:"file,omitempty"`
+	Line      int      `json:"line,omitempty"`
+	Column    int      `json:"column,omitempty"`
+	EndLine   int      `json:"endLine,omitempty"`
+	EndColumn int      `json:"endColumn,omitempty"`
+	Notes     []string `json:"notes,omitempty"`
+}
+
+func (r *Renderer) renderJSON(out io.Writer, d Diagnostic) {
+	encoded, _ := json.Marshal(jsonDiagnostic{
+		Severity:  d.Severity.String(),
+		Code:      d.Code,
+		Message:   d.Message,
+		File:      d.Span.Start.Filename,
+		Line:      d.Span.Start.Line,
+		Column:    d.Span.Start.Column,
+		EndLine:   d.Span.End.Line,
+		EndColumn: d.Span.End.Column,
+		Notes:     d.Notes,
+	})
+	out.Write(encoded)
+	io.WriteString(out, "\n")
+}
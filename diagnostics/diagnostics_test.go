@@ -0,0 +1,147 @@
+package diagnostics
+
+import (
+	"MyInterpreter/token"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func span(line, col, endLine, endCol int) token.Span {
+	return token.Span{
+		Start: token.Position{Filename: "test.k2m", Line: line, Column: col},
+		End:   token.Position{Filename: "test.k2m", Line: endLine, Column: endCol},
+	}
+}
+
+func TestRenderPlain(t *testing.T) {
+	source := "let a = 1;\nlet b = a + True;"
+
+	tests := []struct {
+		diag     Diagnostic
+		expected string
+	}{
+		{
+			Diagnostic{Severity: Error, Code: TypeMismatch, Message: "type mismatch: INTEGER + BOOLEAN", Span: span(2, 9, 2, 17)},
+			"error[E0201]: type mismatch: INTEGER + BOOLEAN\n" +
+				" --> test.k2m:2:9\n" +
+				"  |\n" +
+				"2 | let b = a + True;\n" +
+				"  |         ^~~~~~~~\n",
+		},
+		{
+			Diagnostic{Severity: Warning, Message: "unused variable", Span: span(1, 5, 1, 6), Notes: []string{"remove it"}},
+			"warning: unused variable\n" +
+				" --> test.k2m:1:5\n" +
+				"  |\n" +
+				"1 | let a = 1;\n" +
+				"  |     ^\n" +
+				"  = note: remove it\n",
+		},
+		{
+			// Spans over several lines are cut at the end of the first one
+			Diagnostic{Severity: Error, Message: "bad", Span: span(1, 9, 2, 3)},
+			"error: bad\n" +
+				" --> test.k2m:1:9\n" +
+				"  |\n" +
+				"1 | let a = 1;\n" +
+				"  |         ^~\n",
+		},
+		{
+			Diagnostic{Severity: Error, Message: "no position"},
+			"error: no position\n",
+		},
+	}
+
+	renderer := NewRenderer(Plain, source)
+	for _, tt := range tests {
+		var out bytes.Buffer
+		renderer.Render(&out, tt.diag)
+
+		if out.String() != tt.expected {
+			t.Errorf("wrong rendering.\nexpected=\n%s\ngot=\n%s", tt.expected, out.String())
+		}
+	}
+}
+
+func TestRenderKeepsTabs(t *testing.T) {
+	var out bytes.Buffer
+	NewRenderer(Plain, "\tfoo;").Render(&out, Diagnostic{Message: "x", Span: span(1, 2, 1, 5)})
+
+	if !strings.Contains(out.String(), "  | \t^~~\n") {
+		t.Errorf("underline is not aligned with the tab. got=\n%s", out.String())
+	}
+}
+
+// Columns count characters, é takes one column and one space in front of the underline
+func TestRenderCountsCharacters(t *testing.T) {
+	var out bytes.Buffer
+	NewRenderer(Plain, "s = \"é\"; x +").Render(&out, Diagnostic{Message: "x", Span: span(1, 10, 2, 1)})
+
+	if !strings.Contains(out.String(), "  |          ^~~\n") {
+		t.Errorf("underline is not aligned after the é. got=\n%s", out.String())
+	}
+}
+
+func TestRenderColor(t *testing.T) {
+	var out bytes.Buffer
+	NewRenderer(Color, "foo").Render(&out, Diagnostic{Message: "x", Span: span(1, 1, 1, 4)})
+
+	if !strings.Contains(out.String(), ansiRed) || !strings.Contains(out.String(), ansiReset) {
+		t.Errorf("colored output has no escape codes. got=%q", out.String())
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	var out bytes.Buffer
+	NewRenderer(JSON, "foo").Render(&out,
+		Diagnostic{Severity: Error, Code: UndefinedIdent, Message: "identifier not found: foo", Span: span(1, 1, 1, 4)},
+		Diagnostic{Severity: Note, Message: "second"},
+	)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per diagnostic, got %d", len(lines))
+	}
+
+	var decoded jsonDiagnostic
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatalf("output is not json: %s", err)
+	}
+
+	expected := jsonDiagnostic{Severity: "error", Code: "E0203", Message: "identifier not found: foo",
+		File: "test.k2m", Line: 1, Column: 1, EndLine: 1, EndColumn: 4}
+	if decoded.Severity != expected.Severity || decoded.Code != expected.Code || decoded.Message != expected.Message ||
+		decoded.File != expected.File || decoded.Line != expected.Line || decoded.Column != expected.Column ||
+		decoded.EndLine != expected.EndLine || decoded.EndColumn != expected.EndColumn {
+		t.Errorf("wrong json. expected=%+v, got=%+v", expected, decoded)
+	}
+}
+
+func TestFromError(t *testing.T) {
+	d := Diagnostic{Severity: Error, Code: CompileError, Message: "undefined variable x", Span: span(1, 1, 1, 2)}
+	if got := FromError(fmt.Errorf("compiling: %w", d)); got.Message != d.Message || got.Span != d.Span {
+		t.Errorf("wrapped diagnostic lost. got=%+v", got)
+	}
+
+	got := FromError(errors.New("something broke"))
+	if got.Code != CompileError || got.Message != "something broke" || got.Span.IsValid() {
+		t.Errorf("plain error not turned into a diagnostic. got=%+v", got)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, expected := range map[string]Format{"plain": Plain, "color": Color, "json": JSON} {
+		format, err := ParseFormat(name)
+		if err != nil || format != expected {
+			t.Errorf("ParseFormat(%q) = %v, %v", name, format, err)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
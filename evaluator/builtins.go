@@ -2,9 +2,20 @@ package evaluator
 
 import (
 	"MyInterpreter/object"
+	"MyInterpreter/packages/mymath"
 	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 )
 
+// LookupBuiltin is how the compiler and the vm get to the same builtins the evaluator uses
+func LookupBuiltin(name string) (*object.Builtin, bool) {
+	builtin, ok := builtins[name]
+	return builtin, ok
+}
+
 var builtins = map[string]*object.Builtin{
 	"len": &object.Builtin{
 		Fn: func(args ...object.Object) object.Object {
@@ -18,6 +29,8 @@ var builtins = map[string]*object.Builtin{
 				return &object.Integer{Value: int64(len(arg.Value))}
 			case *object.Array:
 				return &object.Integer{Value: int64(len(arg.Elements))}
+			case *object.Range:
+				return &object.Integer{Value: arg.Length}
 			default:
 				return newError("argument to `len` not supported, got %s", args[0].Type())
 			}
@@ -72,6 +85,120 @@ var builtins = map[string]*object.Builtin{
 
 		},
 	},
+	"int": &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *object.Integer, *object.BigInteger:
+				return arg
+			case *object.Float:
+				if math.IsNaN(arg.Value) || math.IsInf(arg.Value, 0) {
+					return newError("cannot convert %s to INTEGER", arg.Inspect())
+				}
+				value, _ := big.NewFloat(arg.Value).Int(nil) // Truncates, int(2.9) is 2 and int(-2.9) is -2
+				return object.IntegerFromBig(value)
+			case *object.String:
+				value, ok := new(big.Int).SetString(strings.TrimSpace(arg.Value), 0)
+				if !ok {
+					return newError("cannot convert %q to INTEGER", arg.Value)
+				}
+				return object.IntegerFromBig(value)
+			default:
+				return newError("argument to `int` not supported, got %s", args[0].Type())
+			}
+		},
+	},
+	"float": &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *object.Integer, *object.BigInteger:
+				return &object.Float{Value: toFloat(arg)}
+			case *object.Float:
+				return arg
+			case *object.String:
+				value, err := strconv.ParseFloat(strings.TrimSpace(arg.Value), 64)
+				if err != nil {
+					return newError("cannot convert %q to FLOAT", arg.Value)
+				}
+				return &object.Float{Value: value}
+			default:
+				return newError("argument to `float` not supported, got %s", args[0].Type())
+			}
+		},
+	},
+	"powmod": &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 3 {
+				return newError("wrong number of arguments. got=%d, want=3", len(args))
+			}
+			for _, arg := range args {
+				if arg.Type() != object.INTEGER_OBJ {
+					return newError("argument to `powmod` must be INTEGER, got %s", arg.Type())
+				}
+			}
+
+			base, exponent, modulus := toBig(args[0]), toBig(args[1]), toBig(args[2])
+			if modulus.Sign() == 0 {
+				return newError("division by zero: powmod(%s, %s, 0)", base, exponent)
+			}
+
+			//The usual case stays in int64, mymath.PowMod never overflows
+			if base.IsInt64() && exponent.IsInt64() && modulus.IsInt64() && exponent.Sign() >= 0 && modulus.Sign() > 0 {
+				return &object.Integer{Value: mymath.PowMod(base.Int64(), exponent.Int64(), modulus.Int64())}
+			}
+
+			//A negative exponent is the modular inverse raised to the opposite exponent, only some numbers have one
+			result := new(big.Int).Exp(base, exponent, new(big.Int).Abs(modulus))
+			if result == nil {
+				return newError("powmod: %s has no inverse modulo %s", base, modulus)
+			}
+			return object.IntegerFromBig(result)
+		},
+	},
+	"range": &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) < 1 || len(args) > 3 {
+				return newError("wrong number of arguments. got=%d, want=1 to 3", len(args))
+			}
+
+			bounds := make([]int64, len(args))
+			for i, arg := range args {
+				switch arg := arg.(type) {
+				case *object.Integer:
+					bounds[i] = arg.Value
+				case *object.BigInteger:
+					return newError("argument to `range` is too large: %s", arg.Inspect())
+				default:
+					return newError("argument to `range` must be INTEGER, got %s", arg.Type())
+				}
+			}
+
+			//range(end) and range(start, end) count up by 1
+			start, end, step := int64(0), bounds[0], int64(1)
+			if len(bounds) > 1 {
+				start, end = bounds[0], bounds[1]
+			}
+			if len(bounds) > 2 {
+				step = bounds[2]
+			}
+
+			if step == 0 {
+				return newError("range step can't be 0")
+			}
+			r, ok := object.NewRange(start, end, step)
+			if !ok {
+				return newError("range(%d, %d, %d) has too many elements", start, end, step)
+			}
+			return r
+		},
+	},
 	"print": &object.Builtin{
 		Fn: func(args ...object.Object) object.Object {
 			for _, arg := range args {
@@ -2,9 +2,13 @@ package evaluator
 
 import (
 	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/object"
 	"MyInterpreter/packages/mymath"
 	"fmt"
+	"math"
+	"math/big"
+	"strings"
 )
 
 var (
@@ -14,14 +18,40 @@ var (
 	VOID  = &object.Void{}
 )
 
+// maxNesting is how deep Eval can go into itself, whatever MaxDepth allows. A level takes around a kilobyte
+// of Go stack, so this stays far from the 1GB a goroutine can have, past that Go kills the whole process
+const maxNesting = 1 << 18
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	var result object.Object
+	if options := env.Options(); options.Nest(maxNesting) {
+		defer options.Unnest()
+		result = eval(node, env)
+	} else {
+		result = newError("maximum recursion depth exceeded")
+	}
+
+	//Errors bubble up through every Eval call on the way out, so the first (innermost) node
+	//that sees the error is the one that gets to say where it happened
+	if err, ok := result.(*object.Error); ok && !err.Span.IsValid() && node != nil {
+		err.Span = ast.SpanOf(node)
+	}
+	return result
+}
+
+func eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node, env)
 	case *ast.ExpressionStatement:
 		return Eval(node.Expression, env)
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return &object.BigInteger{Value: node.Big}
+		}
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.PrefixExpression:
@@ -29,8 +59,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return evalPrefixExpression(node.Operator, right, env.Options())
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
@@ -39,7 +73,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return evalInfixExpression(node.Operator, left, right, env.Options())
 	case *ast.BlockStatement:
 		return evalBlockStatements(node, env)
 	case *ast.IfExpression:
@@ -55,6 +89,10 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(val) {
 			return val
 		}
+		//Same as the compiler, only a function written right in the let gets its name
+		if _, ok := node.Value.(*ast.FunctionLiteral); ok {
+			val.(*object.Function).Name = node.Name.Value
+		}
 		env.Set(node.Name.Value, val)
 
 	case *ast.Identifier:
@@ -71,32 +109,73 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args)
+
+		//Only calls of functions are left for later, a builtin is done before the caller is anyway
+		if fn, ok := function.(*object.Function); ok && node.Tail {
+			if err := checkArguments(fn, args); err != nil {
+				return err
+			}
+			return &object.TailCall{Function: fn, Arguments: args}
+		}
+		return applyFunction(function, args, node)
+
+	case *ast.InlinedCall:
+		return Eval(node.Value, env)
 
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
+	case *ast.InterpolatedString:
+		parts := evalExpressions(node.Parts, env)
+		if len(parts) == 1 && isError(parts[0]) {
+			return parts[0]
+		}
+		return Interpolate(parts)
+
 	case *ast.CompoundAssignment:
-		value := Eval(node.Value, env).(*object.Integer)
+		value := Eval(node.Value, env)
 		if isError(value) {
 			return value
 		}
 
-		val, ok := env.Get(node.Variable.String())
+		val, ok := env.Get(node.Variable.Value)
 		if !ok {
-			fmt.Println("Error")
+			return newError("identifier not found: %s", node.Variable.Value)
+		}
+
+		//x += y is x = x + y, so it's the same arithmetic, overflow into big numbers included
+		result := evalInfixExpression(strings.TrimSuffix(node.Operator, "="), val, value, env.Options())
+		if isError(result) {
+			return result
+		}
+		env.Assign(node.Variable.Value, result)
+
+	case *ast.Assignment:
+		value := Eval(node.Value, env)
+		if isError(value) {
 			return value
 		}
 
-		switch node.Operator {
-		case "+=":
-			env.Set(node.Variable.String(), &object.Integer{Value: val.(*object.Integer).Value + value.Value})
-		case "-=":
-			env.Set(node.Variable.String(), &object.Integer{Value: val.(*object.Integer).Value - value.Value})
-		case "*=":
-			env.Set(node.Variable.String(), &object.Integer{Value: val.(*object.Integer).Value * value.Value})
-		case "/=":
-			env.Set(node.Variable.String(), &object.Integer{Value: val.(*object.Integer).Value / value.Value})
+		if !env.Assign(node.Variable.Value, value) {
+			return newError("identifier not found: %s", node.Variable.Value)
+		}
+
+	case *ast.IndexAssignment:
+		left := Eval(node.Target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(node.Target.Index, env)
+		if isError(index) {
+			return index
+		}
+		value := Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+
+		if err := SetIndex(left, index, value); err != nil {
+			return err
 		}
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
@@ -120,12 +199,85 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalHashLiteral(node, env)
 	case *ast.WhileLoop:
 		return evalWhileLoop(node, env)
+	case *ast.ForLoop:
+		return evalForLoop(node, env)
+	case *ast.ForInLoop:
+		return evalForInLoop(node, env)
+	case *ast.BreakStatement:
+		return &object.Break{Label: labelName(node.Label)}
+	case *ast.ContinueStatement:
+		return &object.Continue{Label: labelName(node.Label)}
+	case *ast.BadStatement, *ast.BadExpression:
+		return newError("cannot evaluate code that failed to parse")
 	}
 
 	return nil
 
 }
 
+// The operator semantics live here and nowhere else, the vm calls these instead of keeping its own copy
+// so both engines agree on what 1 + "a" or [1,2][-1] means
+
+func EvalInfix(operator string, left, right object.Object, options *object.Options) object.Object {
+	return evalInfixExpression(operator, left, right, options)
+}
+
+func EvalPrefix(operator string, right object.Object, options *object.Options) object.Object {
+	return evalPrefixExpression(operator, right, options)
+}
+
+func EvalIndex(left, index object.Object) object.Object {
+	return evalIndexExpression(left, index)
+}
+
+// SetIndex is left[index] = value, only arrays and hashes can be changed in place
+// the result is nil, or the error that stopped the assignment
+func SetIndex(left, index, value object.Object) *object.Error {
+	switch left := left.(type) {
+	case *object.Array:
+		var position int64
+		switch idx := index.(type) {
+		case *object.Integer:
+			position = idx.Value
+		case *object.BigInteger:
+			return newError("index out of range: %s, the array has %d elements", idx.Inspect(), len(left.Elements))
+		default:
+			return newError("%s can't be used as index", index.Type())
+		}
+
+		//Negative indexes count from the end, like reading does
+		if position < 0 {
+			position += int64(len(left.Elements))
+		}
+		if position < 0 || position >= int64(len(left.Elements)) {
+			return newError("index out of range: %s, the array has %d elements", index.Inspect(), len(left.Elements))
+		}
+
+		left.Elements[position] = value
+		return nil
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+		return nil
+
+	default:
+		return newError("index assignment not supported for %s", left.Type())
+	}
+}
+
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
+
+func NewError(format string, a ...interface{}) *object.Error {
+	return newError(format, a...)
+}
+
 func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
@@ -155,21 +307,25 @@ func nativeBoolToBooleanObject(value bool) *object.Boolean {
 	// We return our already existing Boolean object, just a small detail
 }
 
-func evalPrefixExpression(operator string, right object.Object) object.Object {
+func evalPrefixExpression(operator string, right object.Object, options *object.Options) object.Object {
 	switch operator {
 	case "!":
 		return evalBangOperatorExpression(right)
 	case "-":
-		return evalMinusPrefixOperatorExpression(right)
+		return evalMinusPrefixOperatorExpression(right, options)
+	case "~":
+		return evalBitNotPrefixOperatorExpression(right)
 	default:
 		return newError("unknown operator: %s%s", operator, right.Type())
 	}
 }
 
-func evalInfixExpression(operator string, left, right object.Object) object.Object {
+func evalInfixExpression(operator string, left, right object.Object, options *object.Options) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
-		return evalIntegerInfixExpression(operator, left, right)
+		return evalIntegerInfixExpression(operator, left, right, options)
+	case isNumber(left) && isNumber(right):
+		return evalFloatInfixExpression(operator, left, right)
 	case right.Type() == object.STRING_OBJ && left.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
 	case operator == "*": //This does not handle int multiplication, this is responsible for multiplication between strings and integers
@@ -185,25 +341,98 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
-func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+// evalLogicalExpression only evaluates the right side when the left one didn't decide the result already
+// the result is always a Boolean, whatever the operands were
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if isTruthy(left) == (node.Operator == "||") {
+		return nativeBoolToBooleanObject(isTruthy(left))
+	}
+
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
+func evalIntegerInfixExpression(operator string, left, right object.Object, options *object.Options) object.Object {
+	leftInt, leftSmall := left.(*object.Integer)
+	rightInt, rightSmall := right.(*object.Integer)
 
+	//A BigInteger is never 0, only a small one can be
+	if (operator == "/" || operator == "%") && rightSmall && rightInt.Value == 0 {
+		return newError("division by zero: %s %s 0", left.Inspect(), operator)
+	}
+
+	if !leftSmall || !rightSmall {
+		return evalBigIntegerInfixExpression(operator, left, right, options)
+	}
+
+	leftVal := leftInt.Value
+	rightVal := rightInt.Value
+
+	//The int64 operations are tried first, anything that overflows breaks out of the switch and is redone with big numbers
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		if result, ok := mymath.AddInt(leftVal, rightVal); ok {
+			return &object.Integer{Value: result}
+		}
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		if result, ok := mymath.SubInt(leftVal, rightVal); ok {
+			return &object.Integer{Value: result}
+		}
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		if result, ok := mymath.MulInt(leftVal, rightVal); ok {
+			return &object.Integer{Value: result}
+		}
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if leftVal != math.MinInt64 || rightVal != -1 {
+			return &object.Integer{Value: leftVal / rightVal}
+		}
+	case "%":
+		return &object.Integer{Value: leftVal % rightVal} // Takes the sign of the left side, like / truncates
+	case "&":
+		return &object.Integer{Value: leftVal & rightVal}
+	case "|":
+		return &object.Integer{Value: leftVal | rightVal}
+	case "^":
+		return &object.Integer{Value: leftVal ^ rightVal}
+	case ">>":
+		if rightVal < 0 {
+			return newError("invalid shift: negative shift count %d", rightVal)
+		}
+		return &object.Integer{Value: leftVal >> rightVal} // Shifting 64 or more leaves 0 or -1, same as big numbers
+	case "<<":
+		if rightVal < 0 {
+			return newError("invalid shift: negative shift count %d", rightVal)
+		}
+		//Shifting back tells if any bit fell off the end
+		if result := leftVal << rightVal; result>>rightVal == leftVal {
+			return &object.Integer{Value: result}
+		}
 	case "**":
-		return &object.Integer{Value: int64(mymath.Exponentiate(leftVal, rightVal))}
+		if rightVal < 0 {
+			if leftVal == 0 {
+				return newError("invalid exponent: 0 ** %d divides by zero", rightVal)
+			}
+			return &object.Float{Value: mymath.Exponentiate(leftVal, rightVal)} // 2 ** -1 is 0.5, not 0
+		}
+		if result, ok := mymath.PowInt(leftVal, rightVal); ok {
+			return &object.Integer{Value: result}
+		}
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	case "==":
@@ -211,6 +440,150 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
+
+	return evalBigIntegerInfixExpression(operator, left, right, options)
+}
+
+// maxBigExponent keeps x ** y from trying to build a number with billions of digits
+const maxBigExponent = 1 << 20
+
+// The results go through IntegerFromBig, so they're back to being an int64 Integer whenever they fit
+// In checked mode a result that doesn't fit is an error instead
+func evalBigIntegerInfixExpression(operator string, left, right object.Object, options *object.Options) object.Object {
+	leftVal := toBig(left)
+	rightVal := toBig(right)
+
+	var result *big.Int
+
+	switch operator {
+	case "+":
+		result = new(big.Int).Add(leftVal, rightVal)
+	case "-":
+		result = new(big.Int).Sub(leftVal, rightVal)
+	case "*":
+		result = new(big.Int).Mul(leftVal, rightVal)
+	case "/":
+		result = new(big.Int).Quo(leftVal, rightVal) // Quo truncates like int64 division does
+	case "%":
+		result = new(big.Int).Rem(leftVal, rightVal) // and Rem goes with Quo
+	case "**":
+		if rightVal.Sign() < 0 {
+			return &object.Float{Value: math.Pow(toFloat(left), toFloat(right))}
+		}
+		if leftVal.CmpAbs(big.NewInt(1)) > 0 && (!rightVal.IsInt64() || rightVal.Int64() > maxBigExponent) {
+			return newError("invalid exponent: %s ** %s is too large", leftVal, rightVal)
+		}
+		result = new(big.Int).Exp(leftVal, rightVal, nil)
+	case "&":
+		result = new(big.Int).And(leftVal, rightVal) // big.Int works as two's complement here, same results as int64
+	case "|":
+		result = new(big.Int).Or(leftVal, rightVal)
+	case "^":
+		result = new(big.Int).Xor(leftVal, rightVal)
+	case "<<", ">>":
+		if rightVal.Sign() < 0 {
+			return newError("invalid shift: negative shift count %s", rightVal)
+		}
+		if operator == ">>" {
+			//Past the last bit everything is 0 or -1, so a huge count can be cut down to that
+			count := uint(leftVal.BitLen() + 1)
+			if rightVal.IsInt64() && rightVal.Int64() < int64(count) {
+				count = uint(rightVal.Int64())
+			}
+			result = new(big.Int).Rsh(leftVal, count)
+			break
+		}
+		if leftVal.Sign() != 0 && (!rightVal.IsInt64() || rightVal.Int64() > maxBigExponent) {
+			return newError("invalid shift: %s << %s is too large", leftVal, rightVal)
+		}
+		result = new(big.Int).Lsh(leftVal, uint(rightVal.Uint64()))
+	case ">":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) > 0)
+	case "<":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) < 0)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) >= 0)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) <= 0)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) != 0)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) == 0)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+
+	if !result.IsInt64() && options.Checked() {
+		return newError("integer overflow: %s %s %s", left.Inspect(), operator, right.Inspect())
+	}
+	return object.IntegerFromBig(result)
+}
+
+func toBig(obj object.Object) *big.Int {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return big.NewInt(obj.Value)
+	case *object.BigInteger:
+		return obj.Value
+	}
+	return new(big.Int)
+}
+
+// Mixing an Integer with a Float gives a Float, just like in most languages
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	//Dividing by zero is an error like with integers, IEEE's Inf and NaN only come from overflow (1e308 * 10)
+	if (operator == "/" || operator == "%") && rightVal == 0 {
+		return newError("division by zero: %s %s %s", left.Inspect(), operator, right.Inspect())
+	}
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInteger:
+		value, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return value
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
 }
 
 func evalStringInfixExpression(operator string, left object.Object, right object.Object) object.Object {
@@ -221,6 +594,12 @@ func evalStringInfixExpression(operator string, left object.Object, right object
 		if left.Type() == right.Type() {
 			return newError("unknown operator: %s %s %s", left.Inspect(), operator, right.Inspect())
 		}
+		if _, ok := left.(*object.BigInteger); ok {
+			return newError("string can't be repeated %s times", left.Inspect())
+		}
+		if _, ok := right.(*object.BigInteger); ok {
+			return newError("string can't be repeated %s times", right.Inspect())
+		}
 		if left.Type() == object.INTEGER_OBJ && right.Type() == object.STRING_OBJ {
 			var string string
 			nloop := left.(*object.Integer).Value
@@ -238,9 +617,29 @@ func evalStringInfixExpression(operator string, left object.Object, right object
 		} else {
 			return newError(" %s operator not supported between %s and %s", operator, left.Type(), right.Type())
 		}
+	}
+
+	//Both are strings from here on, they compare byte by byte like Go does
+	if left.Type() != object.STRING_OBJ || right.Type() != object.STRING_OBJ {
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+	l, r := left.(*object.String).Value, right.(*object.String).Value
 
+	switch operator {
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	case "<":
+		return nativeBoolToBooleanObject(l < r)
+	case ">":
+		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
 	default:
-		return nil
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
@@ -257,28 +656,59 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 	}
 }
 
-func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+func evalMinusPrefixOperatorExpression(right object.Object, options *object.Options) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		if right.Value == math.MinInt64 {
+			if options.Checked() {
+				return newError("integer overflow: -(%d)", right.Value)
+			}
+			return object.IntegerFromBig(new(big.Int).Neg(big.NewInt(right.Value)))
+		}
+		return &object.Integer{Value: -right.Value}
+	case *object.BigInteger:
+		return object.IntegerFromBig(new(big.Int).Neg(right.Value))
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
+}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+func evalBitNotPrefixOperatorExpression(right object.Object) object.Object {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: ^right.Value}
+	case *object.BigInteger:
+		return object.IntegerFromBig(new(big.Int).Not(right.Value))
+	default:
+		return newError("unknown operator: ~%s", right.Type())
+	}
 }
 
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
-	if isError(condition) {
-		return condition
-	}
-	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
-	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
-	} else {
-		return NULL
+// Interpolate joins the parts of an interpolated string, every value is written the way Inspect writes it
+func Interpolate(parts []object.Object) *object.String {
+	var out strings.Builder
+	for _, part := range parts {
+		out.WriteString(part.Inspect())
 	}
+	return &object.String{Value: out.String()}
+}
 
+func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	//An else if chain is walked in a loop, however long it is
+	for ; ie != nil; ie = ie.ElseIf {
+		condition := Eval(ie.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if isTruthy(condition) {
+			return Eval(ie.Consequence, env)
+		} else if ie.Alternative != nil {
+			return Eval(ie.Alternative, env)
+		}
+	}
+	return NULL
 }
 
 func isTruthy(condition object.Object) bool {
@@ -302,7 +732,7 @@ func evalBlockStatements(block *ast.BlockStatement, env *object.Environment) obj
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -311,8 +741,37 @@ func evalBlockStatements(block *ast.BlockStatement, env *object.Environment) obj
 	return result
 }
 
+// errorCodes maps how an error message starts to its diagnostics code
+// anything that doesn't match is reported as a generic runtime error
+var errorCodes = []struct {
+	prefix string
+	code   string
+}{
+	{"type mismatch", diagnostics.TypeMismatch},
+	{"unknown operator", diagnostics.UnknownOperator},
+	{"identifier not found", diagnostics.UndefinedIdent},
+	{"wrong number of arguments", diagnostics.WrongArguments},
+	{"not a function", diagnostics.NotCallable},
+	{"unusable as hash", diagnostics.UnusableHashKey},
+	{"index operator not supported", diagnostics.UnsupportedIndex},
+	{"index assignment not supported", diagnostics.UnsupportedIndex},
+	{"division by zero", diagnostics.DivisionByZero},
+	{"integer overflow", diagnostics.IntegerOverflow},
+	{"invalid exponent", diagnostics.InvalidExponent},
+	{"not iterable", diagnostics.NotIterable},
+	{"invalid shift", diagnostics.InvalidShift},
+	{"maximum recursion depth", diagnostics.RecursionLimit},
+}
+
 func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+	code := diagnostics.RuntimeError
+	for _, ec := range errorCodes {
+		if strings.HasPrefix(format, ec.prefix) {
+			code = ec.code
+			break
+		}
+	}
+	return &object.Error{Message: fmt.Sprintf(format, a...), Code: code}
 }
 
 func isError(obj object.Object) bool {
@@ -349,14 +808,42 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// applyFunction makes call, fn and args are its already evaluated function and arguments
+func applyFunction(fn object.Object, args []object.Object, call *ast.CallExpression) object.Object {
 
 	switch fn := fn.(type) {
 
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args) // add parameters as local scope vars
-		evaluated := Eval(fn.Body, extendedEnv)    //evaluate BlockStatement
-		return unwrapReturnValue(evaluated)
+		if err := checkArguments(fn, args); err != nil {
+			return err
+		}
+		options := fn.Env.Options()
+		if !options.Enter() {
+			return newError("maximum recursion depth exceeded")
+		}
+		defer options.Leave()
+
+		//A call in tail position comes back as a TailCall instead of being made, it's made here
+		//after the body's Go frames are gone, so a chain of them (however long) runs in this one loop
+		for {
+			extendedEnv := extendFunctionEnv(fn, args) // add parameters as local scope vars
+			evaluated := Eval(fn.Body, extendedEnv)    //evaluate BlockStatement
+
+			result := unwrapReturnValue(evaluated)
+			if result == nil {
+				//A body ending in a let or an assignment has no value, the call still has one like in the vm
+				return NULL
+			}
+			tail, ok := result.(*object.TailCall)
+			if !ok {
+				//A recursion error lists the calls it went through, this one ends here
+				if err, ok := result.(*object.Error); ok && err.Code == diagnostics.RecursionLimit {
+					err.AddFrame(fn.Name, call.Pos())
+				}
+				return result
+			}
+			fn, args = tail.Function, tail.Arguments
+		}
 
 	case *object.Builtin:
 		return fn.Fn(args...)
@@ -366,6 +853,14 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 
 }
 
+// checkArguments is the vm's check, a call passes exactly one argument per parameter
+func checkArguments(fn *object.Function, args []object.Object) *object.Error {
+	if len(args) != len(fn.Parameters) {
+		return newError("wrong number of arguments: want=%d, got=%d", len(fn.Parameters), len(args))
+	}
+	return nil
+}
+
 func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
 	env := object.ScopedEnv(fn.Env)
 
@@ -389,6 +884,8 @@ func evalIndexExpression(left, index object.Object) object.Object {
 		return evalArrayIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.RANGE_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalRangeIndexExpression(left.(*object.Range), index)
 	default:
 		return newError("index operator not supported for %s", left.Type())
 	}
@@ -419,12 +916,34 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 	return &object.Hash{Pairs: pairs}
 }
 
+// evalRangeIndexExpression works like an array index, negative indexes count from the end
+func evalRangeIndexExpression(r *object.Range, index object.Object) object.Object {
+	idx, ok := index.(*object.Integer)
+	if !ok {
+		return NULL
+	}
+
+	position := idx.Value
+	if position < 0 {
+		position += r.Length
+	}
+
+	if position < 0 || position >= r.Length {
+		return NULL
+	}
+	return &object.Integer{Value: r.At(position)}
+}
+
 func evalArrayIndexExpression(left, index object.Object) object.Object {
 	array, ok := left.(*object.Array)
 	if !ok {
 		return newError("index operator not supported for %s", left.Type())
 	}
 
+	if _, ok := index.(*object.BigInteger); ok {
+		return NULL //Way past either end of the array
+	}
+
 	idx, ok := index.(*object.Integer)
 	if !ok {
 		return newError("%s can't be used as index", index.Type())
@@ -432,15 +951,17 @@ func evalArrayIndexExpression(left, index object.Object) object.Object {
 
 	max_index := int64(len(array.Elements) - 1)
 
-	if idx.Value < 0 {
-		idx.Value = max_index + idx.Value + 1
+	//idx might be a constant shared by every run of this code (the vm's constant pool), so it's never modified
+	position := idx.Value
+	if position < 0 {
+		position = max_index + position + 1
 	}
 
-	if idx.Value > max_index {
+	if position < 0 || position > max_index {
 		return NULL
 	}
 
-	return array.Elements[idx.Value]
+	return array.Elements[position]
 }
 
 func evalHashIndexExpression(hash, index object.Object) object.Object {
@@ -463,18 +984,183 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 }
 
 func evalWhileLoop(node *ast.WhileLoop, env *object.Environment) object.Object {
-	var WhileTrue object.Object
-	var evaluated object.Object
+	//A loop whose body never gave a value is Null, like in the vm
+	var evaluated object.Object = NULL
+	label := labelName(node.Label)
+
+	for {
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return evaluated
+		}
+
+		result := Eval(node.Consequence, env)
+
+		var done bool
+		if evaluated, done = afterBody(result, evaluated, label); done {
+			return evaluated
+		}
+	}
+}
+
+func evalForLoop(node *ast.ForLoop, env *object.Environment) object.Object {
+	if node.Init != nil {
+		if init := Eval(node.Init, env); isError(init) {
+			return init
+		}
+	}
+
+	var evaluated object.Object = NULL
+	label := labelName(node.Label)
+
+	for {
+		if node.Condition != nil {
+			condition := Eval(node.Condition, env)
+			if isError(condition) {
+				return condition
+			}
+			if !isTruthy(condition) {
+				return evaluated
+			}
+		}
+
+		result := Eval(node.Body, env)
+
+		var done bool
+		if evaluated, done = afterBody(result, evaluated, label); done {
+			return evaluated
+		}
+
+		if node.Post != nil {
+			if post := Eval(node.Post, env); isError(post) {
+				return post
+			}
+		}
+	}
+}
 
-	WhileTrue = Eval(node.Condition, env)
+func evalForInLoop(node *ast.ForInLoop, env *object.Environment) object.Object {
+	iterable := Eval(node.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
 
-	if isError(WhileTrue) {
-		return WhileTrue
+	iter := MakeIterator(iterable, node.Key != nil)
+	if isError(iter) {
+		return iter
 	}
+	next := iter.(*object.Iterator).Next
+
+	var evaluated object.Object = NULL
+	label := labelName(node.Label)
+
+	for {
+		key, value, ok := next()
+		if !ok {
+			return evaluated
+		}
+		if node.Key != nil {
+			env.Set(node.Key.Value, key)
+		}
+		env.Set(node.Value.Value, value)
 
-	for isTruthy(Eval(node.Condition, env)) {
-		evaluated = Eval(node.Consequence, env)
+		result := Eval(node.Body, env)
+
+		var done bool
+		if evaluated, done = afterBody(result, evaluated, label); done {
+			return evaluated
+		}
 	}
+}
 
-	return evaluated
+// afterBody decides what a loop does with what its body gave back, when done is true the loop is over and returns out
+// Returns and errors go up as they are, and so does a break or continue with another loop's label until it finds that loop
+func afterBody(result, evaluated object.Object, label string) (out object.Object, done bool) {
+	switch result := result.(type) {
+	case *object.ReturnValue, *object.Error:
+		return result, true
+	case *object.Break:
+		if result.Label != "" && result.Label != label {
+			return result, true
+		}
+		return evaluated, true
+	case *object.Continue:
+		if result.Label != "" && result.Label != label {
+			return result, true
+		}
+		return evaluated, false
+	case nil:
+		return NULL, false //The body ended with a let
+	default:
+		return result, false
+	}
+}
+
+// MakeIterator is what a for-in loop goes through, keys are only worked out when withKeys is set
+// arrays and hashes are copied first, so changing them inside the loop doesn't change what the loop sees
+func MakeIterator(obj object.Object, withKeys bool) object.Object {
+	i := 0
+
+	switch obj := obj.(type) {
+	case *object.Array:
+		elements := append([]object.Object(nil), obj.Elements...)
+		return &object.Iterator{Next: func() (object.Object, object.Object, bool) {
+			if i >= len(elements) {
+				return nil, nil, false
+			}
+			i++
+			return indexKey(withKeys, int64(i-1)), elements[i-1], true
+		}}
+	case *object.Hash:
+		pairs := obj.SortedPairs()
+		return &object.Iterator{Next: func() (object.Object, object.Object, bool) {
+			if i >= len(pairs) {
+				return nil, nil, false
+			}
+			i++
+			//With a single name the loop goes through the keys
+			if !withKeys {
+				return nil, pairs[i-1].Key, true
+			}
+			return pairs[i-1].Key, pairs[i-1].Value, true
+		}}
+	case *object.String:
+		//One rune at a time, the index is the rune's position and not its byte offset
+		runes := []rune(obj.Value)
+		return &object.Iterator{Next: func() (object.Object, object.Object, bool) {
+			if i >= len(runes) {
+				return nil, nil, false
+			}
+			i++
+			return indexKey(withKeys, int64(i-1)), &object.String{Value: string(runes[i-1])}, true
+		}}
+	case *object.Range:
+		var n int64
+		return &object.Iterator{Next: func() (object.Object, object.Object, bool) {
+			if n >= obj.Length {
+				return nil, nil, false
+			}
+			n++
+			return indexKey(withKeys, n-1), &object.Integer{Value: obj.At(n - 1)}, true
+		}}
+	default:
+		return newError("not iterable: %s", obj.Type())
+	}
+}
+
+func indexKey(withKeys bool, i int64) object.Object {
+	if !withKeys {
+		return nil
+	}
+	return &object.Integer{Value: i}
+}
+
+func labelName(label *ast.Identifier) string {
+	if label == nil {
+		return ""
+	}
+	return label.Value
 }
@@ -1,11 +1,18 @@
-package evaluator
+package evaluator_test
 
 import (
+	"MyInterpreter/ast"
+	"MyInterpreter/compiler"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/evaluator"
 	"MyInterpreter/lexer"
 	"MyInterpreter/object"
 	"MyInterpreter/parser"
+	"MyInterpreter/vm"
 	"encoding/csv"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -33,18 +40,105 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testIntegerObject(t, evaluated, tt.expected)
 	}
 }
 
-func testEval(input string) object.Object {
+// testEval runs input with the evaluator and with the compiler + vm, the test fails if they don't agree
+// the evaluator's result is the one that gets checked by the caller
+func testEval(t *testing.T, input string) object.Object {
+	return testEvalWithOptions(t, input, object.Options{})
+}
+
+func testEvalWithOptions(t *testing.T, input string, options object.Options) object.Object {
 	l := lexer.NewLexer(input)
 	p := parser.NewParser(l)
 	program := p.ParseProgram()
 	env := object.NewEnvironment()
+	*env.Options() = options
+
+	evaluated := evaluator.Eval(program, env)
+
+	if compiled := testRun(t, program, options); !sameObject(evaluated, compiled) {
+		t.Errorf("engines disagree on %q. evaluator=%s, vm=%s", input, describe(evaluated), describe(compiled))
+	}
+
+	return evaluated
+}
+
+func testRun(t *testing.T, program *ast.Program, options object.Options) object.Object {
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		return &object.Error{Message: err.Error()}
+	}
+
+	machine := vm.New(comp.Bytecode())
+	machine.SetOptions(options)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	return machine.Result()
+}
+
+func sameObject(expected, actual object.Object) bool {
+	if expected == nil || actual == nil {
+		return expected == actual
+	}
+	if expected.Type() != actual.Type() {
+		return false
+	}
 
-	return Eval(program, env)
+	switch expected := expected.(type) {
+	case *object.Integer:
+		return expected.Value == actual.(*object.Integer).Value
+	case *object.Float:
+		return expected.Value == actual.(*object.Float).Value
+	case *object.Boolean:
+		return expected.Value == actual.(*object.Boolean).Value
+	case *object.String:
+		return expected.Value == actual.(*object.String).Value
+	case *object.Error:
+		err := actual.(*object.Error)
+		return expected.Message == err.Message && expected.Span == err.Span
+	case *object.Array:
+		elements := actual.(*object.Array).Elements
+		if len(expected.Elements) != len(elements) {
+			return false
+		}
+		for i := range elements {
+			if !sameObject(expected.Elements[i], elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		pairs := actual.(*object.Hash).Pairs
+		if len(expected.Pairs) != len(pairs) {
+			return false
+		}
+		for key, pair := range expected.Pairs {
+			other, ok := pairs[key]
+			if !ok || !sameObject(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+	case *object.Function:
+		return true //The evaluator's Function and the vm's Closure can't be compared, they only share the type
+	default:
+		return expected.Inspect() == actual.Inspect()
+	}
+}
+
+func describe(obj object.Object) string {
+	if obj == nil {
+		return "nil"
+	}
+	if err, ok := obj.(*object.Error); ok {
+		return fmt.Sprintf("%s (%s-%s)", err.Inspect(), err.Span.Start, err.Span.End)
+	}
+	return fmt.Sprintf("%T(%s)", obj, obj.Inspect())
 }
 
 func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
@@ -61,6 +155,124 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"3.5", "3.5"},
+		{"-0.25", "-0.25"},
+		{"1e3", "1000.0"},
+		{"1.5 + 2", "3.5"},
+		{"2 * 1.5", "3.0"},
+		{"10 / 4.0", "2.5"},
+		{"7.5 - 0.5", "7.0"},
+		{"2 ** -1", "0.5"},
+		{"2.0 ** 3", "8.0"},
+		{"1 / 0.0", "Error at 1:1: division by zero: 1 / 0.0"},
+		{"-1.5 % 0", "Error at 1:1: division by zero: -1.5 % 0"},
+		{"let x = 2.5; x /= 0.0; x", "Error at 1:14: division by zero: 2.5 / 0.0"},
+		{"1e308 * 10", "Inf"},
+		{"-1e308 * 10", "-Inf"},
+		{"1.5 < 2", "true"},
+		{"2 > 2.5", "false"},
+		{"2.0 == 2", "true"},
+		{"0.1 + 0.2 != 0.3", "true"},
+		{"10 / 4", "2"},
+		{`{1: "one"}[1.0]`, "one"},
+		{`float(3) + int(2.9)`, "5.0"},
+		{`float("2.5") * int("4")`, "10.0"},
+		{`int(-2.9)`, "-2"},
+		{`float("abc")`, `Error at 1:1: cannot convert "abc" to FLOAT`},
+		{`int(1e308 * 10)`, "Error at 1:1: cannot convert Inf to INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestBigIntegers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"-9223372036854775807 - 2", "-9223372036854775809"},
+		{"4294967296 * 4294967296", "18446744073709551616"},
+		{"2 ** 70", "1180591620717411303424"},
+		{"(-2) ** 63", "-9223372036854775808"},
+		{"-9223372036854775808 / -1", "9223372036854775808"},
+		{"-(-9223372036854775807 - 1)", "9223372036854775808"},
+		{"123456789012345678901234567890", "123456789012345678901234567890"},
+		{"123456789012345678901234567890 * 0", "0"},
+		{"2 ** 70 / 2 ** 69", "2"},
+		{"2 ** 70 - 2 ** 70 + 5", "5"},
+		{"2 ** 70 > 2 ** 69", "true"},
+		{"2 ** 64 == 18446744073709551616", "true"},
+		{"2 ** 64 != 2 ** 64 + 1", "true"},
+		{"2 ** 64 * 0.5", "9.223372036854776e+18"},
+		{"2 ** -70 > 0", "true"},
+		{"let x = 1; let i = 0; while (i < 100) { x *= 2; i += 1; }; x", "1267650600228229401496703205376"},
+		{`{2 ** 70: "big"}[1180591620717411303424]`, "big"},
+		{`{2 ** 70: "big"}[2.0 ** 70]`, "big"},
+		{"[1, 2, 3][2 ** 70]", "Null"},
+		{`int("99999999999999999999")`, "99999999999999999999"},
+		{"int(1e20)", "100000000000000000000"},
+		{"float(2 ** 70)", "1.1805916207174113e+21"},
+		{"2 ** 9999999999", "Error at 1:1: invalid exponent: 2 ** 9999999999 is too large"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+
+	//Results that fit go back to being plain int64 Integers
+	if _, ok := testEval(t, "2 ** 70 / 2 ** 69").(*object.Integer); !ok {
+		t.Errorf("2 ** 70 / 2 ** 69 was not demoted to an Integer")
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775807 + 1", "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", "integer overflow: -9223372036854775807 - 2"},
+		{"4294967296 * 4294967296", "integer overflow: 4294967296 * 4294967296"},
+		{"2 ** 64", "integer overflow: 2 ** 64"},
+		{"let x = -9223372036854775807 - 1; -x", "integer overflow: -(-9223372036854775808)"},
+		{"let x = -9223372036854775807 - 1; x / -1", "integer overflow: -9223372036854775808 / -1"},
+		{"let x = 4611686018427387904; x *= 2; x", "integer overflow: 4611686018427387904 * 2"},
+		{"2 ** 62 + (2 ** 62 - 1)", "9223372036854775807"},
+		{"99999999999999999999 - 99999999999999999998", "1"},
+		{"let n = 1; n << 63", "integer overflow: 1 << 63"},
+		{"let n = 1; n << 62", "4611686018427387904"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithOptions(t, tt.input, object.Options{CheckedArithmetic: true})
+
+		got := evaluated.Inspect()
+		if errObj, ok := evaluated.(*object.Error); ok {
+			got = errObj.Message
+			if errObj.Code != diagnostics.IntegerOverflow {
+				t.Errorf("%s: wrong error code. got=%s", tt.input, errObj.Code)
+			}
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input  string
@@ -88,7 +300,7 @@ func TestEvalBooleanExpression(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testBooleanObject(t, evaluated, tt.expect)
 	}
 }
@@ -121,11 +333,73 @@ func TestBangOperator(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testBooleanObject(t, evaluated, tt.expect)
 	}
 }
 
+func TestLogicalAndComparisonOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 5; x >= 0 && x < 10", "true"},
+		{"let x = 5; x > 5 || x <= 4", "false"},
+		{"let x = 5; x >= 5 && x <= 5", "true"},
+		{"1.5 >= 1.5", "true"},
+		{"2 <= 1.5", "false"},
+		{"2 ** 64 >= 2 ** 63", "true"},
+		{"let f = 0; f <= 0 && f >= 0", "true"},
+		// The right side doesn't run when the left one already decided
+		{"let boom = fn() { 1 + True }; False && boom()", "false"},
+		{"let boom = fn() { 1 + True }; True || boom()", "true"},
+		{"let n = 0; let bump = fn() { n += 1; True }; False && bump(); True || bump(); n", "0"},
+		{"let n = 0; let bump = fn() { n += 1; True }; True && bump(); False || bump(); n", "2"},
+		{"let a = 1; let b = [];  a && b", "true"},
+		{"let boom = fn() { 1 + True }; True && boom()", "Error at 1:19: type mismatch: INTEGER + BOOLEAN"},
+		{"let a = 7; let b = 3; [a % b, -a % b, a % -b]", "[1,-1,1]"},
+		{"let a = 7.5; a % 2", "1.5"},
+		{"2 ** 70 % 1000", "424"},
+		{"let z = 0; 5 % z", "Error at 1:12: division by zero: 5 % 0"},
+		{"let z = 0; 2 ** 70 % z", "Error at 1:12: division by zero: 1180591620717411303424 % 0"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = 12; let b = 10; [a & b, a | b, a ^ b, ~a]", "[8,14,6,-13]"},
+		{"let a = -8; [a & 255, a | 1, a ^ -1]", "[248,-7,7]"},
+		{"let n = 1; [n << 10, 1024 >> n, -16 >> 2, 5 >> 64, -5 >> 100]", "[1024,512,-4,0,-1]"},
+		{"let n = 1; n << 63", "9223372036854775808"},
+		{"let n = 3; n << 100 >> 99", "6"},
+		{"let big = 2 ** 70; [big & (2 ** 69 + 1), big | 1, ~big, big >> 68, big >> 1000]", "[0,1180591620717411303425,-1180591620717411303425,4,0]"},
+		{"let flags = 0; flags |= 1 << 3; flags |= 1; flags &= ~1; flags ^= 16; flags <<= 2; flags >>= 1; flags", "48"},
+		{"let x = 5; x & 1 == 1", "true"},
+		{"let mode = 0o755; [mode & 0o700, mode >> 6, 0xFF ^ 0b1010_1010]", "[448,7,85]"},
+		{"let s = -1; 1 << s", "Error at 1:13: invalid shift: negative shift count -1"},
+		{"let n = 1; n << 2 ** 40", "Error at 1:12: invalid shift: 1 << 1099511627776 is too large"},
+		{"let f = 1.5; f & 1", "Error at 1:14: unknown operator: FLOAT & INTEGER"},
+		{"~True", "Error at 1:1: unknown operator: ~BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestIfElseExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -138,10 +412,14 @@ func TestIfElseExpressions(t *testing.T) {
 		{"if (1 > 2) {10}", nil},
 		{"if (1 > 2) {10} else {20}", 20},
 		{"if (1 < 2) {10} else {20}", 10},
+		{"if (1 > 2) {10} else if (2 > 1) {20} else {30}", 20},
+		{"if (1 > 2) {10} else if (2 > 3) {20} else {30}", 30},
+		{"if (1 > 2) {10} else if (2 > 3) {20}", nil},
+		{"let x = 3; if (x == 1) {10} else if (x == 2) {20} else if (x == 3) {30} else if (x == 4) {40}", 30},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -152,7 +430,7 @@ func TestIfElseExpressions(t *testing.T) {
 }
 
 func testNullObject(t *testing.T, obj object.Object) bool {
-	if obj != NULL {
+	if obj != evaluator.NULL {
 		t.Errorf("object is not NULL, got=%T (%+v)", obj, obj)
 		return false
 	}
@@ -178,7 +456,7 @@ func TestReturnStatements(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testIntegerObject(t, evaluated, tt.expected)
 	}
 }
@@ -206,10 +484,20 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) {x}];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{"10 / 0", "division by zero: 10 / 0"},
+		{"let x = 5; x /= 0; x", "division by zero: 5 / 0"},
+		{"2 ** 70 / (3 - 3)", "division by zero: 1180591620717411303424 / 0"},
+		{"0 ** -2", "invalid exponent: 0 ** -2 divides by zero"},
+		{"let g = fn(a) { a }; g(1, 2)", "wrong number of arguments: want=1, got=2"},
+		{"let g = fn(a, b) { a }; g(1)", "wrong number of arguments: want=2, got=1"},
+		{"let g = fn(a) { a }; let f = fn() { g() }; f()", "wrong number of arguments: want=1, got=0"},
+		// A builtin can't be assigned, it's a variable nothing declared
+		{"len = 5", "identifier not found: len"},
+		{"let f = fn() { len += 1 }; f()", "identifier not found: len"},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 
 		errObj, ok := evaluated.(*object.Error)
 		if !ok {
@@ -222,6 +510,66 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestErrorSpans(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedStart string
+		expectedEnd   string
+	}{
+		{"True + 5;", "1:1", "1:9"},
+		{"let a = 1;\nlet b = [a, foobar];", "2:13", "2:19"},
+		{"let f = fn(x) { -x };\n\nf(True);", "1:17", "1:19"},
+		{`len(1)`, "1:1", "1:7"},
+		{"let f = fn(x) { 10 / x };\nf(0)", "1:17", "1:23"},
+		{"let x = 1;\nx /= 0;", "2:1", "2:7"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got %T(%v)", evaluated, evaluated)
+			continue
+		}
+		if errObj.Span.Start.String() != tt.expectedStart || errObj.Span.End.String() != tt.expectedEnd {
+			t.Errorf("wrong error span for %q. expected=%s-%s, got=%s-%s",
+				tt.input, tt.expectedStart, tt.expectedEnd, errObj.Span.Start, errObj.Span.End)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedCode string
+	}{
+		{"True + 5;", diagnostics.TypeMismatch},
+		{"-True", diagnostics.UnknownOperator},
+		{"foobar", diagnostics.UndefinedIdent},
+		{`len("one", "two")`, diagnostics.WrongArguments},
+		{`len(1)`, diagnostics.RuntimeError},
+		{"1 / 0", diagnostics.DivisionByZero},
+		{"2 ** 99999999999", diagnostics.InvalidExponent},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got %T(%v)", evaluated, evaluated)
+			continue
+		}
+		if errObj.Code != tt.expectedCode {
+			t.Errorf("wrong error code for %q. expected=%s, got=%s", tt.input, tt.expectedCode, errObj.Code)
+		}
+		if errObj.Diagnostic().Message != errObj.Message {
+			t.Errorf("diagnostic lost the message. got=%q", errObj.Diagnostic().Message)
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -234,14 +582,105 @@ func TestLetStatements(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		testIntegerObject(t, testEval(tt.input), tt.expected)
+		testIntegerObject(t, testEval(t, tt.input), tt.expected)
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 1; x = x + 1; x", "2"},
+		{"let x = 1; let f = fn() { x = 10 }; f(); x", "10"},
+		{"let x = 1; let f = fn(x) { x = 10; x }; [f(5), x]", "[10,1]"},
+		{"let counter = fn() { let n = 0; fn() { n = n + 1; n } }; let c = counter(); c(); c(); c()", "3"},
+		{"let counter = fn() { let n = 0; fn() { n += 1; n } }; let a = counter(); let b = counter(); a(); a(); [a(), b()]", "[3,1]"},
+		{"let n = 0; for (let i = 0; i < 5; i = i + 1) { n = n + i }; n", "10"},
+		{"let a = [1, 2, 3]; a[0] = 10; a[-1] = 30; a", "[10,2,30]"},
+		{"let a = [1, 2]; let b = a; b[1] = 5; a", "[1,5]"},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; [h["a"], h["b"]]`, "[2,3]"},
+		{"let m = [[0, 0], [0, 0]]; m[1][0] = 7; m", "[[0,0],[7,0]]"},
+		{"y = 1", "Error at 1:1: identifier not found: y"},
+		{"y += 1", "Error at 1:1: identifier not found: y"},
+		{"let f = fn() { z = 1 }; f()", "Error at 1:16: identifier not found: z"},
+		{"let a = [1]; a[1] = 2", "Error at 1:14: index out of range: 1, the array has 1 elements"},
+		{`let a = [1]; a["x"] = 2`, "Error at 1:14: STRING can't be used as index"},
+		{`let h = {}; h[[1]] = 2`, "Error at 1:13: unusable as hash key: ARRAY"},
+		{`"abc"[0] = "x"`, "Error at 1:1: index assignment not supported for STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated == nil || evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%v", tt.input, tt.expected, evaluated)
+		}
+	}
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let i = 0; while (i < 5) { i += 1; }; i", "5"},
+		{"let f = fn() { let i = 0; while (True) { i += 1; if (i == 3) { return i * 10; } }; -1 }; f()", "30"},
+		{"let i = 0; while (True) { i += 1; if (i == 4) { break; } }; i", "4"},
+		{"let i = 0; let odd = 0; while (i < 10) { i += 1; if (i / 2 * 2 == i) { continue; } odd += 1; }; odd", "5"},
+		{"let n = 0; let i = 0; outer: while (i < 3) { i += 1; let j = 0; while (j < 3) { j += 1; if (j == 2) { continue outer; } n += 1; } }; n", "3"},
+		{"let n = 0; outer: while (True) { while (True) { n += 1; break outer; }; n += 100; }; n", "1"},
+		{"let i = 0; while (i < 3) { i += 1; i + True; }; i", "Error at 1:36: type mismatch: INTEGER + BOOLEAN"},
+		{"let i = 0; while (i + True) { i += 1 }", "Error at 1:19: type mismatch: INTEGER + BOOLEAN"},
+		{"let f = fn(n) { n * 2 }; let i = 1; while (f(i) < 20) { i += 1 }; i", "10"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let n = 0; for (let i = 0; i < 5; i += 1) { n += i }; n", "10"},
+		{"let n = 0; for (let i = 0; ; i += 1) { if (i == 4) { break } n += 1 }; n", "4"},
+		{"let n = 0; for (let i = 0; i < 10; i += 1) { if (i / 2 * 2 == i) { continue } n += i }; n", "25"},
+		{"let f = fn(n) { let total = 0; for (let i = 1; i < n + 1; i += 1) { total += i }; total }; f(100)", "5050"},
+		{"let n = 0; for (x in [1, 2, 3]) { n += x }; n", "6"},
+		{"let n = 0; for (i, x in [10, 20, 30]) { n += i * x }; n", "80"},
+		{`let ks = []; for (k in {"b": 1, "a": 2, 3: 3}) { let ks = push(ks, k) }; ks`, "[3,a,b]"},
+		{`let ps = []; for (k, v in {"b": 1, "a": 2}) { let ps = push(ps, [k, v]) }; ps`, "[[a,2],[b,1]]"},
+		{`let s = ""; for (c in "héllo") { s += c + "." }; s`, "h.é.l.l.o."},
+		{`let n = 0; for (i, c in "héllo") { n += i }; n`, "10"},
+		{"let xs = []; for (x in range(3)) { let xs = push(xs, x) }; xs", "[0,1,2]"},
+		{"let xs = []; for (x in range(10, 0, -3)) { let xs = push(xs, x) }; xs", "[10,7,4,1]"},
+		{"let n = 0; for (x in range(5, 5)) { n += 1 }; n", "0"},
+		{"let n = 0; outer: for (x in range(3)) { for (y in range(3)) { if (y == 1) { continue outer } n += 1 } }; n", "3"},
+		{"let n = 0; outer: for (x in range(3)) { for (c in \"abc\") { n += 1; break outer } }; n", "1"},
+		{"let f = fn() { for (x in range(10)) { for (y in range(10)) { if (x * y == 12) { return [x, y] } } } }; f()", "[2,6]"},
+		{"let f = fn(xs) { let fs = []; for (x in xs) { let fs = push(fs, fn() { x }) }; fs }; f([1, 2])[0]()", "2"},
+		{"for (x in []) { x }", "Null"},
+		{"for (x in 5) { }", "Error at 1:1: not iterable: INTEGER"},
+		{"for (x in [1]) { x + True }", "Error at 1:18: type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
 	}
 }
 
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) {x + 2}"
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	fn, ok := evaluated.(*object.Function)
 	if !ok {
 		t.Fatalf("object is not Function. got=%T (%+v)", evaluated, evaluated)
@@ -276,7 +715,20 @@ func TestFunctionApplication(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		testIntegerObject(t, testEval(tt.input), tt.expected)
+		testIntegerObject(t, testEval(t, tt.input), tt.expected)
+	}
+}
+
+func TestFunctionsWithoutAValue(t *testing.T) {
+	tests := []string{
+		"let f = fn() { let y = 1; }; let z = f(); z",
+		"let y = 1; let f = fn() { y = 2 }; f()",
+		"let f = fn() { }; f()",
+		"let f = fn(n) { if (n > 0) { let m = n } }; [f(1), f(0)][0]",
+	}
+
+	for _, input := range tests {
+		testNullObject(t, testEval(t, input))
 	}
 }
 
@@ -290,13 +742,118 @@ func TestClosures(t *testing.T) {
 	addTwo(2);
 	`
 
-	testIntegerObject(t, testEval(input), 4)
+	testIntegerObject(t, testEval(t, input), 4)
+}
+
+func TestTailCalls(t *testing.T) {
+	// Far deeper than MaxDepth, these only work when a tail call doesn't stack up on its caller
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + 1) } }; f(100000, 0)", "100000"},
+		{"let f = fn(n) { if (n == 0) { return 0 }; return f(n - 1) }; f(100000)", "0"},
+		{"let f = fn(n) { if (n == 0) { 0 } else if (n % 2 == 0) { f(n - 1) } else { f(n - 1) } }; f(100000)", "0"},
+		{"let f = fn(n) { while (True) { if (n == 0) { return 0 }; return f(n - 1) } }; f(100000)", "0"},
+		{"let sum = fn(xs, i, acc) { if (i == len(xs)) { return acc }; sum(xs, i + 1, acc + xs[i]) }; sum(range(100000), 0, 0)", "4999950000"},
+		{`let even = fn(n) { if (n == 0) { True } else { odd(n - 1) } };
+		  let odd = fn(n) { if (n == 0) { False } else { even(n - 1) } };
+		  even(100001)`, "false"},
+		{"let f = fn(n) { if (n == 0) { len([1, 2]) } else { f(n - 1) } }; f(100000)", "2"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	// f(n) runs n + 1 calls at once, none of them is a tail call
+	count := "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; "
+	tests := []struct {
+		input    string
+		maxDepth int
+		expected string
+	}{
+		{count + "f(5000)", 0, "5000"},
+		{count + "f(99)", 100, "99"},
+		{count + "f(100)", 100, "maximum recursion depth exceeded"},
+		{count + "f(20000)", 0, "maximum recursion depth exceeded"},
+		{"let f = fn() { 1 + f() }; f()", 50, "maximum recursion depth exceeded"},
+		// The calls that came back give their depth back
+		{count + "f(90) + f(90)", 100, "180"},
+		// The tail call replaces g, so h only gets as deep as f
+		{"let g = fn(n) { f(n) }; let h = fn(n) { 1 + g(n) }; " + count + "h(98)", 100, "99"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalWithOptions(t, tt.input, object.Options{MaxDepth: tt.maxDepth})
+
+		got := evaluated.Inspect()
+		if errObj, ok := evaluated.(*object.Error); ok {
+			got = errObj.Message
+			if errObj.Code != diagnostics.RecursionLimit {
+				t.Errorf("%s: wrong error code. got=%s", tt.input, errObj.Code)
+			}
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestRecursionErrorFrames(t *testing.T) {
+	// f and g call each other without end, start's f(0) takes start's place but keeps where start was called
+	input := "let f = fn(n) { 1 + g(n) };\nlet g = fn(n) { 1 + f(n) };\nlet start = fn() { f(0) * 2 };\nstart()"
+	tests := []struct {
+		maxDepth int
+		expected []string
+	}{
+		{4, []string{"in f, called at 2:21", "in g, called at 1:21", "in f, called at 3:20", "in start, called at 4:1"}},
+		{100, []string{"in f, called at 2:21", "in g, called at 1:21", "in f, called at 2:21", "in g, called at 1:21", "in f, called at 2:21"}},
+	}
+
+	for _, tt := range tests {
+		options := object.Options{MaxDepth: tt.maxDepth}
+		evaluated, ok := testEvalWithOptions(t, input, options).(*object.Error)
+		if !ok {
+			t.Fatalf("max depth %d: expected an error", tt.maxDepth)
+		}
+		compiled := testRun(t, parser.NewParser(lexer.NewLexer(input)).ParseProgram(), options).(*object.Error)
+
+		for engine, err := range map[string]*object.Error{"evaluator": evaluated, "vm": compiled} {
+			if strings.Join(err.Notes, "; ") != strings.Join(tt.expected, "; ") {
+				t.Errorf("max depth %d, %s: wrong frames.\nexpected=%q\ngot=%q", tt.maxDepth, engine, tt.expected, err.Notes)
+			}
+		}
+	}
+}
+
+// Past what Go's stack can take the evaluator stops on its own, whatever MaxDepth says, and the environment still works after
+func TestEvaluatorNesting(t *testing.T) {
+	env := object.NewEnvironment()
+	env.Options().MaxDepth = 100000000
+
+	count := "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000000)"
+	evaluated := evaluator.Eval(parser.NewParser(lexer.NewLexer(count)).ParseProgram(), env)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok || errObj.Message != "maximum recursion depth exceeded" || errObj.Code != diagnostics.RecursionLimit {
+		t.Fatalf("expected a recursion error, got=%s", evaluated.Inspect())
+	}
+	if len(errObj.Notes) != object.TraceFrames {
+		t.Errorf("expected %d frames, got=%q", object.TraceFrames, errObj.Notes)
+	}
+
+	testIntegerObject(t, evaluator.Eval(parser.NewParser(lexer.NewLexer("f(10000)")).ParseProgram(), env), 10000)
 }
 
 func TestStringConcatenation(t *testing.T) {
 	input := `"Hello" + " " + "World!"`
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	str, ok := evaluated.(*object.String)
 	if !ok {
 		t.Fatalf("object is not String. got=%T (%+V)", evaluated, evaluated)
@@ -307,6 +864,97 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestStringComparisons(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"abc" < "abd"`, "true"},
+		{`"abc" > "abd"`, "false"},
+		{`"a" <= "a"`, "true"},
+		{`"b" >= "a"`, "true"},
+		{`"a" == "a"`, "true"},
+		{`"a" != "a"`, "false"},
+		{`("a" == "a") == True`, "true"},
+		{`let b = "a" == "b"; b`, "false"},
+		{`"a" - "b"`, "Error at 1:1: unknown operator: STRING - STRING"},
+		{`"a" % "b"`, "Error at 1:1: unknown operator: STRING % STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated == nil || evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%v", tt.input, tt.expected, evaluated)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"tab\there" + "\n"`, "tab\there\n"},
+		{"`C:\\temp\\` + \"x\"", `C:\temp\x`},
+		{`len("\"\\")`, "2"},
+		{"len(`a\nb`)", "3"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		got := evaluated.Inspect()
+		if str, ok := evaluated.(*object.String); ok {
+			got = str.Value
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let xs = [1, 2, 3]; "total: ${len(xs)} items"`, "total: 3 items"},
+		{`let x = 1.5; "${x}${x * 2}"`, "1.53.0"},
+		{`let name = "k2m"; "hi ${name}, ${[1, "a"]} ${True} ${{"k": 2}["k"]}"`, "hi k2m, [1,a] true 2"},
+		{`let f = fn(n) { "<${n}>" }; "${f(1)}${f("${f(2)}")}"`, "<1><<2>>"},
+		{`let i = 0; let out = ""; while (i < 3) { out += "${i};"; i += 1 }; out`, "0;1;2;"},
+		{`"no ${1 + True} way"`, "Error at 1:7: type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		got := evaluated.Inspect()
+		if str, ok := evaluated.(*object.String); ok {
+			got = str.Value
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `
+// sums the numbers up to n
+let total = fn(n) {
+	let sum = 0; /* running total */
+	for (i in range(n + 1)) {
+		sum += i // one at a time
+	}
+	/* return sum * 2
+	   /* nested */
+	*/
+	sum
+};
+total(4) / 2 // 5`
+
+	testIntegerObject(t, testEval(t, input), 5)
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -317,10 +965,16 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{`len(range(0, 100, 7))`, 15},
+		{`range(10)[-1]`, 9},
+		{`range(1, 10, 2)[2]`, 5},
+		{`range(1, 2, 0)`, "range step can't be 0"},
+		{`range("1")`, "argument to `range` must be INTEGER, got STRING"},
+		{`range(-9223372036854775808, 9223372036854775807)`, "range(-9223372036854775808, 9223372036854775807, 1) has too many elements"},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 
 		switch expected := tt.expected.(type) {
 		case int:
@@ -339,10 +993,43 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestExponentiation(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2 ** 10", "1024"},
+		{"3 ** 40", "12157665459056928801"},
+		{"3 ** 39", "4052555153018976267"},
+		{"(-3) ** 3", "-27"},
+		{"7 ** 0", "1"},
+		{"2 ** -2", "0.25"},
+		{"3 ** -40 == 1 / 12157665459056928801.0", "true"},
+		{"2 ** 0.5 > 1.41", "true"},
+		{"powmod(2, 10, 1000)", "24"},
+		{"powmod(-2, 3, 5)", "2"},
+		{"powmod(123456789, 987654321, 1000000007)", "652541198"},
+		{"powmod(2, 100, 10 ** 20)", "28229401496703205376"},
+		{"powmod(3, -1, 7)", "5"},
+		{"powmod(2, 5, -7)", "4"},
+		{"powmod(2, -1, 4)", "Error at 1:1: powmod: 2 has no inverse modulo 4"},
+		{"powmod(2, 1, 0)", "Error at 1:1: division by zero: powmod(2, 1, 0)"},
+		{"powmod(2, 1.5, 3)", "Error at 1:1: argument to `powmod` must be INTEGER, got FLOAT"},
+		{"powmod(2, 1)", "Error at 1:1: wrong number of arguments. got=2, want=3"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 +3]"
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	result, ok := evaluated.(*object.Array)
 	if !ok {
 		t.Fatalf("object is not Array, got=%T (%+v)", evaluated, evaluated)
@@ -404,7 +1091,7 @@ func TestArrayIndexExpression(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -419,7 +1106,7 @@ func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
 {"one": 10-9, two: 1 + 1, "thr" + "ee": 6/2, 4:4, True:5, False:6}`
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	result, ok := evaluated.(*object.Hash)
 	if !ok {
 		t.Fatalf("Eval didn't return Hash. got=%T (%+v)", evaluated, evaluated)
@@ -430,8 +1117,8 @@ func TestHashLiterals(t *testing.T) {
 		(&object.String{Value: "two"}).HashKey():   2,
 		(&object.String{Value: "three"}).HashKey(): 3,
 		(&object.Integer{Value: 4}).HashKey():      4,
-		TRUE.HashKey():                             5,
-		FALSE.HashKey():                            6,
+		evaluator.TRUE.HashKey():                   5,
+		evaluator.FALSE.HashKey():                  6,
 	}
 
 	if len(result.Pairs) != len(expected) {
@@ -484,7 +1171,7 @@ func TestHashIndexExpression(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -1,9 +1,13 @@
 package lexer
 
 import (
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/token"
-	_ "fmt"
+	"fmt"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type Lexer struct {
@@ -11,14 +15,32 @@ type Lexer struct {
 	position     int    // Lexer's reading position relative to the input
 	readPosition int    // Pointer to the next char being read
 	ch           byte   // Char being read
+
+	filename string // Optional, only used to tag positions
+	line     int    // Line of ch, starting at 1
+	column   int    // Column of ch, starting at 1, counted in characters and not bytes
+
+	diags []diagnostics.Diagnostic // Bad strings and the like, the token is still handed out so the parser can go on
+
+	interps []int // One entry per ${ still open, how many { are open inside it, the } that closes it goes back to the string
 }
 
 func (l *Lexer) readChar() {
-	if l.readPosition >= len(l.input) {
-		l.ch = 0 // Stop Parsing, ch-0 means EOF in NextToken
-	} else {
-		l.ch = l.input[l.readPosition] //read the token in the next position
+	var next byte // Stop Parsing, ch-0 means EOF in NextToken
+	if l.readPosition < len(l.input) {
+		next = l.input[l.readPosition] //read the token in the next position
+	}
+
+	//Line and column are bumped before moving on, so they always describe l.ch
+	//the other bytes of a character like é stay on the column of its first one
+	if l.ch == '\n' {
+		l.line += 1
+		l.column = 1
+	} else if utf8.RuneStart(next) {
+		l.column += 1
 	}
+
+	l.ch = next
 	l.position = l.readPosition
 	l.readPosition += 1
 
@@ -30,7 +52,8 @@ func (l *Lexer) NextToken() token.Token {
 	// returns token
 
 	var tok token.Token
-	l.skipWhiteSpace()
+	comments := l.skipTrivia()
+	start := l.pos()
 	switch l.ch {
 
 	case '=':
@@ -50,16 +73,37 @@ func (l *Lexer) NextToken() token.Token {
 	case '*':
 		tok = l.GetMultiCharToken(token.ASTERISK, token.ME, token.EXPONENT)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		tok = l.GetMultiCharToken(token.LT, token.LTE, token.SHLE, token.SHL)
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		tok = l.GetMultiCharToken(token.GT, token.GTE, token.SHRE, token.SHR)
+	case '%':
+		tok = newToken(token.MODULO, l.ch)
+	case '&':
+		tok = l.GetMultiCharToken(token.BIT_AND, token.AND, token.ANDE)
+	case '|':
+		tok = l.GetMultiCharToken(token.BIT_OR, token.OR, token.ORE)
+	case '^':
+		tok = l.GetMultiCharToken(token.BIT_XOR, token.XORE)
+	case '~':
+		tok = newToken(token.BIT_NOT, l.ch)
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '{':
+		if len(l.interps) > 0 {
+			l.interps[len(l.interps)-1] += 1
+		}
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
+		if len(l.interps) > 0 && l.interps[len(l.interps)-1] == 0 {
+			l.interps = l.interps[:len(l.interps)-1]
+			tok.Literal, tok.Type = l.readStringPart(start, token.STRING_MID, token.STRING_TAIL)
+			break
+		}
+		if len(l.interps) > 0 {
+			l.interps[len(l.interps)-1] -= 1
+		}
 		tok = newToken(token.RBRACE, l.ch)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
@@ -70,8 +114,10 @@ func (l *Lexer) NextToken() token.Token {
 	case ']':
 		tok = newToken(token.RBRACKET, l.ch)
 	case '"':
+		tok.Literal, tok.Type = l.readStringPart(start, token.STRING_HEAD, token.STRING)
+	case '`':
 		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok.Literal = l.readRawString(start)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
 	case 0:
@@ -81,11 +127,12 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier() //reads all grouped letters, and returns the word they form
 			tok.Type = token.LookupIdent(tok.Literal)
-			return tok
+			tok.Comments = comments
+			return l.withSpan(tok, start)
 		} else if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
-			return tok
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Comments = comments
+			return l.withSpan(tok, start)
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 			//if a token is not a recognized symbol or a letter, it has to be wrong
@@ -93,6 +140,35 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Comments = comments
+	return l.withSpan(tok, start)
+}
+
+// pos is the position of the char being read
+func (l *Lexer) pos() token.Position {
+	offset := l.position
+	if offset > len(l.input) {
+		offset = len(l.input)
+	}
+	return token.Position{Filename: l.filename, Offset: offset, Line: l.line, Column: l.column}
+}
+
+// next is the position right after l.ch
+func (l *Lexer) next() token.Position {
+	p := l.pos()
+	p.Offset += 1
+	p.Column += 1
+	return p
+}
+
+// withSpan is called once the token has been consumed, so l.pos() is right after its last char
+func (l *Lexer) withSpan(tok token.Token, start token.Position) token.Token {
+	tok.Span.Start = start
+	if tok.Type == token.EOF {
+		tok.Span.End = start
+	} else {
+		tok.Span.End = l.pos()
+	}
 	return tok
 }
 
@@ -112,12 +188,101 @@ func (l *Lexer) skipWhiteSpace() {
 
 }
 
-func (l *Lexer) readNumber() string {
+// skipTrivia skips the whitespace and comments before a token, and returns the comments
+func (l *Lexer) skipTrivia() []token.Comment {
+	var comments []token.Comment
+
+	for {
+		l.skipWhiteSpace()
+		if l.ch != '/' || (l.peekChar() != '/' && l.peekChar() != '*') {
+			return comments
+		}
+
+		start := l.pos()
+		position := l.position
+		if l.peekChar() == '/' {
+			for l.ch != '\n' && l.ch != 0 {
+				l.readChar()
+			}
+		} else {
+			l.skipBlockComment(start)
+		}
+		comments = append(comments, token.Comment{Text: l.input[position:l.position], Span: token.Span{Start: start, End: l.pos()}})
+	}
+}
+
+// skipBlockComment reads a /* */ comment, l.ch is the first /
+// They nest, so a block of code that already has comments can be commented out
+func (l *Lexer) skipBlockComment(start token.Position) {
+	depth := 0
+	for {
+		switch {
+		case l.ch == 0:
+			l.errorAt(diagnostics.UnterminatedComment, token.Span{Start: start, End: l.pos()}, "comment not terminated")
+			return
+		case l.ch == '/' && l.peekChar() == '*':
+			depth += 1
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth -= 1
+			l.readChar()
+			if depth == 0 {
+				l.readChar()
+				return
+			}
+		}
+		l.readChar()
+	}
+}
+
+// readNumber reads 42, 4.2, 4e2 and 4.2e-1, the last three are floats
+// A "." only belongs to the number when a digit follows it, same for the "e"
+// 0xFF, 0o755 and 0b1010 are integers in another base, and _ can separate digits in all of them (1_000_000)
+// The lexer doesn't check the digits, the parser does and says what's wrong with the literal
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
-	for isDigit(l.ch) {
+	tokenType := token.TokenType(token.INT)
+
+	if l.ch == '0' && isBasePrefix(l.peekChar()) {
+		l.readChar()
+		l.readChar()
+		l.readAlphanumeric() //0x has letters for digits, so anything up to the next symbol is taken
+		return l.input[position:l.position], tokenType
+	}
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if isDigit(next) || ((next == '+' || next == '-') && l.readPosition+1 < len(l.input) && isDigit(l.input[l.readPosition+1])) {
+			tokenType = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return l.input[position:l.position], tokenType
+}
+
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+}
+
+func (l *Lexer) readAlphanumeric() {
+	for isLetter(l.ch) || isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
 func (l *Lexer) peekChar() byte {
@@ -128,16 +293,125 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// readStringPart reads a "..." string up to its closing quote or the next ${, and replaces its escapes
+// l.ch is the opening quote (or the } that ends a ${...}), the last char read is left in l.ch,
+// NextToken moves past it like it does for every other token
+// The token is open when the string stopped at a ${, closed when it got to the quote
+func (l *Lexer) readStringPart(start token.Position, open, closed token.TokenType) (string, token.TokenType) {
+	var out strings.Builder
 
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		switch l.ch {
+		case '"':
+			return out.String(), closed
+		case 0:
+			l.errorAt(diagnostics.UnterminatedString, token.Span{Start: start, End: l.pos()}, "string literal not terminated")
+			return out.String(), closed
+		case '$':
+			if l.peekChar() == '{' {
+				l.readChar()
+				l.interps = append(l.interps, 0)
+				return out.String(), open
+			}
+			out.WriteByte(l.ch)
+		case '\\':
+			if l.peekChar() != 0 { //A \ right before the end escapes nothing, the next round reports the missing quote
+				l.readEscape(&out)
+			}
+		default:
+			out.WriteByte(l.ch)
 		}
 	}
-	return l.input[position:l.position]
+}
+
+// readEscape reads what comes after a \, a bad escape is reported and kept as it was written
+func (l *Lexer) readEscape(out *strings.Builder) {
+	escape := l.pos()
+	l.readChar()
+
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '0':
+		out.WriteByte(0)
+	case '"', '\\', '$':
+		out.WriteByte(l.ch)
+	case 'u':
+		if r, ok := l.readUnicodeEscape(escape); ok {
+			out.WriteRune(r)
+		}
+	default:
+		l.errorAt(diagnostics.InvalidEscape, token.Span{Start: escape, End: l.next()}, "unknown escape sequence \\%c", l.ch)
+		out.WriteByte('\\')
+		out.WriteByte(l.ch)
+	}
+}
+
+// readUnicodeEscape reads the {1F600} of \u{1F600}, l.ch is the u
+func (l *Lexer) readUnicodeEscape(escape token.Position) (rune, bool) {
+	if l.peekChar() != '{' {
+		l.errorAt(diagnostics.InvalidEscape, token.Span{Start: escape, End: l.next()}, "\\u must be followed by a code point in braces, like \\u{1F600}")
+		return 0, false
+	}
+	l.readChar()
+
+	digits := l.readPosition
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+	}
+	hex := l.input[digits:l.readPosition]
+
+	if l.peekChar() != '}' || hex == "" || len(hex) > 6 {
+		l.errorAt(diagnostics.InvalidEscape, token.Span{Start: escape, End: l.next()}, "\\u{...} must hold 1 to 6 hex digits")
+		return 0, false
+	}
+	l.readChar()
+
+	value, _ := strconv.ParseUint(hex, 16, 32)
+	if r := rune(value); utf8.ValidRune(r) {
+		return r, true
+	}
+	l.errorAt(diagnostics.InvalidEscape, token.Span{Start: escape, End: l.next()}, "\\u{%s} is not a valid unicode code point", hex)
+	return 0, false
+}
+
+// readRawString reads a `...` string, nothing in it is an escape and it can span lines
+// \r is dropped like Go does, so a file saved on windows gives the same string
+func (l *Lexer) readRawString(start token.Position) string {
+	var out strings.Builder
+
+	for {
+		l.readChar()
+		switch l.ch {
+		case '`':
+			return out.String()
+		case 0:
+			l.errorAt(diagnostics.UnterminatedString, token.Span{Start: start, End: l.pos()}, "raw string literal not terminated")
+			return out.String()
+		case '\r':
+		default:
+			out.WriteByte(l.ch)
+		}
+	}
+}
+
+func (l *Lexer) errorAt(code string, span token.Span, format string, a ...interface{}) {
+	l.diags = append(l.diags, diagnostics.Diagnostic{
+		Severity: diagnostics.Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Span:     span,
+	})
+}
+
+// Diagnostics are the errors found in the tokens read so far
+func (l *Lexer) Diagnostics() []diagnostics.Diagnostic {
+	return l.diags
 }
 
 func newToken(tokenType token.TokenType, ch byte) token.Token {
@@ -145,7 +419,14 @@ func newToken(tokenType token.TokenType, ch byte) token.Token {
 }
 
 func NewLexer(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
+	l.readChar()
+	return l
+}
+
+// NewFileLexer is NewLexer, but every position it hands out is tagged with filename
+func NewFileLexer(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
@@ -159,12 +440,26 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func isBasePrefix(ch byte) bool {
+	switch ch {
+	case 'x', 'X', 'o', 'O', 'b', 'B':
+		return true
+	}
+	return false
+}
+
+// ExpectChar is tried in order, so "<<=" has to come before "<<" or it would never match
 func (l *Lexer) GetMultiCharToken(CurChar token.TokenType, ExpectChar ...token.TokenType) token.Token {
 	for _, tokens := range ExpectChar {
-		if l.peekChar() == tokens[1] {
-			ch := l.ch
-			l.readChar()
-			return token.Token{Type: tokens, Literal: string(ch) + string(l.ch)}
+		if strings.HasPrefix(l.input[l.position:], string(tokens)) {
+			for i := 1; i < len(tokens); i++ {
+				l.readChar()
+			}
+			return token.Token{Type: tokens, Literal: string(tokens)}
 		}
 	}
 	return token.Token{Type: CurChar, Literal: string(l.ch)}
@@ -1,9 +1,11 @@
 package lexer
 
 import (
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/token"
 	"encoding/csv"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,7 +19,7 @@ func TestNextToken(t *testing.T) {
 			x + y;
 			};
 			let result = add(five, ten);
-			!-/*5;
+			!-/ *5;
 			5 < 10 > 5;
 			if (5 < 10) {
 			return True;
@@ -183,3 +185,340 @@ func BenchmarkLexer(b *testing.B) {
 
 	writer.Write([]string{date + " | " + Process + " | " + "Duration: " + Duration})
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let x = 5;\n  x + \"ab\";"
+
+	tests := []struct {
+		expectedType  token.TokenType
+		expectedStart token.Position
+		expectedEnd   token.Position
+	}{
+		{token.LET, token.Position{Filename: "test.k2m", Offset: 0, Line: 1, Column: 1}, token.Position{Filename: "test.k2m", Offset: 3, Line: 1, Column: 4}},
+		{token.IDENT, token.Position{Filename: "test.k2m", Offset: 4, Line: 1, Column: 5}, token.Position{Filename: "test.k2m", Offset: 5, Line: 1, Column: 6}},
+		{token.ASSIGN, token.Position{Filename: "test.k2m", Offset: 6, Line: 1, Column: 7}, token.Position{Filename: "test.k2m", Offset: 7, Line: 1, Column: 8}},
+		{token.INT, token.Position{Filename: "test.k2m", Offset: 8, Line: 1, Column: 9}, token.Position{Filename: "test.k2m", Offset: 9, Line: 1, Column: 10}},
+		{token.SEMICOLON, token.Position{Filename: "test.k2m", Offset: 9, Line: 1, Column: 10}, token.Position{Filename: "test.k2m", Offset: 10, Line: 1, Column: 11}},
+		{token.IDENT, token.Position{Filename: "test.k2m", Offset: 13, Line: 2, Column: 3}, token.Position{Filename: "test.k2m", Offset: 14, Line: 2, Column: 4}},
+		{token.PLUS, token.Position{Filename: "test.k2m", Offset: 15, Line: 2, Column: 5}, token.Position{Filename: "test.k2m", Offset: 16, Line: 2, Column: 6}},
+		{token.STRING, token.Position{Filename: "test.k2m", Offset: 17, Line: 2, Column: 7}, token.Position{Filename: "test.k2m", Offset: 21, Line: 2, Column: 11}},
+		{token.SEMICOLON, token.Position{Filename: "test.k2m", Offset: 21, Line: 2, Column: 11}, token.Position{Filename: "test.k2m", Offset: 22, Line: 2, Column: 12}},
+		{token.EOF, token.Position{Filename: "test.k2m", Offset: 22, Line: 2, Column: 12}, token.Position{Filename: "test.k2m", Offset: 22, Line: 2, Column: 12}},
+	}
+
+	l := NewFileLexer("test.k2m", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Span.Start != tt.expectedStart {
+			t.Errorf("tests[%d] - start wrong. expected=%+v, got=%+v", i, tt.expectedStart, tok.Span.Start)
+		}
+		if tok.Span.End != tt.expectedEnd {
+			t.Errorf("tests[%d] - end wrong. expected=%+v, got=%+v", i, tt.expectedEnd, tok.Span.End)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{"42", []token.Token{{Type: token.INT, Literal: "42"}}},
+		{"3.14", []token.Token{{Type: token.FLOAT, Literal: "3.14"}}},
+		{"1e9", []token.Token{{Type: token.FLOAT, Literal: "1e9"}}},
+		{"2.5E-3", []token.Token{{Type: token.FLOAT, Literal: "2.5E-3"}}},
+		{"6e+2", []token.Token{{Type: token.FLOAT, Literal: "6e+2"}}},
+		// A "." or "e" without digits after it is not part of the number
+		{"5.", []token.Token{{Type: token.INT, Literal: "5"}, {Type: token.ILLEGAL, Literal: "."}}},
+		{"5e", []token.Token{{Type: token.INT, Literal: "5"}, {Type: token.IDENT, Literal: "e"}}},
+		{"5e-x", []token.Token{{Type: token.INT, Literal: "5"}, {Type: token.IDENT, Literal: "e"}, {Type: token.MINUS, Literal: "-"}, {Type: token.IDENT, Literal: "x"}}},
+		{"1.5*2", []token.Token{{Type: token.FLOAT, Literal: "1.5"}, {Type: token.ASTERISK, Literal: "*"}, {Type: token.INT, Literal: "2"}}},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+
+		for i, expected := range append(tt.expected, token.Token{Type: token.EOF}) {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: token %d wrong. expected=%s %q, got=%s %q", tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestOperatorTokens(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{"a <= b", []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.LTE, Literal: "<="}, {Type: token.IDENT, Literal: "b"}}},
+		{"a >= b", []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.GTE, Literal: ">="}, {Type: token.IDENT, Literal: "b"}}},
+		{"a&&b||c", []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.AND, Literal: "&&"}, {Type: token.IDENT, Literal: "b"}, {Type: token.OR, Literal: "||"}, {Type: token.IDENT, Literal: "c"}}},
+		{"7 % 2", []token.Token{{Type: token.INT, Literal: "7"}, {Type: token.MODULO, Literal: "%"}, {Type: token.INT, Literal: "2"}}},
+		{"a & b | c ^ ~d", []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.BIT_AND, Literal: "&"}, {Type: token.IDENT, Literal: "b"}, {Type: token.BIT_OR, Literal: "|"}, {Type: token.IDENT, Literal: "c"}, {Type: token.BIT_XOR, Literal: "^"}, {Type: token.BIT_NOT, Literal: "~"}, {Type: token.IDENT, Literal: "d"}}},
+		{"1 << 2 >> 3", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.SHL, Literal: "<<"}, {Type: token.INT, Literal: "2"}, {Type: token.SHR, Literal: ">>"}, {Type: token.INT, Literal: "3"}}},
+		{"&= |= ^= <<= >>=", []token.Token{{Type: token.ANDE, Literal: "&="}, {Type: token.ORE, Literal: "|="}, {Type: token.XORE, Literal: "^="}, {Type: token.SHLE, Literal: "<<="}, {Type: token.SHRE, Literal: ">>="}}},
+		{"<<<=", []token.Token{{Type: token.SHL, Literal: "<<"}, {Type: token.LTE, Literal: "<="}}},
+		{">>>", []token.Token{{Type: token.SHR, Literal: ">>"}, {Type: token.GT, Literal: ">"}}},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+
+		for i, expected := range append(tt.expected, token.Token{Type: token.EOF}) {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: token %d wrong. expected=%s %q, got=%s %q", tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestNumberTokens(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{"0xFF 0o755 0b1010", []token.Token{{Type: token.INT, Literal: "0xFF"}, {Type: token.INT, Literal: "0o755"}, {Type: token.INT, Literal: "0b1010"}}},
+		{"1_000_000 1_000.5", []token.Token{{Type: token.INT, Literal: "1_000_000"}, {Type: token.FLOAT, Literal: "1_000.5"}}},
+		{"x[0x1f]", []token.Token{{Type: token.IDENT, Literal: "x"}, {Type: token.LBRACKET, Literal: "["}, {Type: token.INT, Literal: "0x1f"}, {Type: token.RBRACKET, Literal: "]"}}},
+		{"0xff+1", []token.Token{{Type: token.INT, Literal: "0xff"}, {Type: token.PLUS, Literal: "+"}, {Type: token.INT, Literal: "1"}}},
+		// Bad literals are still one token, the parser reports them
+		{"0b102 0xZZ 0x", []token.Token{{Type: token.INT, Literal: "0b102"}, {Type: token.INT, Literal: "0xZZ"}, {Type: token.INT, Literal: "0x"}}},
+		{"1__0 1_", []token.Token{{Type: token.INT, Literal: "1__0"}, {Type: token.INT, Literal: "1_"}}},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+
+		for i, expected := range append(tt.expected, token.Token{Type: token.EOF}) {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: token %d wrong. expected=%s %q, got=%s %q", tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestStringTokens(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\nb\tc"`, "a\nb\tc"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"C:\\dir\\"`, `C:\dir\`},
+		{`"\r\0"`, "\r\x00"},
+		{`"\u{48}\u{e9}\u{1F600}"`, "Hé😀"},
+		{"\"two\nlines\"", "two\nlines"},
+		{"`raw \\n \"string\"`", `raw \n "string"`},
+		{"`first\r\nsecond\n`", "first\nsecond\n"},
+		{"``", ""},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != token.STRING || tok.Literal != tt.expected {
+			t.Errorf("%s: expected=STRING %q, got=%s %q", tt.input, tt.expected, tok.Type, tok.Literal)
+		}
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("%s: string didn't end at its quote, then got %s %q", tt.input, next.Type, next.Literal)
+		}
+		if len(l.Diagnostics()) != 0 {
+			t.Errorf("%s: unexpected errors %v", tt.input, l.Diagnostics())
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedCode string
+		expected     string
+		literal      string
+	}{
+		{`let s = "abc`, diagnostics.UnterminatedString, "1:9: string literal not terminated", "abc"},
+		{"x\n`one\ntwo", diagnostics.UnterminatedString, "2:1: raw string literal not terminated", "one\ntwo"},
+		{`"ab\`, diagnostics.UnterminatedString, "1:1: string literal not terminated", "ab"},
+		{`"a\qb"`, diagnostics.InvalidEscape, `1:3: unknown escape sequence \q`, `a\qb`},
+		{`"\u41"`, diagnostics.InvalidEscape, `1:2: \u must be followed by a code point in braces, like \u{1F600}`, "41"},
+		{`"\u{}"`, diagnostics.InvalidEscape, `1:2: \u{...} must hold 1 to 6 hex digits`, "}"},
+		{`"\u{1234567}"`, diagnostics.InvalidEscape, `1:2: \u{...} must hold 1 to 6 hex digits`, "}"},
+		{`"\u{D800}"`, diagnostics.InvalidEscape, `1:2: \u{D800} is not a valid unicode code point`, ""},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+
+		var tok token.Token
+		for tok = l.NextToken(); tok.Type != token.STRING && tok.Type != token.EOF; tok = l.NextToken() {
+		}
+		if tok.Literal != tt.literal {
+			t.Errorf("%s: wrong literal. expected=%q, got=%q", tt.input, tt.literal, tok.Literal)
+		}
+
+		if len(l.Diagnostics()) != 1 {
+			t.Errorf("%s: expected 1 error, got %v", tt.input, l.Diagnostics())
+			continue
+		}
+		if diag := l.Diagnostics()[0]; diag.Error() != tt.expected || diag.Code != tt.expectedCode {
+			t.Errorf("%s: wrong error. expected=%s %q, got=%s %q", tt.input, tt.expectedCode, tt.expected, diag.Code, diag.Error())
+		}
+	}
+}
+
+func TestInterpolatedStringTokens(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{`"a ${x} b"`, []token.Token{{Type: token.STRING_HEAD, Literal: "a "}, {Type: token.IDENT, Literal: "x"}, {Type: token.STRING_TAIL, Literal: " b"}}},
+		{`"${x}${y}"`, []token.Token{{Type: token.STRING_HEAD, Literal: ""}, {Type: token.IDENT, Literal: "x"}, {Type: token.STRING_MID, Literal: ""}, {Type: token.IDENT, Literal: "y"}, {Type: token.STRING_TAIL, Literal: ""}}},
+		// Braces inside the expression don't close it
+		{`"${ {"k": 1}["k"] }!"`, []token.Token{{Type: token.STRING_HEAD, Literal: ""}, {Type: token.LBRACE, Literal: "{"}, {Type: token.STRING, Literal: "k"}, {Type: token.COLON, Literal: ":"}, {Type: token.INT, Literal: "1"}, {Type: token.RBRACE, Literal: "}"}, {Type: token.LBRACKET, Literal: "["}, {Type: token.STRING, Literal: "k"}, {Type: token.RBRACKET, Literal: "]"}, {Type: token.STRING_TAIL, Literal: "!"}}},
+		{`"a ${"b ${c}"}"`, []token.Token{{Type: token.STRING_HEAD, Literal: "a "}, {Type: token.STRING_HEAD, Literal: "b "}, {Type: token.IDENT, Literal: "c"}, {Type: token.STRING_TAIL, Literal: ""}, {Type: token.STRING_TAIL, Literal: ""}}},
+		{`"cost: \${x} $5 {}"`, []token.Token{{Type: token.STRING, Literal: "cost: ${x} $5 {}"}}},
+		{"`raw ${x}`", []token.Token{{Type: token.STRING, Literal: "raw ${x}"}}},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(tt.input)
+
+		for i, expected := range append(tt.expected, token.Token{Type: token.EOF}) {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: token %d wrong. expected=%s %q, got=%s %q", tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// adds things
+let add = fn(a, b) { a + b }; // trailing
+/* block /* nested */ still comment */ add(1 /* inline */, 2) / 2;
+x /= 2 // last`
+
+	tests := []struct {
+		expectedType     token.TokenType
+		expectedLiteral  string
+		expectedComments []string
+	}{
+		{token.LET, "let", []string{"// adds things"}},
+		{token.IDENT, "add", nil},
+		{token.ASSIGN, "=", nil},
+		{token.FUNCTION, "fn", nil},
+		{token.LPAREN, "(", nil},
+		{token.IDENT, "a", nil},
+		{token.COMMA, ",", nil},
+		{token.IDENT, "b", nil},
+		{token.RPAREN, ")", nil},
+		{token.LBRACE, "{", nil},
+		{token.IDENT, "a", nil},
+		{token.PLUS, "+", nil},
+		{token.IDENT, "b", nil},
+		{token.RBRACE, "}", nil},
+		{token.SEMICOLON, ";", nil},
+		{token.IDENT, "add", []string{"// trailing", "/* block /* nested */ still comment */"}},
+		{token.LPAREN, "(", nil},
+		{token.INT, "1", nil},
+		{token.COMMA, ",", []string{"/* inline */"}},
+		{token.INT, "2", nil},
+		{token.RPAREN, ")", nil},
+		{token.SLASH, "/", nil},
+		{token.INT, "2", nil},
+		{token.SEMICOLON, ";", nil},
+		{token.IDENT, "x", nil},
+		{token.DE, "/=", nil},
+		{token.INT, "2", nil},
+		{token.EOF, "", []string{"// last"}},
+	}
+
+	l := NewLexer(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - token wrong. expected=%s %q, got=%s %q", i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+
+		var comments []string
+		for _, c := range tok.Comments {
+			comments = append(comments, c.Text)
+		}
+		if strings.Join(comments, "|") != strings.Join(tt.expectedComments, "|") {
+			t.Errorf("tests[%d] - comments wrong. expected=%q, got=%q", i, tt.expectedComments, comments)
+		}
+	}
+
+	if len(l.Diagnostics()) != 0 {
+		t.Errorf("unexpected errors %v", l.Diagnostics())
+	}
+}
+
+func TestColumnsCountCharacters(t *testing.T) {
+	l := NewLexer("\"café\" + x\n€ y")
+
+	tests := []struct {
+		literal    string
+		start, end token.Position
+	}{
+		{"café", token.Position{Offset: 0, Line: 1, Column: 1}, token.Position{Offset: 7, Line: 1, Column: 7}},
+		{"+", token.Position{Offset: 8, Line: 1, Column: 8}, token.Position{Offset: 9, Line: 1, Column: 9}},
+		{"x", token.Position{Offset: 10, Line: 1, Column: 10}, token.Position{Offset: 11, Line: 1, Column: 11}},
+	}
+	for _, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.literal || tok.Span.Start != tt.start || tok.Span.End != tt.end {
+			t.Errorf("%q: wrong span. want=%+v-%+v, got=%q %+v-%+v", tt.literal, tt.start, tt.end, tok.Literal, tok.Span.Start, tok.Span.End)
+		}
+	}
+
+	// € is three bytes but one column, whatever the lexer makes of it
+	tok := l.NextToken()
+	for tok.Type != token.EOF && tok.Literal != "y" {
+		tok = l.NextToken()
+	}
+	if tok.Literal != "y" || tok.Span.Start.Column != 3 {
+		t.Errorf("y after € should be on column 3, got=%q at %s", tok.Literal, tok.Span.Start)
+	}
+}
+
+func TestCommentSpans(t *testing.T) {
+	l := NewLexer("x\n  /* a\nb */ y")
+	l.NextToken()
+	tok := l.NextToken()
+
+	if len(tok.Comments) != 1 {
+		t.Fatalf("expected 1 comment, got %v", tok.Comments)
+	}
+	span := tok.Comments[0].Span
+	if span.Start.Line != 2 || span.Start.Column != 3 || span.End.Line != 3 || span.End.Column != 5 {
+		t.Errorf("wrong comment span. got=%+v", span)
+	}
+	if tok.Span.Start.Line != 3 || tok.Span.Start.Column != 6 {
+		t.Errorf("wrong token position after the comment. got=%s", tok.Span.Start)
+	}
+
+	l = NewLexer("x /* open /* nested */")
+	l.NextToken()
+	if tok := l.NextToken(); tok.Type != token.EOF {
+		t.Errorf("unterminated comment should run to the end, got %s %q", tok.Type, tok.Literal)
+	}
+	if len(l.Diagnostics()) != 1 || l.Diagnostics()[0].Error() != "1:3: comment not terminated" || l.Diagnostics()[0].Code != diagnostics.UnterminatedComment {
+		t.Errorf("wrong errors for an unterminated comment. got=%v", l.Diagnostics())
+	}
+}
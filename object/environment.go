@@ -1,12 +1,70 @@
 package object
 
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store   map[string]Object
+	outer   *Environment
+	options *Options
+}
+
+// DefaultMaxDepth is how many function calls can be running at once when the Options don't say
+const DefaultMaxDepth = 10000
+
+// Options change how a program runs, every scope of a program shares the ones of its root Environment
+type Options struct {
+	CheckedArithmetic bool // Integer overflow is an error instead of switching to big numbers
+	MaxDepth          int  // Most function calls running at once, 0 is DefaultMaxDepth. A tail call takes its caller's place, it doesn't count
+
+	depth   int // Calls the evaluator is running right now, see Enter
+	nesting int // Evals the evaluator is inside of right now, see Nest
+}
+
+// Checked is safe to call on nil Options, which are the defaults
+func (o *Options) Checked() bool {
+	return o != nil && o.CheckedArithmetic
+}
+
+// Limit is the MaxDepth in effect, also safe on nil Options
+func (o *Options) Limit() int {
+	if o == nil || o.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return o.MaxDepth
+}
+
+// Enter counts a call the evaluator starts, false means there's no room left for it under Limit
+// every Enter that returned true needs a Leave once the call is done
+func (o *Options) Enter() bool {
+	if o.depth >= o.Limit() {
+		return false
+	}
+	o.depth++
+	return true
+}
+
+func (o *Options) Leave() {
+	o.depth--
+}
+
+// Nest counts one more level of the evaluator's Go recursion, false means it's already limit levels deep
+// every Nest that returned true needs an Unnest
+func (o *Options) Nest(limit int) bool {
+	if o.nesting >= limit {
+		return false
+	}
+	o.nesting++
+	return true
+}
+
+func (o *Options) Unnest() {
+	o.nesting--
 }
 
 func NewEnvironment() *Environment {
-	return &Environment{store: make(map[string]Object), outer: nil}
+	return &Environment{store: make(map[string]Object), outer: nil, options: &Options{}}
+}
+
+func (env *Environment) Options() *Options {
+	return env.options
 }
 
 func (env *Environment) Get(name string) (Object, bool) {
@@ -25,6 +83,18 @@ func (env *Environment) Set(name string, obj Object) Object {
 	return obj
 }
 
+// Assign changes name in the closest scope that has it, unlike Set it never creates a variable
+// false means no scope has one with that name
+func (env *Environment) Assign(name string, obj Object) bool {
+	for e := env; e != nil; e = e.outer {
+		if _, ok := e.store[name]; ok {
+			e.store[name] = obj
+			return true
+		}
+	}
+	return false
+}
+
 func ScopedEnv(outer *Environment) *Environment {
 	//Really Simple solution to scoped functions
 	// We create a new Environment (local) for the function,
@@ -32,6 +102,7 @@ func ScopedEnv(outer *Environment) *Environment {
 	// however, the function can still go outside and touch grass by using env.outer
 	env := NewEnvironment()
 	env.outer = outer
+	env.options = outer.options
 
 	return env
 }
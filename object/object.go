@@ -2,24 +2,40 @@ package object
 
 import (
 	"MyInterpreter/ast"
+	"MyInterpreter/code"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/token"
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 const (
 	INTEGER_OBJ      = "INTEGER"
+	FLOAT_OBJ        = "FLOAT"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
+	TAIL_CALL_OBJ    = "TAIL_CALL"
 	ERROR_OBJ        = "ERROR"
 	FUNCTION_OBJ     = "FUNCTION"
 	STRING_OBJ       = "STRING"
 	ARRAY_OBJ        = "ARRAY"
 	BUILTIN_OBJ      = "BUILTIN"
 	HASH_OBJ         = "HASH"
+	RANGE_OBJ        = "RANGE"
+	ITERATOR_OBJ     = "ITERATOR"
 	VOID_OBJ         = ""
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+	CELL_OBJ              = "CELL"
 )
 
 type ObjectType string
@@ -44,6 +60,69 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// BigInteger is an Integer too large for an int64, arithmetic switches to it when a result overflows
+// It's only ever made through IntegerFromBig, so a value that fits in an int64 is always an Integer
+// Value is never modified after that, the same BigInteger can be a constant shared by every run
+type BigInteger struct {
+	Value *big.Int
+}
+
+func (b *BigInteger) Type() ObjectType { return INTEGER_OBJ }
+func (b *BigInteger) Inspect() string  { return b.Value.String() }
+func (b *BigInteger) HashKey() HashKey {
+	h := fnv.New64a()
+	if b.Value.Sign() < 0 {
+		h.Write([]byte{'-'})
+	}
+	h.Write(b.Value.Bytes())
+
+	return HashKey{Type: b.Type(), Value: h.Sum64()}
+}
+
+// IntegerFromBig is the Integer holding value, a BigInteger only when it doesn't fit in an int64
+func IntegerFromBig(value *big.Int) Object {
+	if value.IsInt64() {
+		return &Integer{Value: value.Int64()}
+	}
+	return &BigInteger{Value: value}
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
+// Inspect always shows a float as one, 2.0 and not 2
+func (f *Float) Inspect() string {
+	switch {
+	case math.IsInf(f.Value, 1):
+		return "Inf"
+	case math.IsInf(f.Value, -1):
+		return "-Inf"
+	case math.IsNaN(f.Value):
+		return "NaN"
+	}
+
+	out := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(out, ".e") {
+		out += ".0"
+	}
+	return out
+}
+
+// HashKey of a whole float is the one of the same Integer, 1 == 1.0 so {1: "a"}[1.0] has to find "a"
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && f.Value >= -(1<<63) && f.Value < 1<<63 {
+		return (&Integer{Value: int64(f.Value)}).HashKey()
+	}
+	if f.Value == math.Trunc(f.Value) && !math.IsInf(f.Value, 0) {
+		value, _ := big.NewFloat(f.Value).Int(nil)
+		return (&BigInteger{Value: value}).HashKey()
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -76,17 +155,77 @@ type ReturnValue struct {
 func (r *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (r *ReturnValue) Inspect() string  { return r.Value.Inspect() }
 
+// Break and Continue go up from the statement to its loop the same way a ReturnValue goes up to its function
+// Label is empty when the statement is for the innermost loop
+type Break struct {
+	Label string
+}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct {
+	Label string
+}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 type Error struct {
 	Message string
+	Code    string     // diagnostics code, see diagnostics/codes.go
+	Span    token.Span // Code that raised the error, zero until the evaluator stamps it
+	Notes   []string
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "Error" + e.Message }
+func (e *Error) Inspect() string {
+	if e.Span.IsValid() {
+		return "Error at " + e.Span.Start.String() + ": " + e.Message
+	}
+	return "Error" + e.Message
+}
+
+// TraceFrames is how many of the calls that were running a "maximum recursion depth exceeded" error lists
+const TraceFrames = 5
+
+// AddFrame notes one of the calls that were running when e happened, from the innermost out
+// name is what the function was bound to with let (empty for the others), at is where it was called
+func (e *Error) AddFrame(name string, at token.Position) {
+	if len(e.Notes) >= TraceFrames {
+		return
+	}
+	if name == "" {
+		name = "<anonymous>"
+	}
+	e.Notes = append(e.Notes, fmt.Sprintf("in %s, called at %s", name, at))
+}
+
+func (e *Error) Diagnostic() diagnostics.Diagnostic {
+	return diagnostics.Diagnostic{
+		Severity: diagnostics.Error,
+		Code:     e.Code,
+		Message:  e.Message,
+		Span:     e.Span,
+		Notes:    e.Notes,
+	}
+}
+
+// TailCall is a call in tail position that the evaluator hands back instead of making it, applyFunction makes it
+// once the frames of the function it came from are gone. A program never gets to see one
+type TailCall struct {
+	Function  *Function
+	Arguments []Object
+}
+
+func (tc *TailCall) Type() ObjectType { return TAIL_CALL_OBJ }
+func (tc *TailCall) Inspect() string  { return "tail call" }
 
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // Name it was bound to with let, if any
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -156,7 +295,7 @@ func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
+	for _, pair := range h.SortedPairs() {
 		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
 	}
 
@@ -167,6 +306,68 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// SortedPairs gives the pairs ordered by key, so going through a hash gives the same order every time
+// numbers come first, then booleans and strings, anything else goes last
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return compareKeys(pairs[i].Key, pairs[j].Key) < 0 })
+	return pairs
+}
+
+func compareKeys(a, b Object) int {
+	if ra, rb := keyRank(a), keyRank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch a := a.(type) {
+	case *Integer, *BigInteger, *Float:
+		return keyNumber(a).Cmp(keyNumber(b))
+	case *Boolean:
+		if a.Value == b.(*Boolean).Value {
+			return 0
+		}
+		if a.Value {
+			return 1
+		}
+		return -1
+	case *String:
+		return strings.Compare(a.Value, b.(*String).Value)
+	}
+	return strings.Compare(a.Inspect(), b.Inspect())
+}
+
+func keyRank(key Object) int {
+	switch key := key.(type) {
+	case *Integer, *BigInteger:
+		return 0
+	case *Float:
+		if math.IsNaN(key.Value) {
+			return 1
+		}
+		return 0
+	case *Boolean:
+		return 2
+	case *String:
+		return 3
+	}
+	return 4
+}
+
+func keyNumber(key Object) *big.Float {
+	switch key := key.(type) {
+	case *Integer:
+		return new(big.Float).SetInt64(key.Value)
+	case *BigInteger:
+		return new(big.Float).SetInt(key.Value)
+	default:
+		return big.NewFloat(key.(*Float).Value)
+	}
+}
+
 type HashPair struct {
 	Key   Object //actual Unhashed Key
 	Value Object
@@ -177,8 +378,104 @@ type HashKey struct {
 	Value uint64     //Hashed Key
 }
 
+// Range is what range() returns, the integers from Start up to End (not included) going by Step
+// nothing is allocated, the elements are worked out when they're asked for
+type Range struct {
+	Start, End, Step int64
+	Length           int64
+}
+
+// NewRange fails when step is 0, or when the range has more elements than an int64 can count
+func NewRange(start, end, step int64) (*Range, bool) {
+	if step == 0 {
+		return nil, false
+	}
+
+	// Differences are taken as uint64, the distance between two int64 always fits there
+	var length uint64
+	switch {
+	case step > 0 && end > start:
+		length = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+	case step < 0 && end < start:
+		length = (uint64(start)-uint64(end)-1)/(-uint64(step)) + 1
+	}
+	if length > math.MaxInt64 {
+		return nil, false
+	}
+
+	return &Range{Start: start, End: end, Step: step, Length: int64(length)}, true
+}
+
+// At is the i-th element, i has to be in [0, Length)
+func (r *Range) At(i int64) int64 {
+	return int64(uint64(r.Start) + uint64(i)*uint64(r.Step))
+}
+
+func (r *Range) Type() ObjectType { return RANGE_OBJ }
+func (r *Range) Inspect() string {
+	return fmt.Sprintf("range(%d, %d, %d)", r.Start, r.End, r.Step)
+}
+
+// Iterator is how a for-in loop goes through a value, every call to Next gives the following key and value
+// until ok is false. It only lives on the vm's stack, programs never get their hands on one
+type Iterator struct {
+	Next func() (key, value Object, ok bool)
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+func (it *Iterator) Inspect() string  { return "iterator" }
+
 type Void struct {
 }
 
 func (v *Void) Type() ObjectType { return VOID_OBJ }
 func (v *Void) Inspect() string  { return "" }
+
+// CompiledFunction is a function literal after going through the compiler, the vm only ever sees it wrapped in a Closure
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	Cells         []int    // Local slots captured by inner functions, the vm boxes them in a Cell when the function is called
+	Locals        []string // Local names by slot, for error messages
+	Free          []string // Names of the captured variables, in the order the Closure holds them
+	Name          string   // Name it was bound to with let, if any
+	SourceMap     code.SourceMap
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string  { return fmt.Sprintf("CompiledFunction[%p]", cf) }
+
+// Closure is the vm's version of Function, for the user both are just functions
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []*Cell
+}
+
+func (c *Closure) Type() ObjectType { return FUNCTION_OBJ }
+func (c *Closure) Inspect() string {
+	var out bytes.Buffer
+
+	params := c.Fn.Locals[:c.Fn.NumParameters]
+
+	out.WriteString("fn")
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {/n")
+
+	return out.String()
+}
+
+// Cell holds a variable that is shared between a function and the closures created inside of it
+// this way both see each other's changes, just like they would share an Environment in the evaluator
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string {
+	if c.Value == nil {
+		return "cell()"
+	}
+	return "cell(" + c.Value.Inspect() + ")"
+}
@@ -0,0 +1,206 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/token"
+)
+
+// Dead code elimination removes code that can never run, or whose running can't be noticed:
+//   - branches of an if whose condition folded to a constant, and loops whose condition is always false
+//   - statements after a return, break or continue
+//   - lets that nobody reads, holding a value that can't fail or call anything
+//
+// Code that declares a variable is never removed, even when it can't run: the compiler gives every let of a
+// function its slot up front, so taking one away could change which variable the rest of the function reads
+
+// pruneIf optimizes an if chain and drops its branches that can never run
+// when the conditions already tell which branch runs, decided is true and taken is that branch (nil when it's none),
+// otherwise live is what's left of the chain
+func (o *optimizer) pruneIf(ie *ast.IfExpression, s *scope) (live *ast.IfExpression, taken *ast.BlockStatement, decided bool) {
+	ie.Condition = o.expression(ie.Condition, s)
+
+	if neverTrue(ie.Condition) && !declares(ie.Consequence) {
+		o.report(diagnostics.DeadCode, token.Span{Start: ie.Pos(), End: ie.Consequence.End()}, "removed a branch that never runs")
+		return o.pruneElse(ie, s)
+	}
+
+	if alwaysTrue(ie.Condition) {
+		var rest ast.Node
+		if ie.ElseIf != nil {
+			rest = ie.ElseIf
+		} else if ie.Alternative != nil {
+			rest = ie.Alternative
+		}
+
+		if rest == nil || !declares(rest) {
+			if rest != nil {
+				o.report(diagnostics.DeadCode, ast.SpanOf(rest), "removed a branch that never runs")
+			}
+			o.block(ie.Consequence, s)
+			return nil, ie.Consequence, true
+		}
+	}
+
+	o.block(ie.Consequence, s)
+	if live, taken, decided := o.pruneElse(ie, s); decided {
+		ie.ElseIf, ie.Alternative = nil, taken
+	} else {
+		ie.ElseIf = live
+	}
+	return ie, nil, false
+}
+
+// pruneElse is pruneIf for what comes after the first branch of ie, its else if chain or its else block
+func (o *optimizer) pruneElse(ie *ast.IfExpression, s *scope) (live *ast.IfExpression, taken *ast.BlockStatement, decided bool) {
+	if ie.ElseIf != nil {
+		return o.pruneIf(ie.ElseIf, s)
+	}
+	o.block(ie.Alternative, s)
+	return nil, ie.Alternative, true
+}
+
+// branchValue stands for a decided if whose value is used, so its branch can't just take the if's place in a list
+func branchValue(e *ast.IfExpression, taken *ast.BlockStatement) ast.Expression {
+	if taken != nil && len(taken.Statements) == 1 {
+		if es, ok := taken.Statements[0].(*ast.ExpressionStatement); ok {
+			return es.Expression
+		}
+	}
+
+	// Otherwise it stays an if, one that runs that branch, or none at all which gives Null
+	runs := taken != nil
+	if !runs {
+		taken = &ast.BlockStatement{Token: e.Consequence.Token, Closing: e.Consequence.Closing}
+	}
+	return &ast.IfExpression{Token: e.Token, Condition: literal(nativeBool(runs), e.Condition), Consequence: taken}
+}
+
+// removeUnusedLets runs after everything else, propagation leaves a lot of lets with nobody reading them
+func (o *optimizer) removeUnusedLets(program *ast.Program) {
+	read := readNames(program)
+	removeIn := func(node ast.Node) bool {
+		if b, ok := node.(*ast.BlockStatement); ok {
+			b.Statements = o.removeUnused(b.Statements, read)
+		}
+		return true
+	}
+
+	if o.opts.Session {
+		// The next inputs can read the top level variables, only the ones inside functions can go
+		ast.Inspect(program, func(node ast.Node) bool {
+			if fl, ok := node.(*ast.FunctionLiteral); ok {
+				ast.Inspect(fl.Body, removeIn)
+				return false
+			}
+			return true
+		})
+		return
+	}
+
+	program.Statements = o.removeUnused(program.Statements, read)
+	ast.Inspect(program, removeIn)
+}
+
+func (o *optimizer) removeUnused(list []ast.Statement, read map[string]bool) []ast.Statement {
+	out := list[:0]
+	for i, stmt := range list {
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok || i == len(list)-1 || read[let.Name.Value] || o.assigned[let.Name.Value] || !pure(let.Value) {
+			out = append(out, stmt)
+			continue
+		}
+		o.report(diagnostics.UnusedVariable, ast.SpanOf(let), "removed unused variable %s", let.Name.Value)
+	}
+	return out
+}
+
+// readNames are the names the program reads, by name only, the same name read in another function keeps a let too
+func readNames(program *ast.Program) map[string]bool {
+	read := map[string]bool{}
+
+	var visit func(ast.Node) bool
+	visit = func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			// The name of a let is written, not read
+			if node.Value != nil {
+				ast.Inspect(node.Value, visit)
+			}
+			return false
+		case *ast.Identifier:
+			read[node.Value] = true
+		}
+		return true
+	}
+
+	ast.Inspect(program, visit)
+	return read
+}
+
+// pure is true when evaluating e can't fail or do anything, skipping it can't be noticed
+func pure(e ast.Expression) bool {
+	switch e := e.(type) {
+	case *ast.FunctionLiteral:
+		return true
+	case *ast.ArrayLiteral:
+		for _, elem := range e.Elements {
+			if !pure(elem) {
+				return false
+			}
+		}
+		return true
+	case *ast.HashLiteral:
+		// A key that isn't a literal could be an array, which can't be a hash key
+		for key, value := range e.Pairs {
+			if constant(key) == nil || !pure(value) {
+				return false
+			}
+		}
+		return true
+	}
+	return constant(e) != nil
+}
+
+// declares is true when a let or a for in loop inside node (but not inside its functions) defines a variable
+func declares(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.FunctionLiteral:
+			return false
+		case *ast.LetStatement, *ast.ForInLoop:
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func declaresAny(list []ast.Statement) bool {
+	for _, stmt := range list {
+		if declares(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJump(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.ReturnStatement, *ast.BreakStatement, *ast.ContinueStatement:
+		return true
+	}
+	return false
+}
+
+func neverTrue(condition ast.Expression) bool {
+	value := constant(condition)
+	return value != nil && !evaluator.IsTruthy(value)
+}
+
+func alwaysTrue(condition ast.Expression) bool {
+	value := constant(condition)
+	return value != nil && evaluator.IsTruthy(value)
+}
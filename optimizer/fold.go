@@ -0,0 +1,123 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/object"
+	"MyInterpreter/token"
+	"math/big"
+)
+
+// Folding runs the evaluator's own operators on the literals, so a folded value is always what the engines
+// would have computed. Checked arithmetic is on while folding: whatever overflows could be an error or a
+// big number depending on how the program is run, so it's left for runtime, like any other error
+var checked = &object.Options{CheckedArithmetic: true}
+
+// maxFoldedString keeps "ab" * 1000000 from ending up in the program as a literal
+const maxFoldedString = 1024
+
+func foldPrefix(e *ast.PrefixExpression) ast.Expression {
+	right := constant(e.Right)
+	if right == nil {
+		return e
+	}
+	if folded := literal(evaluator.EvalPrefix(e.Operator, right, checked), e); folded != nil {
+		return folded
+	}
+	return e
+}
+
+func foldInfix(e *ast.InfixExpression) ast.Expression {
+	left := constant(e.Left)
+	if left == nil {
+		return e
+	}
+
+	if e.Operator == "&&" || e.Operator == "||" {
+		// The right side doesn't run when the left one decides, it can be dropped even when it isn't a literal
+		if evaluator.IsTruthy(left) == (e.Operator == "||") {
+			return literal(nativeBool(evaluator.IsTruthy(left)), e)
+		}
+		if right := constant(e.Right); right != nil {
+			return literal(nativeBool(evaluator.IsTruthy(right)), e)
+		}
+		return e
+	}
+
+	right := constant(e.Right)
+	if right == nil {
+		return e
+	}
+	if folded := literal(evaluator.EvalInfix(e.Operator, left, right, checked), e); folded != nil {
+		return folded
+	}
+	return e
+}
+
+func foldInterpolation(e *ast.InterpolatedString) ast.Expression {
+	parts := make([]object.Object, len(e.Parts))
+	for i, part := range e.Parts {
+		if parts[i] = constant(part); parts[i] == nil {
+			return e
+		}
+	}
+	if folded := literal(evaluator.Interpolate(parts), e); folded != nil {
+		return folded
+	}
+	return e
+}
+
+// constant is the value of a literal, nil when e isn't one
+func constant(e ast.Expression) object.Object {
+	switch e := e.(type) {
+	case *ast.IntegerLiteral:
+		if e.Big != nil {
+			return object.IntegerFromBig(e.Big)
+		}
+		return &object.Integer{Value: e.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: e.Value}
+	case *ast.Boolean:
+		return nativeBool(e.Value)
+	case *ast.StringLiteral:
+		return &object.String{Value: e.Value}
+	}
+	return nil
+}
+
+// literal writes obj back as a literal standing where node was, nil when it can't (errors, arrays...)
+func literal(obj object.Object, node ast.Node) ast.Expression {
+	span := token.Span{Start: node.Pos(), End: node.End()}
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: obj.Inspect(), Span: span}, Value: obj.Value}
+	case *object.BigInteger:
+		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: obj.Inspect(), Span: span}, Big: new(big.Int).Set(obj.Value)}
+	case *object.Float:
+		return &ast.FloatLiteral{Token: token.Token{Type: token.FLOAT, Literal: obj.Inspect(), Span: span}, Value: obj.Value}
+	case *object.Boolean:
+		if obj.Value {
+			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "True", Span: span}, Value: true}
+		}
+		return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "False", Span: span}, Value: false}
+	case *object.String:
+		if len(obj.Value) > maxFoldedString {
+			return nil
+		}
+		return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: obj.Value, Span: span}, Value: obj.Value}
+	}
+	return nil
+}
+
+// literalAt is a copy of the literal value, moved to where the variable was read
+func literalAt(value ast.Expression, at ast.Node) ast.Expression {
+	return literal(constant(value), at)
+}
+
+func nativeBool(b bool) *object.Boolean {
+	if b {
+		return evaluator.TRUE
+	}
+	return evaluator.FALSE
+}
@@ -0,0 +1,198 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+)
+
+// Inlining replaces a call to a small pure function with the function's body, its parameters replaced by the
+// arguments. A body is only inlined where that can't change anything:
+//   - it's a single expression (or the return of one) without loops, functions, hashes or assignments
+//   - it reads nothing but its parameters and builtins, so every name in it means the same at the call
+//     (that also rules out recursion, a function can't call itself without reading its own name)
+//   - every argument is a literal, or a variable of the caller that's already set: either one is the same value
+//     however many times the body reads it, and reading it can't fail, even if the body never does
+// The copy keeps the positions of the function's code, an error in it points where it always did, and the whole
+// of it has the call's span, so an error around it (like a division by what the call returned) still points at the call
+
+func (o *optimizer) inline(call *ast.CallExpression, s *scope) ast.Expression {
+	name, ok := call.Function.(*ast.Identifier)
+	if !ok || o.opts.InlineSize <= 0 {
+		return nil
+	}
+	fn, ok := s.lookup(name.Value).(*ast.FunctionLiteral)
+	if !ok || !fn.Pure || len(call.Arguments) != len(fn.Parameters) {
+		return nil
+	}
+
+	body := o.inlinable(fn)
+	if body == nil {
+		return nil
+	}
+
+	args := map[string]ast.Expression{}
+	for i, p := range fn.Parameters {
+		if !settled(call.Arguments[i], s) {
+			return nil
+		}
+		args[p.Value] = call.Arguments[i]
+	}
+
+	// The arguments are in, some of it probably folds now
+	// what's left stands where the call was, like a literal it folds to
+	return o.expression(&ast.InlinedCall{Span: ast.SpanOf(call), Value: substitute(body, args)}, s)
+}
+
+// inlinable is the expression fn's body comes down to, nil when fn can't be inlined
+func (o *optimizer) inlinable(fn *ast.FunctionLiteral) ast.Expression {
+	if fn.Body == nil || len(fn.Body.Statements) != 1 {
+		return nil
+	}
+
+	var body ast.Expression
+	switch stmt := fn.Body.Statements[0].(type) {
+	case *ast.ExpressionStatement:
+		body = stmt.Expression
+	case *ast.ReturnStatement:
+		body = stmt.ReturnValue
+	}
+	if body == nil {
+		return nil
+	}
+
+	params := map[string]bool{}
+	for _, p := range fn.Parameters {
+		if params[p.Value] {
+			return nil
+		}
+		params[p.Value] = true
+	}
+
+	size, ok := 0, true
+	ast.Inspect(body, func(node ast.Node) bool {
+		// Returning false only skips the children, a rejected node must stop its siblings too
+		if !ok {
+			return false
+		}
+		size++
+		switch node := node.(type) {
+		case *ast.Identifier:
+			ok = params[node.Value] || o.builtin(node.Value)
+		case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.Boolean, *ast.StringLiteral, *ast.PrefixExpression,
+			*ast.InfixExpression, *ast.CallExpression, *ast.ArrayLiteral, *ast.IndexExpression,
+			*ast.InterpolatedString, *ast.IfExpression, *ast.BlockStatement, *ast.ExpressionStatement, *ast.InlinedCall:
+		default:
+			ok = false
+		}
+		return ok
+	})
+
+	if !ok || size > o.opts.InlineSize {
+		return nil
+	}
+	return body
+}
+
+// settled is true for an argument that can stand in for a parameter, see the rules above
+func settled(arg ast.Expression, s *scope) bool {
+	if ident, ok := arg.(*ast.Identifier); ok {
+		return s.declared[ident.Value] > 0 && s.defined[ident.Value]
+	}
+	return constant(arg) != nil
+}
+
+// substitute copies e with the parameters in args replaced, the copy shares nothing the optimizer could change later
+func substitute(e ast.Expression, args map[string]ast.Expression) ast.Expression {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if arg, ok := args[e.Value]; ok {
+			return moved(arg, e)
+		}
+		return &ast.Identifier{Token: e.Token, Value: e.Value}
+
+	case *ast.PrefixExpression:
+		c := *e
+		c.Right = substitute(e.Right, args)
+		return &c
+
+	case *ast.InfixExpression:
+		c := *e
+		c.Left = substitute(e.Left, args)
+		c.Right = substitute(e.Right, args)
+		return &c
+
+	case *ast.CallExpression:
+		c := *e
+		c.Tail = false // the function's tail, the copy can end up anywhere in the caller
+		c.Function = substitute(e.Function, args)
+		c.Arguments = substituteAll(e.Arguments, args)
+		return &c
+
+	case *ast.ArrayLiteral:
+		c := *e
+		c.Elements = substituteAll(e.Elements, args)
+		return &c
+
+	case *ast.IndexExpression:
+		c := *e
+		c.Left = substitute(e.Left, args)
+		c.Index = substitute(e.Index, args)
+		return &c
+
+	case *ast.InterpolatedString:
+		c := *e
+		c.Parts = substituteAll(e.Parts, args)
+		return &c
+
+	case *ast.InlinedCall:
+		c := *e
+		c.Value = substitute(e.Value, args)
+		return &c
+
+	case *ast.IfExpression:
+		c := *e
+		c.Condition = substitute(e.Condition, args)
+		c.Consequence = substituteBlock(e.Consequence, args)
+		c.Alternative = substituteBlock(e.Alternative, args)
+		if e.ElseIf != nil {
+			c.ElseIf = substitute(e.ElseIf, args).(*ast.IfExpression)
+		}
+		return &c
+	}
+
+	// Literals, nothing changes those in place
+	return e
+}
+
+func substituteAll(list []ast.Expression, args map[string]ast.Expression) []ast.Expression {
+	out := make([]ast.Expression, len(list))
+	for i, e := range list {
+		out[i] = substitute(e, args)
+	}
+	return out
+}
+
+// substituteBlock copies a block of an inlined if, inlinable made sure it only holds expression statements
+func substituteBlock(b *ast.BlockStatement, args map[string]ast.Expression) *ast.BlockStatement {
+	if b == nil {
+		return nil
+	}
+
+	c := *b
+	c.Statements = make([]ast.Statement, len(b.Statements))
+	for i, stmt := range b.Statements {
+		es := *stmt.(*ast.ExpressionStatement)
+		es.Expression = substitute(es.Expression, args)
+		c.Statements[i] = &es
+	}
+	return &c
+}
+
+// moved is a copy of an argument, standing where the parameter was read
+func moved(arg ast.Expression, at *ast.Identifier) ast.Expression {
+	if ident, ok := arg.(*ast.Identifier); ok {
+		tok := at.Token
+		tok.Literal = ident.Value
+		return &ast.Identifier{Token: tok, Value: ident.Value}
+	}
+	return literalAt(arg, at)
+}
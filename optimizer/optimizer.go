@@ -0,0 +1,352 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/token"
+	"fmt"
+)
+
+// The optimizer rewrites a parsed program before it runs, both engines get the same program so they
+// can't disagree about it. Every rewrite has to keep the program doing exactly what it did, errors included,
+// so anything it isn't sure about is left alone for the engines to do at runtime
+//
+// Constant propagation replaces a variable with its value when that value can never change:
+//   - the variable comes from a let holding a literal (after folding), written straight in a function body
+//     or the top level, not inside an if or a loop where it may not run
+//   - that function (or the top level) declares the name only once, parameters and loop variables count
+//   - no assignment anywhere in the program uses the name, so += in a closure can't change it behind our back
+//   - only code written after the let is rewritten, code before it could run before the variable exists
+//
+// Small pure functions are inlined at their calls (see inline.go), the same rules decide which function a name holds
+//
+// Dead code elimination (see dead.go) then drops what can never run or never matters
+
+// DefaultInlineSize is the largest function body, counted in ast nodes, that Optimize inlines
+const DefaultInlineSize = 12
+
+type Options struct {
+	Session    bool                         // The program is one input of a REPL session, see OptimizeInput
+	Report     func(diagnostics.Diagnostic) // Gets a note for every piece of code that was removed, nil when nobody asked
+	InlineSize int                          // Largest function body inlined, in ast nodes, 0 turns inlining off
+}
+
+// Optimize rewrites a whole script, in place, and returns it
+func Optimize(program *ast.Program) *ast.Program {
+	return OptimizeWith(program, Options{InlineSize: DefaultInlineSize})
+}
+
+// OptimizeInput is Optimize for code typed in the REPL
+// the next inputs can still use and reassign its top level variables, so those are never propagated or removed
+func OptimizeInput(program *ast.Program) *ast.Program {
+	return OptimizeWith(program, Options{Session: true, InlineSize: DefaultInlineSize})
+}
+
+func OptimizeWith(program *ast.Program, opts Options) *ast.Program {
+	o := &optimizer{opts: opts, assigned: assignedNames(program), declared: declaredNames(program), checking: map[*ast.FunctionLiteral]bool{}}
+
+	top := newScope(nil, program.Statements, nil)
+	top.open = opts.Session
+	program.Statements = o.body(program.Statements, top)
+
+	o.removeUnusedLets(program)
+	return program
+}
+
+type optimizer struct {
+	opts     Options
+	assigned map[string]bool               // Names that show up on the left of an assignment somewhere in the program
+	declared map[string]bool               // Names declared somewhere in the program, any other name can only be a builtin
+	checking map[*ast.FunctionLiteral]bool // Functions whose purity is being worked out, see pure.go
+}
+
+// scope is a function body (or the top level), blocks aren't scopes here, a let in an if is the function's
+type scope struct {
+	parent   *scope
+	declared map[string]int            // How many times each name is declared in this function
+	consts   map[string]ast.Expression // The lets known to always hold the same literal or function, from the point they're declared on
+	defined  map[string]bool           // Parameters, and the lets that already ran when the code being optimized runs
+	open     bool                      // More code can come later and assign these variables (the REPL's top level)
+}
+
+func newScope(parent *scope, body []ast.Statement, parameters []*ast.Identifier) *scope {
+	s := &scope{parent: parent, declared: map[string]int{}, consts: map[string]ast.Expression{}, defined: map[string]bool{}}
+
+	for _, p := range parameters {
+		s.declared[p.Value] += 1
+		s.defined[p.Value] = true
+	}
+	for _, stmt := range body {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FunctionLiteral:
+				return false // its names are its own
+			case *ast.LetStatement:
+				s.declared[node.Name.Value] += 1
+			case *ast.ForInLoop:
+				if node.Key != nil {
+					s.declared[node.Key.Value] += 1
+				}
+				s.declared[node.Value.Value] += 1
+			}
+			return true
+		})
+	}
+	return s
+}
+
+// lookup is the literal or function name holds, or nil
+// A name declared in a function hides the outer one in the whole function, even before the let,
+// the compiler gives it a local slot from the start of the function
+func (s *scope) lookup(name string) ast.Expression {
+	for ; s != nil; s = s.parent {
+		if value, ok := s.consts[name]; ok {
+			return value
+		}
+		if s.declared[name] > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+func declaredNames(program *ast.Program) map[string]bool {
+	declared := map[string]bool{}
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			declared[node.Name.Value] = true
+		case *ast.FunctionLiteral:
+			for _, p := range node.Parameters {
+				declared[p.Value] = true
+			}
+		case *ast.ForInLoop:
+			if node.Key != nil {
+				declared[node.Key.Value] = true
+			}
+			declared[node.Value.Value] = true
+		}
+		return true
+	})
+	return declared
+}
+
+func assignedNames(program *ast.Program) map[string]bool {
+	assigned := map[string]bool{}
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Assignment:
+			assigned[node.Variable.Value] = true
+		case *ast.CompoundAssignment:
+			assigned[node.Variable.Value] = true
+		}
+		return true
+	})
+	return assigned
+}
+
+// body optimizes the statements of a function or the top level, the only place a let can become a constant
+func (o *optimizer) body(statements []ast.Statement, s *scope) []ast.Statement {
+	return o.statements(statements, s, true)
+}
+
+func (o *optimizer) block(b *ast.BlockStatement, s *scope) {
+	if b != nil {
+		b.Statements = o.statements(b.Statements, s, false)
+	}
+}
+
+// statements optimizes a list of statements and gives back what's left of it
+// in a body every let runs exactly once, in order, so that's where lets are turned into constants
+func (o *optimizer) statements(list []ast.Statement, s *scope, body bool) []ast.Statement {
+	out := make([]ast.Statement, 0, len(list))
+
+	for i, stmt := range list {
+		last := i == len(list)-1
+
+		let, fixed := stmt.(*ast.LetStatement)
+		fixed = fixed && body && o.fixed(let, s)
+		if fixed {
+			if fn, ok := let.Value.(*ast.FunctionLiteral); ok {
+				// Known before its body is optimized, so the function's calls to itself are known too
+				s.consts[let.Name.Value] = fn
+			}
+		}
+
+		out = append(out, o.expand(stmt, s, last)...)
+
+		if fixed && constant(let.Value) != nil {
+			s.consts[let.Name.Value] = let.Value
+		}
+		if body && let != nil {
+			s.defined[let.Name.Value] = true
+		}
+
+		if rest := list[i+1:]; len(out) > 0 && isJump(out[len(out)-1]) && len(rest) > 0 && !declaresAny(rest) {
+			o.report(diagnostics.UnreachableCode, token.Span{Start: rest[0].Pos(), End: rest[len(rest)-1].End()},
+				"removed unreachable code")
+			break
+		}
+	}
+	return out
+}
+
+// fixed is true when let gives its variable the only value it will ever have
+func (o *optimizer) fixed(let *ast.LetStatement, s *scope) bool {
+	name := let.Name.Value
+	return !s.open && s.declared[name] == 1 && !o.assigned[name]
+}
+
+// expand optimizes one statement of a list and gives what takes its place, that's stmt itself unless
+// it's an if or a loop that can be decided now: then it's the statements of the branch that always runs, or nothing
+// The last statement gives the value of the whole list (a function's result, what the REPL prints), it always stays
+func (o *optimizer) expand(stmt ast.Statement, s *scope, last bool) []ast.Statement {
+	es, ok := stmt.(*ast.ExpressionStatement)
+	if !ok || last {
+		o.statement(stmt, s)
+		return []ast.Statement{stmt}
+	}
+
+	switch e := es.Expression.(type) {
+	case *ast.IfExpression:
+		live, taken, decided := o.pruneIf(e, s)
+		if !decided {
+			es.Expression = live
+			return []ast.Statement{stmt}
+		}
+		if taken == nil {
+			return nil
+		}
+		return taken.Statements
+
+	case *ast.WhileLoop:
+		e.Condition = o.expression(e.Condition, s)
+		if neverTrue(e.Condition) && !declares(e.Consequence) {
+			o.report(diagnostics.DeadCode, ast.SpanOf(e), "removed a loop that never runs")
+			return nil
+		}
+		o.block(e.Consequence, s)
+		return []ast.Statement{stmt}
+	}
+
+	o.statement(stmt, s)
+	return []ast.Statement{stmt}
+}
+
+func (o *optimizer) report(code string, span token.Span, format string, args ...interface{}) {
+	if o.opts.Report != nil {
+		o.opts.Report(diagnostics.Diagnostic{Severity: diagnostics.Note, Code: code, Message: fmt.Sprintf(format, args...), Span: span})
+	}
+}
+
+func (o *optimizer) statement(stmt ast.Statement, s *scope) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		stmt.Value = o.expression(stmt.Value, s)
+	case *ast.ReturnStatement:
+		stmt.ReturnValue = o.expression(stmt.ReturnValue, s)
+	case *ast.ExpressionStatement:
+		stmt.Expression = o.expression(stmt.Expression, s)
+	case *ast.Assignment:
+		stmt.Value = o.expression(stmt.Value, s)
+	case *ast.CompoundAssignment:
+		stmt.Value = o.expression(stmt.Value, s)
+	case *ast.IndexAssignment:
+		stmt.Target.Left = o.expression(stmt.Target.Left, s)
+		stmt.Target.Index = o.expression(stmt.Target.Index, s)
+		stmt.Value = o.expression(stmt.Value, s)
+	}
+}
+
+func (o *optimizer) expression(e ast.Expression, s *scope) ast.Expression {
+	if e == nil {
+		return nil
+	}
+
+	switch e := e.(type) {
+	case *ast.Identifier:
+		if value := s.lookup(e.Value); constant(value) != nil {
+			return literalAt(value, e)
+		}
+
+	case *ast.PrefixExpression:
+		e.Right = o.expression(e.Right, s)
+		return foldPrefix(e)
+
+	case *ast.InfixExpression:
+		e.Left = o.expression(e.Left, s)
+		e.Right = o.expression(e.Right, s)
+		return foldInfix(e)
+
+	case *ast.IfExpression:
+		live, taken, decided := o.pruneIf(e, s)
+		if !decided {
+			return live
+		}
+		return branchValue(e, taken)
+
+	case *ast.FunctionLiteral:
+		if e.Body != nil {
+			fs := newScope(s, e.Body.Statements, e.Parameters)
+			e.Body.Statements = o.body(e.Body.Statements, fs)
+			e.Pure = o.pure(e, fs)
+		}
+
+	case *ast.CallExpression:
+		e.Function = o.expression(e.Function, s)
+		for i, arg := range e.Arguments {
+			e.Arguments[i] = o.expression(arg, s)
+		}
+		if inlined := o.inline(e, s); inlined != nil {
+			return inlined
+		}
+
+	case *ast.InlinedCall:
+		e.Value = o.expression(e.Value, s)
+		if folded := literal(constant(e.Value), e); folded != nil {
+			return folded
+		}
+
+	case *ast.ArrayLiteral:
+		for i, elem := range e.Elements {
+			e.Elements[i] = o.expression(elem, s)
+		}
+
+	case *ast.HashLiteral:
+		pairs := make(map[ast.Expression]ast.Expression, len(e.Pairs))
+		for key, value := range e.Pairs {
+			pairs[o.expression(key, s)] = o.expression(value, s)
+		}
+		e.Pairs = pairs
+
+	case *ast.IndexExpression:
+		e.Left = o.expression(e.Left, s)
+		e.Index = o.expression(e.Index, s)
+
+	case *ast.InterpolatedString:
+		for i, part := range e.Parts {
+			e.Parts[i] = o.expression(part, s)
+		}
+		return foldInterpolation(e)
+
+	case *ast.WhileLoop:
+		e.Condition = o.expression(e.Condition, s)
+		o.block(e.Consequence, s)
+
+	case *ast.ForLoop:
+		if e.Init != nil {
+			o.statement(e.Init, s)
+		}
+		e.Condition = o.expression(e.Condition, s)
+		if e.Post != nil {
+			o.statement(e.Post, s)
+		}
+		o.block(e.Body, s)
+
+	case *ast.ForInLoop:
+		e.Iterable = o.expression(e.Iterable, s)
+		o.block(e.Body, s)
+	}
+
+	return e
+}
@@ -0,0 +1,403 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/lexer"
+	"MyInterpreter/object"
+	"MyInterpreter/parser"
+	"fmt"
+	"testing"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.NewParser(lexer.NewLexer(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("%q has parser errors: %v", input, p.Errors())
+	}
+	return program
+}
+
+func TestFolding(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(3 + 4) * -5", "-35"},
+		{"7 % 3", "1"},
+		{"-7 % 3", "-1"},
+		{"2 <= 3", "True"},
+		{"(3 > 5) == False", "True"},
+		{"12 & 10 | 3", "11"},
+		{"1 << 3", "8"},
+		{"~0", "-1"},
+		{"!True", "False"},
+		{"2 ** 10", "1024"},
+		{"1.5 * 2", "3.0"},
+		{`"ab" + "c"`, "abc"},
+		{`"total: ${1 + 2}!"`, "total: 3!"},
+		{"add(1, 2 * 3, [4 + 5])", "add(1, 6, [9])"},
+		// Short-circuiting drops the side that never runs
+		{"True || f()", "True"},
+		{"False && f()", "False"},
+		{"0 && 0", "True"},
+		{"True && f()", "(True && f())"},
+		// Errors and overflow are left for runtime, where they get reported (or become big numbers)
+		{"1 / 0", "(1 / 0)"},
+		{"1 + True", "(1 + True)"},
+		{"9223372036854775807 + 1", "(9223372036854775807 + 1)"},
+		{"1 << -1", "(1 << -1)"},
+		{"x + 1 * 2", "(x + 2)"},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input))
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestFoldedNodesKeepTheirSpan(t *testing.T) {
+	program := Optimize(parse(t, "let x = 5;\nputs((x + 1) * 2);"))
+
+	value := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.CallExpression).Arguments[0]
+	if _, ok := value.(*ast.IntegerLiteral); !ok {
+		t.Fatalf("value not folded. got=%T", value)
+	}
+	if value.Pos().Line != 2 || value.Pos().Column != 7 || value.End().Column != 17 {
+		t.Errorf("wrong span. got=%s to %s", value.Pos(), value.End())
+	}
+}
+
+// What's left of an inlined call stands where the call was, folded or not
+func TestInlinedCallsKeepTheirSpan(t *testing.T) {
+	program := Optimize(parse(t, "let sq = fn(x) { x * x };\nlet f = fn(y) {\n  sq(3) + sq(y) };\nf"))
+
+	fn := program.Statements[len(program.Statements)-2].(*ast.LetStatement).Value.(*ast.FunctionLiteral)
+	sum := fn.Body.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.InfixExpression)
+
+	if _, ok := sum.Left.(*ast.IntegerLiteral); !ok {
+		t.Fatalf("sq(3) not folded. got=%T", sum.Left)
+	}
+	if _, ok := sum.Right.(*ast.InlinedCall); !ok {
+		t.Fatalf("sq(y) not inlined. got=%T", sum.Right)
+	}
+
+	for _, tt := range []struct {
+		node       ast.Node
+		start, end int
+	}{
+		{sum.Left, 3, 8},
+		{sum.Right, 11, 16},
+	} {
+		if tt.node.Pos().Line != 3 || tt.node.Pos().Column != tt.start || tt.node.End().Column != tt.end {
+			t.Errorf("wrong span for %s. got=%s to %s", tt.node.String(), tt.node.Pos(), tt.node.End())
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // what the last statement becomes
+	}{
+		{"let x = 5; let y = x * 2; y + 1", "11"},
+		{"let name = \"k2m\"; \"hi ${name}\"", "hi k2m"},
+		{"fn() { let n = 3; n * n }", "fn()9/n}"},
+		{"let x = 5; fn(y) { x + y }", "fn(y)(5 + y)/n}"},
+		{"let x = 5; fn() { fn() { x } }", "fn()fn()5/n}/n}"},
+		// Assigned somewhere, even in a function that may never run
+		{"let x = 5; x += 1; x * 2", "(x * 2)"},
+		{"let x = 5; let f = fn() { x = 6 }; x", "x"},
+		{"let x = 5; let f = fn() { let x = 1; x += 1 }; x", "x"},
+		// Code written before the let can run before it
+		{"fn() { x; let x = 5; x }", "fn()xletx = 5;5/n}"},
+		// Another declaration of the same name
+		{"let x = 5; fn(x) { x + 1 }", "fn(x)(x + 1)/n}"},
+		{"let x = 5; fn() { let y = x; let x = 2; y }", "fn()lety = x;letx = 2;y/n}"},
+		{"let x = 1; let x = 2; x", "x"},
+		{"let x = 1; for (x in [1, 2]) { }; x", "x"},
+		// A let that may not run
+		{"if (c) { let x = 5 }; x", "x"},
+		{"fn() { while (c) { let n = 1 }; n }", "fn()while(c){letn = 1;}n/n}"},
+		// Only literals are propagated
+		{"let xs = [1]; xs", "xs"},
+		{"let x = f(); x", "x"},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input))
+		last := program.Statements[len(program.Statements)-1]
+		if last.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, last.String())
+		}
+	}
+}
+
+func TestOptimizeInput(t *testing.T) {
+	// The next line typed in the REPL could be x = 6, so the top level x is never propagated
+	program := OptimizeInput(parse(t, "let x = 5; let f = fn() { let n = 2; x * n }; x + 1"))
+
+	if got := program.Statements[1].String(); got != "letf = fn()(x * 2)/n};" {
+		t.Errorf("wrong function. got=%q", got)
+	}
+	if got := program.Statements[2].String(); got != "(x + 1)" {
+		t.Errorf("wrong last statement. got=%q", got)
+	}
+}
+
+func TestDeadCode(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (False) { puts(1) }; 2", "2"},
+		{"if (1 > 2) { puts(1) } else { puts(2) }; 3", "puts(2)3"},
+		{"if (c) { 1 } else if (False) { 2 } else { 3 }; 4", "if c 1 else 3 4"},
+		{"if (c) { 1 } else if (True) { 2 } else { 3 }; 4", "if c 1 else 2 4"},
+		{"if (False) { 1 } else if (c) { 2 }; 3", "if c 2 3"},
+		{"if (True) { puts(1); puts(2) } else { puts(3) }; 4", "puts(1)puts(2)4"},
+		{"while (False) { puts(1) }; 2", "2"},
+		{"let f = fn() { return 1; puts(2); puts(3) }; f", "letf = fn()return1;/n};f"},
+		{"while (c) { break; puts(1) }; 2", "while(c){break;}2"},
+		{"let f = fn() { if (True) { return 1 }; puts(2) }; f", "letf = fn()return1;/n};f"},
+		// Where the if is used for its value, only the value is left (then propagated here)
+		{"let v = if (True) { 1 } else { 2 }; v + c", "(1 + c)"},
+		{"[if (False) { 1 }]", "[if False  ]"},
+		{"fn() { if (2 < 1) { 1 } else { puts(1); 2 } }", "fn()if True puts(1)2 /n}"},
+		// The last statement gives the value of the program
+		{"puts(1); if (False) { 2 }", "puts(1)if False  "},
+		{"puts(1); let unused = 5", "puts(1)letunused = 5;"},
+		// Unused lets with a value that can't do anything
+		{"let a = 1; let b = [1, \"x\", {1: fn() { c }}]; 2", "2"},
+		{"let a = f(); 2", "leta = f();2"},
+		{"let a = 1 / 0; 2", "leta = (1 / 0);2"},
+		{"let a = {[1]: 2}; 3", "leta = {[1]:2};3"},
+		{"let a = 1; a = 2; 3", "leta = 1;a = 23"},
+		// Declarations stay, even where they can't run
+		{"if (False) { let a = 1 }; a", "if False leta = 1; a"},
+		{"let f = fn() { return a; let a = 1 }; f()", "letf = fn()returna;leta = 1;/n};f()"},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input))
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestOptimizeInputKeepsTopLevelLets(t *testing.T) {
+	// A later input may read it
+	program := OptimizeInput(parse(t, "let a = 1; let f = fn() { let b = 2; 3 }; 4"))
+	if got := program.String(); got != "leta = 1;letf = fn()3/n};4" {
+		t.Errorf("wrong program. got=%q", got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	input := `let f = fn() {
+	let unused = [1, 2];
+	return 1;
+	puts("never");
+	2
+};
+if (False) { puts("never") } else { f() };
+while (1 > 2) { puts("never") };
+f()`
+
+	var notes []diagnostics.Diagnostic
+	OptimizeWith(parse(t, input), Options{Report: func(d diagnostics.Diagnostic) {
+		notes = append(notes, d)
+	}})
+
+	expected := []struct {
+		code    string
+		message string
+		span    string
+	}{
+		{diagnostics.UnreachableCode, "removed unreachable code", "4:2-5:3"},
+		{diagnostics.DeadCode, "removed a branch that never runs", "7:1-7:29"},
+		{diagnostics.DeadCode, "removed a loop that never runs", "8:1-8:32"},
+		{diagnostics.UnusedVariable, "removed unused variable unused", "2:2-2:21"},
+	}
+
+	if len(notes) != len(expected) {
+		t.Fatalf("wrong number of notes. expected=%d, got=%d: %v", len(expected), len(notes), notes)
+	}
+	for i, want := range expected {
+		got := notes[i]
+		span := fmt.Sprintf("%d:%d-%d:%d", got.Span.Start.Line, got.Span.Start.Column, got.Span.End.Line, got.Span.End.Column)
+		if got.Severity != diagnostics.Note || got.Code != want.code || got.Message != want.message || span != want.span {
+			t.Errorf("notes[%d]: expected %s %q at %s, got %s %s %q at %s",
+				i, want.code, want.message, want.span, got.Severity, got.Code, got.Message, span)
+		}
+	}
+}
+
+func TestPurity(t *testing.T) {
+	tests := []struct {
+		input string // defines f
+		pure  bool
+	}{
+		{"let f = fn(x) { x * x }", true},
+		{"let f = fn(xs) { push(xs, len(xs)) }", true},
+		{"let f = fn(n) { let t = 0; for (i in range(n)) { t += i }; t }", true},
+		{"let f = fn() { fn() { print(1) } }", true},
+		{"let f = fn(n) { if (n < 2) { 1 } else { n * f(n - 1) } }", true},
+		{"let sq = fn(x) { x * x }; let f = fn(x) { sq(x) + sq(x + 1) }", true},
+		{"let f = fn(x) { print(x) }", false},
+		{"let f = fn(xs) { remove(xs, 1) }", false},
+		{"let total = 0; let f = fn(n) { total += n }", false},
+		{"let f = fn(xs) { xs[0] = 1 }", false},
+		{"let f = fn(g, x) { g(x) }", false},
+		{"let p = fn(x) { print(x) }; let f = fn(x) { p(x) }", false},
+		{"let len = fn(x) { print(x) }; let f = fn(x) { len(x) }", false},
+		{"let f = fn(x) { g(x) }; let g = fn(x) { x }", false},
+		// An impure call stays impure whatever comes after it
+		{"let f = fn(x) { [print(x), len(x)] }", false},
+		{"let h = fn(x) { print(x) }; let f = fn(x) { [h(x), len(x)] }", false},
+		{"let f = fn(x) { print(x); len(x) }", false},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input+"; f"))
+
+		var f *ast.FunctionLiteral
+		for _, stmt := range program.Statements {
+			if let, ok := stmt.(*ast.LetStatement); ok && let.Name.Value == "f" {
+				f = let.Value.(*ast.FunctionLiteral)
+			}
+		}
+		if f == nil {
+			t.Fatalf("%q: f is gone. got=%q", tt.input, program.String())
+		}
+		if f.Pure != tt.pure {
+			t.Errorf("%q: expected pure=%t, got=%t", tt.input, tt.pure, f.Pure)
+		}
+	}
+}
+
+func TestInlining(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let sq = fn(x) { x * x }; sq(3)", "9"},
+		{"let sq = fn(x) { return x * x }; sq(sq(2))", "16"},
+		{"let abs = fn(n) { if (n < 0) { -n } else { n } }; abs(-5)", "5"},
+		{"let greet = fn(name) { \"hi ${name}\" }; greet(\"k2m\")", "hi k2m"},
+		{"let sq = fn(x) { x * x }; let f = fn(n) { sq(n) + 1 }; f", "letf = fn(n)((n * n) + 1)/n};f"},
+		{"let sq = fn(x) { x * x }; let f = fn() { let y = g(); sq(y) }; f", "letf = fn()lety = g();(y * y)/n};f"},
+		{"let size = fn(xs) { len(xs) * 2 }; size(\"abc\")", "(len(abc) * 2)"},
+		// Not inlined
+		{"let first = fn(xs) { xs[0] }; first([1, 2])", "letfirst = fn(xs)(xs[0])/n};first([1,2])"},
+		{"let p = fn(x) { print(x) }; p(1)", "letp = fn(x)print(x)/n};p(1)"},
+		{"let sq = fn(x) { x * x }; sq(g())", "letsq = fn(x)(x * x)/n};sq(g())"},
+		{"let sq = fn(x) { x * x }; sq(1, 2)", "letsq = fn(x)(x * x)/n};sq(1, 2)"},
+		{"let sq = fn(x) { x * x }; let f = fn() { sq(y) }; let y = g(); f", "letsq = fn(x)(x * x)/n};letf = fn()sq(y)/n};lety = g();f"},
+		{"let k = g(); let h = fn(x) { x * k }; h(2)", "letk = g();leth = fn(x)(x * k)/n};h(2)"},
+		{"let fact = fn(n) { if (n < 2) { 1 } else { n * fact(n - 1) } }; fact(5)", "letfact = fn(n)if (n < 2) 1 else (n * fact((n - 1))) /n};fact(5)"},
+		{"let f = fn(x) { let y = x; y }; f(1)", "letf = fn(x)lety = x;y/n};f(1)"},
+		// Recursive, the call to itself isn't the first thing in the body
+		{"let f = fn(a) { 1 + f(a) }; f(1)", "letf = fn(a)(1 + f(a))/n};f(1)"},
+		{"let f = fn(a) { [f(a)] }; f(1)", "letf = fn(a)[f(a)]/n};f(1)"},
+		{"let f = fn(a) { 1 + g(a) }; let g = fn(a) { 1 + f(a) }; f(1)", "letf = fn(a)(1 + g(a))/n};letg = fn(a)(1 + f(a))/n};f(1)"},
+		// A len declared in the program isn't the builtin, this one is inlined
+		{"let len = fn(x) { 1 }; let f = fn(x) { len(x) }; f(2)", "1"},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input))
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestInlineSize(t *testing.T) {
+	tests := []struct {
+		size     int
+		expected string
+	}{
+		{DefaultInlineSize, "12"},
+		{5, "12"}, // (x * x) + x is 5 nodes
+		{4, "letf = fn(x)((x * x) + x)/n};f(3)"},
+		{0, "letf = fn(x)((x * x) + x)/n};f(3)"},
+	}
+
+	for _, tt := range tests {
+		program := OptimizeWith(parse(t, "let f = fn(x) { x * x + x }; f(3)"), Options{InlineSize: tt.size})
+		if program.String() != tt.expected {
+			t.Errorf("size %d: expected=%q, got=%q", tt.size, tt.expected, program.String())
+		}
+	}
+}
+
+// len(x) is size's tail call, once inlined into 1 + size(y) it isn't f's
+func TestInlinedCallsAreNotTailCalls(t *testing.T) {
+	program := Optimize(parse(t, "let size = fn(x) { len(x) }; let f = fn(y) { 1 + size(y) }; f([1, 2])"))
+
+	inlined := 0
+	ast.Inspect(program, func(node ast.Node) bool {
+		if ic, ok := node.(*ast.InlinedCall); ok {
+			if call, ok := ic.Value.(*ast.CallExpression); ok {
+				inlined++
+				if call.Tail {
+					t.Errorf("%s is marked as a tail call", call.String())
+				}
+			}
+		}
+		return true
+	})
+	if inlined != 1 {
+		t.Fatalf("size(y) wasn't inlined, got=%q", program.String())
+	}
+}
+
+// Whatever the optimizer does, the program has to give the same result as before
+func TestSameResults(t *testing.T) {
+	inputs := []string{
+		"let x = 5; let y = x * 2; [x, y, y / x, x % 3, -x]",
+		"let x = 5; let bump = fn() { x += 1 }; bump(); bump(); x * 10",
+		"let x = 1; let f = fn() { x }; let g = fn(x) { x * 2 }; [f(), g(10)]",
+		"let n = 10; let sum = 0; for (let i = 0; i < n; i += 1) { sum += i }; sum",
+		"let total = fn(xs) { let s = 0; for (x in xs) { s += x }; s }; total([1, 2, 3])",
+		"let k = 3; let h = {k: k * 2, \"k\": k}; [h[3], h[\"k\"]]",
+		"let big = 9223372036854775807; big + 1",
+		"let zero = 0; let one = 1; one / zero",
+		"let t = True; let f = fn() { 1 + True }; t || f()",
+		"let name = \"x\"; let n = 2; \"${name}=${n * 21}\"",
+		"let f = fn() { g() }; let g = fn() { c }; let c = 7; f()",
+		"let s = 1 << 62; [s, s >> 61, ~s & 7]",
+		"let f = fn(n) { if (True) { let m = n * 2 }; if (False) { return 0 }; m }; f(4)",
+		"let g = fn() { while (False) { }; for (let i = 0; i < 3; i += 1) { if (i == 1) { return i }; continue; i = 9 } }; g()",
+		"let unused = 1 / 0; 5",
+		"let h = fn() { let a = 1; if (a > 0) { \"pos\" } else { \"neg\" } }; h()",
+		"if (False) { 1 }",
+		"let sq = fn(x) { x * x }; let n = len(args); [sq(3), sq(n), sq(sq(2))]",
+		"let sq = fn(x) { x * x }; sq(\"a\")",
+		"let half = fn(x) { x / 2 }; let f = fn(n) { half(n) }; f(0) + half(0) + f(\"a\")",
+		"let sq = fn(x) { x * x }; let z = 0; sq(3) / z",
+		"let f = fn(a) { 1 + f(a) }; f(1)",
+		"let sq = fn(x) { x * x }; let f = fn(y, z) { sq(y) / z }; f(3, 0)",
+		"let pick = fn(c, a, b) { if (c) { a } else { b } }; let f = fn() { let u = 1; pick(False, missing, u) }; f()",
+		"let fact = fn(n) { if (n < 2) { 1 } else { n * fact(n - 1) } }; fact(20) + fact(21)",
+		"let size = fn(x) { len(x) }; let f = fn(y) { 1 + size(y) }; f([1, 2])",
+		"let loop = fn(n, acc) { if (n == 0) { return acc }; loop(n - 1, acc + n) }; loop(50000, 0)",
+	}
+
+	for _, input := range inputs {
+		expected := evaluator.Eval(parse(t, input), object.NewEnvironment())
+		got := evaluator.Eval(Optimize(parse(t, input)), object.NewEnvironment())
+
+		if expected.Inspect() != got.Inspect() {
+			t.Errorf("%q: optimized program gives %s, expected %s", input, got.Inspect(), expected.Inspect())
+		}
+	}
+}
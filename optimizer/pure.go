@@ -0,0 +1,60 @@
+package optimizer
+
+import (
+	"MyInterpreter/ast"
+	"MyInterpreter/evaluator"
+)
+
+// A function is pure when a call can only be noticed through its result (or its error): it doesn't assign variables
+// it didn't declare, doesn't assign into arrays or hashes (they may belong to anyone), and only calls builtins
+// without side effects and functions that are pure themselves
+// Reading outer variables is fine, and so is creating functions, those only matter once they're called
+
+// pureBuiltins only look at their arguments, remove changes the array it's given and print writes to stdout
+var pureBuiltins = map[string]bool{"len": true, "push": true, "int": true, "float": true, "powmod": true, "range": true}
+
+// pure works out if fn is pure, fs is the scope its body was just optimized in
+func (o *optimizer) pure(fn *ast.FunctionLiteral, fs *scope) bool {
+	// A call to fn from its own body counts as pure, if fn isn't it's because of something else
+	o.checking[fn] = true
+	defer delete(o.checking, fn)
+
+	pure := true
+	ast.Inspect(fn.Body, func(node ast.Node) bool {
+		// Once impure always impure, a later sibling must not set it back
+		if !pure {
+			return false
+		}
+		switch node := node.(type) {
+		case *ast.FunctionLiteral:
+			return false
+		case *ast.Assignment:
+			pure = fs.declared[node.Variable.Value] > 0
+		case *ast.CompoundAssignment:
+			pure = fs.declared[node.Variable.Value] > 0
+		case *ast.IndexAssignment:
+			pure = false
+		case *ast.CallExpression:
+			pure = o.pureCall(node, fs)
+		}
+		return pure
+	})
+	return pure
+}
+
+func (o *optimizer) pureCall(call *ast.CallExpression, s *scope) bool {
+	name, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return false
+	}
+	if fn, ok := s.lookup(name.Value).(*ast.FunctionLiteral); ok {
+		return fn.Pure || o.checking[fn]
+	}
+	return o.builtin(name.Value) && pureBuiltins[name.Value]
+}
+
+// builtin is true when name can only be the builtin of that name, nothing in the program declares it
+func (o *optimizer) builtin(name string) bool {
+	_, ok := evaluator.LookupBuiltin(name)
+	return ok && !o.declared[name]
+}
@@ -1,11 +1,104 @@
 package mymath
 
-import "math"
+import (
+	"math"
+	"math/big"
+	"math/bits"
+)
 
+// Exponentiate is x ** y as the float closest to the exact result, it's how a negative exponent is done
+// The exact power is only built when the float can tell the difference, past that math.Pow is already 0 or Inf
 func Exponentiate(x, y int64) float64 {
+	if y < -1100 || y > 1100 {
+		return math.Pow(float64(x), float64(y))
+	}
 
-	//TODO implement my own exponentiation
-	//It's not that bad, most libs use e^yln(x) as the identity
+	exponent := y
+	if exponent < 0 {
+		exponent = -exponent
+	}
 
-	return math.Pow(float64(x), float64(y))
+	power := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(x), big.NewInt(exponent), nil))
+	if y < 0 {
+		if power.Sign() == 0 {
+			return math.Inf(1)
+		}
+		power.Inv(power)
+	}
+
+	result, _ := power.Float64()
+	return result
+}
+
+// PowInt is x ** y by squaring, so it's exact, y has to be >= 0
+// ok is false when the result doesn't fit in an int64
+func PowInt(x, y int64) (result int64, ok bool) {
+	result = 1
+	for {
+		if y&1 == 1 {
+			if result, ok = MulInt(result, x); !ok {
+				return 0, false
+			}
+		}
+
+		y >>= 1
+		if y == 0 {
+			return result, true
+		}
+
+		//x is only squared when there's still a bit left to use it, the last square could overflow for nothing
+		if x, ok = MulInt(x, x); !ok {
+			return 0, false
+		}
+	}
+}
+
+// PowMod is x ** y % m without ever building x ** y, y has to be >= 0 and m > 0
+// The result is always between 0 and m - 1, even for a negative x
+func PowMod(x, y, m int64) int64 {
+	r := x % m
+	if r < 0 {
+		r += m
+	}
+	base := uint64(r)
+
+	result := uint64(1) % uint64(m)
+	for y > 0 {
+		if y&1 == 1 {
+			result = mulMod(result, base, uint64(m))
+		}
+		base = mulMod(base, base, uint64(m))
+		y >>= 1
+	}
+	return int64(result)
+}
+
+// mulMod does the product in 128 bits, a and b are both below m so it never overflows
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return bits.Rem64(hi, lo, m)
+}
+
+// AddInt, SubInt and MulInt are int64 arithmetic that says when the result overflowed instead of wrapping around
+// ok is false on overflow, the caller has to redo the operation with big numbers
+
+func AddInt(x, y int64) (result int64, ok bool) {
+	result = x + y
+	return result, (result > x) == (y > 0)
+}
+
+func SubInt(x, y int64) (result int64, ok bool) {
+	result = x - y
+	return result, (result < x) == (y > 0)
+}
+
+func MulInt(x, y int64) (result int64, ok bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	if (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return 0, false
+	}
+	result = x * y
+	return result, result/y == x
 }
@@ -0,0 +1,107 @@
+package mymath
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       func(x, y int64) (int64, bool)
+		x, y     int64
+		expected int64
+		ok       bool
+	}{
+		{"add", AddInt, 2, 3, 5, true},
+		{"add", AddInt, math.MaxInt64, 0, math.MaxInt64, true},
+		{"add", AddInt, math.MaxInt64, 1, 0, false},
+		{"add", AddInt, math.MinInt64, -1, 0, false},
+		{"add", AddInt, math.MinInt64, math.MaxInt64, -1, true},
+		{"sub", SubInt, 2, 3, -1, true},
+		{"sub", SubInt, math.MinInt64, 1, 0, false},
+		{"sub", SubInt, 0, math.MinInt64, 0, false},
+		{"sub", SubInt, -1, math.MinInt64, math.MaxInt64, true},
+		{"mul", MulInt, 6, -7, -42, true},
+		{"mul", MulInt, 0, math.MinInt64, 0, true},
+		{"mul", MulInt, 1 << 32, 1 << 32, 0, false},
+		{"mul", MulInt, -1, math.MinInt64, 0, false},
+		{"mul", MulInt, math.MinInt64, 1, math.MinInt64, true},
+	}
+
+	for _, tt := range tests {
+		result, ok := tt.op(tt.x, tt.y)
+		if ok != tt.ok || (ok && result != tt.expected) {
+			t.Errorf("%s(%d, %d): expected=(%d, %t), got=(%d, %t)", tt.name, tt.x, tt.y, tt.expected, tt.ok, result, ok)
+		}
+	}
+}
+
+func TestPowInt(t *testing.T) {
+	tests := []struct {
+		x, y     int64
+		expected int64
+		ok       bool
+	}{
+		{2, 10, 1024, true},
+		{3, 0, 1, true},
+		{0, 0, 1, true},
+		{-3, 3, -27, true},
+		{3, 39, 4052555153018976267, true}, // math.Pow gets this one wrong
+		{3, 40, 0, false},
+		{2, 62, 1 << 62, true},
+		{2, 63, 0, false},
+		{-2, 63, math.MinInt64, true},
+		{-1, math.MaxInt64, -1, true},
+		{1 << 32, 2, 0, false},
+	}
+
+	for _, tt := range tests {
+		result, ok := PowInt(tt.x, tt.y)
+		if ok != tt.ok || (ok && result != tt.expected) {
+			t.Errorf("PowInt(%d, %d): expected=(%d, %t), got=(%d, %t)", tt.x, tt.y, tt.expected, tt.ok, result, ok)
+		}
+	}
+}
+
+func TestExponentiate(t *testing.T) {
+	tests := []struct {
+		x, y     int64
+		expected float64
+	}{
+		{2, -1, 0.5},
+		{2, -3, 0.125},
+		{-2, -3, -0.125},
+		{10, -2, 0.01},
+		{3, -40, 1 / 12157665459056928801.0},
+		{0, -1, math.Inf(1)},
+		{2, -5000, 0},
+	}
+
+	for _, tt := range tests {
+		if result := Exponentiate(tt.x, tt.y); result != tt.expected {
+			t.Errorf("Exponentiate(%d, %d): expected=%g, got=%g", tt.x, tt.y, tt.expected, result)
+		}
+	}
+}
+
+func TestPowMod(t *testing.T) {
+	tests := []struct {
+		x, y, m  int64
+		expected int64
+	}{
+		{2, 10, 1000, 24},
+		{3, 0, 7, 1},
+		{3, 0, 1, 0},
+		{-2, 3, 5, 2},
+		{4, 13, 497, 445},
+		{math.MaxInt64, 2, math.MaxInt64 - 1, 1},
+		{123456789, 987654321, 1000000007, 652541198},
+	}
+
+	for _, tt := range tests {
+		if result := PowMod(tt.x, tt.y, tt.m); result != tt.expected {
+			t.Errorf("PowMod(%d, %d, %d): expected=%d, got=%d", tt.x, tt.y, tt.m, tt.expected, result)
+		}
+	}
+}
@@ -2,37 +2,51 @@ package parser
 
 import (
 	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/lexer"
 	"MyInterpreter/token"
+	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
+	"strings"
 )
 
 const (
 	_ int = iota
 	LOWEST
+	OR  // ||
+	AND // &&
 	EQUALS
 	LESSGREATER
 	SUM
 	PRODUCT
-	EXPONENT = 6
-	PREFIX   = 7
-	CALL     = 8
+	EXPONENT = 8
+	PREFIX   = 9
+	CALL     = 10
 	INDEX
 )
 
-var VariablePropagationCache = map[string]int64{}
-
 var precedences = map[token.TokenType]int{
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
+	token.OR:       OR,
+	token.AND:      AND,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LTE:      LESSGREATER,
+	token.GTE:      LESSGREATER,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
+	token.BIT_OR:   SUM,
+	token.BIT_XOR:  SUM,
 	token.EXPONENT: EXPONENT,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.MODULO:   PRODUCT,
+	token.BIT_AND:  PRODUCT,
+	token.SHL:      PRODUCT,
+	token.SHR:      PRODUCT,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 }
@@ -55,6 +69,12 @@ type Parser struct {
 	curToken  token.Token //Token is a struct with Type and Literal
 	peekToken token.Token //See Next token
 	errors    []string
+	diags     []diagnostics.Diagnostic // Same errors as above, but structured for the diagnostics renderer
+	panicking bool                     // Set by the first error of a statement, see synchronize
+	lexed     int                      // How many of the lexer's diagnostics are already in diags
+
+	loops []string        // Labels of the loops around what's being parsed, innermost last, "" for a loop without one
+	label *ast.Identifier // Label read right before a loop, the loop takes it
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
@@ -66,17 +86,21 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.BIT_NOT, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.STRING_HEAD, p.parseInterpolatedString)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.WHILE, p.parseWhileLoop)
+	p.registerPrefix(token.FOR, p.parseForLoop)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -88,6 +112,16 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LTE, p.parseInfixExpression)
+	p.registerInfix(token.GTE, p.parseInfixExpression)
+	p.registerInfix(token.MODULO, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfix(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 
@@ -104,24 +138,59 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+func (p *Parser) Diagnostics() []diagnostics.Diagnostic {
+	return p.diags
+}
+
 func (p *Parser) PeekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.errorAt(diagnostics.UnexpectedToken, p.peekToken.Span, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
+}
+
+// errorAt records a parser error, prefixed with where it happened so long scripts can be debugged
+// Only the first error of a statement is kept, whatever goes wrong after it is most likely the same mistake
+func (p *Parser) errorAt(code string, span token.Span, format string, a ...interface{}) {
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+
+	diag := diagnostics.Diagnostic{
+		Severity: diagnostics.Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Span:     span,
+	}
+	p.diags = append(p.diags, diag)
+	p.errors = append(p.errors, diag.Error())
 }
 
 func (p *Parser) ShiftToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
 	//similar to readChar or NextToken, but for tokens instead of chars
+	p.takeLexerErrors()
 }
 
+// takeLexerErrors copies what the lexer found while reading the last token (an unterminated string, a bad escape...)
+// They skip errorAt on purpose, the token is still good enough to parse so they shouldn't hide the parser's own errors
+func (p *Parser) takeLexerErrors() {
+	for _, diag := range p.l.Diagnostics()[p.lexed:] {
+		p.diags = append(p.diags, diag)
+		p.errors = append(p.errors, diag.Error())
+	}
+	p.lexed = len(p.l.Diagnostics())
+}
+
+// ParseProgram always returns a Program, even when there are errors
+// Statements that could not be parsed show up as ast.BadStatement, so tools still get the rest of the code
 func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{} //initiate AST
 	program.Statements = []ast.Statement{}
 
 	for p.curToken.Type != token.EOF { //While token is not End of Life, parse it
-		stmt := p.parseStatement() //Verify which type of statement it is LET, RETURN, FUNC
+		stmt, _ := p.parseStatementOrRecover() //Verify which type of statement it is LET, RETURN, FUNC
 		if stmt != nil {
+			p.checkJumps(stmt)
 			program.Statements = append(program.Statements, stmt)
 		}
 
@@ -137,22 +206,88 @@ func (p *Parser) parseStatement() ast.Statement {
 	// Expressions are simply parsed token by token until we find the semicolon
 
 	if p.curToken.Type == token.IDENT {
-		if p.PeekTokenIs(token.PE, token.LE, token.ME, token.DE) {
+		if p.PeekTokenIs(token.PE, token.LE, token.ME, token.DE, token.ANDE, token.ORE, token.XORE, token.SHLE, token.SHRE) {
 			return p.parseCompoundAssignStatement()
 		}
+		if p.PeekTokenIs(token.COLON) {
+			return p.parseLabeledLoop()
+		}
 	}
 
+	//nil pointers are returned as plain nil, otherwise they sneak into the AST as non nil Statements
 	switch p.curToken.Type {
 	case token.LET:
-		return p.ParseLetStatement()
+		if stmt := p.ParseLetStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
 	case token.RETURN:
 		return p.ParseReturnStatement()
+	case token.BREAK, token.CONTINUE:
+		return p.parseBranchStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 
 }
 
+// parseStatementOrRecover is parseStatement plus panic mode recovery
+// When the statement had an error we skip to where the next statement most likely starts and carry on from there
+// atClosingBrace means the error happened on a '}' that the broken statement never opened, it belongs to the enclosing block
+func (p *Parser) parseStatementOrRecover() (stmt ast.Statement, atClosingBrace bool) {
+	from := p.curToken
+	stmt = p.parseStatement()
+
+	if !p.panicking {
+		return stmt, false
+	}
+
+	atClosingBrace = p.synchronize()
+	p.panicking = false
+
+	if stmt == nil {
+		return &ast.BadStatement{From: from, To: p.curToken}, atClosingBrace
+	}
+	return stmt, atClosingBrace
+}
+
+// synchronize leaves curToken on the last token of the broken statement, so the caller's ShiftToken lands on the next one
+// A statement ends on a ';', right before a keyword that starts a statement, or right before the '}' closing the block we're in
+// Brackets opened inside the broken statement are skipped as a whole
+func (p *Parser) synchronize() (atClosingBrace bool) {
+	depth := 0
+
+	for !p.curTokenIs(token.EOF) {
+		switch p.curToken.Type {
+		case token.LBRACE, token.LPAREN, token.LBRACKET:
+			depth++
+		case token.RBRACE:
+			if depth == 0 {
+				return true
+			}
+			depth--
+		case token.RPAREN, token.RBRACKET:
+			if depth > 0 {
+				depth--
+			}
+		case token.SEMICOLON:
+			if depth == 0 {
+				return false
+			}
+		}
+
+		if p.PeekTokenIs(token.EOF) {
+			return false
+		}
+		if depth == 0 && p.PeekTokenIs(token.LET, token.RETURN, token.WHILE, token.FOR, token.BREAK, token.CONTINUE, token.RBRACE) {
+			return false
+		}
+
+		p.ShiftToken()
+	}
+	return false
+}
+
 func (p *Parser) ParseLetStatement() *ast.LetStatement {
 	//We are parsing a Let statement
 	//Let statements have this structure
@@ -174,11 +309,9 @@ func (p *Parser) ParseLetStatement() *ast.LetStatement {
 	p.ShiftToken()
 
 	stmt.Value = p.parseExpression(LOWEST) //Result of the Parsed Expression Ex: (5 + 5 * 10) -> 55
-	if val, err := stmt.Value.(*ast.IntegerLiteral); err {
-		VariablePropagationCache[stmt.Name.Value] = val.Value
-	}
-	for !p.curTokenIs(token.SEMICOLON) {
-		p.ShiftToken() //shift forward until semicolon
+
+	if p.PeekTokenIs(token.SEMICOLON) {
+		p.ShiftToken()
 	}
 
 	return stmt
@@ -202,12 +335,50 @@ func (p *Parser) ParseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
-func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
+func (p *Parser) parseExpressionStatement() ast.Statement {
 	//defer untrace(trace("parseExpressionStatement"))
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
 	stmt.Expression = p.parseExpression(LOWEST)
 
+	//Only now we know the expression was the target of an assignment
+	if p.PeekTokenIs(token.ASSIGN) && stmt.Expression != nil {
+		return p.parseAssignment(stmt.Expression)
+	}
+
+	if p.PeekTokenIs(token.SEMICOLON) {
+		p.ShiftToken()
+	}
+
+	return stmt
+}
+
+// parseAssignment parses "= value" after target, a variable or an index expression
+func (p *Parser) parseAssignment(target ast.Expression) ast.Statement {
+	p.ShiftToken()
+	tok := p.curToken
+
+	var stmt ast.Statement
+	switch target := target.(type) {
+	case *ast.Identifier:
+		assign := &ast.Assignment{Token: target.Token, Variable: target}
+		p.ShiftToken()
+		assign.Value = p.parseExpression(LOWEST)
+		stmt = assign
+	case *ast.IndexExpression:
+		assign := &ast.IndexAssignment{Token: tok, Target: target}
+		p.ShiftToken()
+		assign.Value = p.parseExpression(LOWEST)
+		stmt = assign
+	default:
+		span := ast.SpanOf(target)
+		if !span.IsValid() {
+			span = tok.Span //Folded constants don't know where they came from
+		}
+		p.errorAt(diagnostics.BadAssignment, span, "cannot assign to %s", target.String())
+		return nil
+	}
+
 	if p.PeekTokenIs(token.SEMICOLON) {
 		p.ShiftToken()
 	}
@@ -232,10 +403,15 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 
 	if prefix == nil {
 		p.noPrefixParseFnError(p.curToken.Type)
-		return nil
+		return &ast.BadExpression{Token: p.curToken}
 	}
 
+	start := p.curToken
 	leftExp := prefix()
+	if leftExp == nil {
+		//The prefix function already reported what went wrong, leave a placeholder so the AST has no holes
+		leftExp = &ast.BadExpression{Token: start}
+	}
 
 	for !p.PeekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
@@ -304,36 +480,6 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	p.ShiftToken()
 	expression.Right = p.parseExpression(precedence)
 
-	switch left.(type) {
-	case *ast.Identifier:
-		leftvar, _ := left.(*ast.Identifier)
-		leftnum := VariablePropagationCache[leftvar.Value]
-
-		if rightnum, ok := expression.Right.(*ast.IntegerLiteral); ok && leftnum != 0 {
-			return p.ConstantFolding(leftnum, expression.Operator, rightnum.Value)
-
-		} else {
-			rightvar, ok := left.(*ast.Identifier)
-			rightnum := VariablePropagationCache[rightvar.Value]
-			if ok {
-				return p.ConstantFolding(leftnum, expression.Operator, rightnum)
-			}
-		}
-
-	case *ast.IntegerLiteral:
-		if rightInteger, ok := expression.Right.(*ast.IntegerLiteral); ok {
-			return p.ConstantFolding(left.(*ast.IntegerLiteral).Value, expression.Operator, rightInteger.Value)
-		} else {
-			rightvar, ok := expression.Right.(*ast.Identifier)
-			rightnum := VariablePropagationCache[rightvar.Value]
-			if ok {
-
-				return p.ConstantFolding(left.(*ast.IntegerLiteral).Value, expression.Operator, rightnum)
-
-			}
-		}
-	}
-
 	return expression
 }
 
@@ -359,6 +505,18 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	if p.PeekTokenIs(token.ELSE) {
 		p.ShiftToken()
 
+		//else if starts the next link of the chain, it takes care of its own else
+		if p.PeekTokenIs(token.IF) {
+			p.ShiftToken()
+
+			elseIf, ok := p.parseIfExpression().(*ast.IfExpression)
+			if !ok {
+				return nil
+			}
+			expression.ElseIf = elseIf
+			return expression
+		}
+
 		if !p.expectPeek(token.LBRACE) {
 			return nil
 		}
@@ -376,12 +534,21 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	p.ShiftToken()
 
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
-		stmt := p.parseStatement()
+		stmt, atClosingBrace := p.parseStatementOrRecover()
 		if stmt != nil {
 			Block.Statements = append(Block.Statements, stmt)
 		}
+		if atClosingBrace {
+			break //That '}' is ours
+		}
 		p.ShiftToken()
 	}
+
+	if p.curTokenIs(token.RBRACE) {
+		Block.Closing = p.curToken
+	} else {
+		p.errorAt(diagnostics.UnexpectedToken, p.curToken.Span, "expected } to close the block opened at %s, got %s instead", Block.Token.Span.Start, p.curToken.Type)
+	}
 	return Block
 }
 
@@ -390,9 +557,17 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if lit.Big, _ = new(big.Int).SetString(p.curToken.Literal, 0); lit.Big != nil {
+			return lit
+		}
+	}
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		if message := numberError(p.curToken.Literal, false); message != "" {
+			p.errorAt(diagnostics.InvalidNumber, p.curToken.Span, "%s", message)
+		} else {
+			p.errorAt(diagnostics.InvalidNumber, p.curToken.Span, "could not parse %q as integer", p.curToken.Literal)
+		}
 		return nil
 	}
 
@@ -401,6 +576,77 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		if message := numberError(p.curToken.Literal, true); message != "" {
+			p.errorAt(diagnostics.InvalidNumber, p.curToken.Span, "%s", message)
+		} else {
+			p.errorAt(diagnostics.InvalidNumber, p.curToken.Span, "could not parse %q as float", p.curToken.Literal)
+		}
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+// numberError says what's wrong with a literal strconv refused, strconv itself only says "invalid syntax"
+// "" means nothing specific was found
+func numberError(literal string, float bool) string {
+	base, digits, name := 10, literal, "decimal"
+	if len(literal) >= 2 && literal[0] == '0' {
+		switch literal[1] {
+		case 'x', 'X':
+			base, digits, name = 16, literal[2:], "hexadecimal"
+		case 'o', 'O':
+			base, digits, name = 8, literal[2:], "octal"
+		case 'b', 'B':
+			base, digits, name = 2, literal[2:], "binary"
+		default:
+			if !float {
+				base, digits, name = 8, literal[1:], "octal" //0755 is octal too, like in Go
+			}
+		}
+	}
+
+	if digits == "" {
+		return fmt.Sprintf("%s literal %s has no digits", name, literal)
+	}
+
+	isDigit := func(i int) bool { return i >= 0 && i < len(digits) && digitValue(digits[i]) < base }
+	for i := 0; i < len(digits); i++ {
+		ch := digits[i]
+		switch {
+		case ch == '_':
+			//0x_FF is fine, the _ separates the prefix from the first digit
+			if !(isDigit(i-1) || (i == 0 && digits != literal)) || !isDigit(i+1) {
+				return fmt.Sprintf("'_' must separate successive digits in %s", literal)
+			}
+		case float && strings.IndexByte(".eE+-", ch) >= 0:
+		case digitValue(ch) >= base:
+			return fmt.Sprintf("invalid digit %q in %s literal %s", ch, name, literal)
+		}
+	}
+	return ""
+}
+
+// digitValue is 16 or more for anything that isn't a digit in any base
+func digitValue(ch byte) int {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return int(ch - '0')
+	case 'a' <= ch && ch <= 'f':
+		return int(ch-'a') + 10
+	case 'A' <= ch && ch <= 'F':
+		return int(ch-'A') + 10
+	}
+	return 16
+}
+
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	lit := &ast.FunctionLiteral{Token: p.curToken}
 
@@ -414,11 +660,58 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	//A break in the body can't leave a loop the function is declared in
+	outer := p.loops
+	p.loops = nil
 	lit.Body = p.parseBlockStatement()
+	p.loops = outer
 
+	markTailCalls(lit.Body)
 	return lit
 }
 
+// markTailCalls flags the calls of a function body that give the function its value: the value of a return,
+// or of the body's last expression, through the branches of an if
+// The engines make those calls in place of the caller instead of on top of it, so recursion through them never gets deeper
+func markTailCalls(body *ast.BlockStatement) {
+	if body == nil {
+		return
+	}
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FunctionLiteral:
+			return false // its calls were marked when it was parsed
+		case *ast.ReturnStatement:
+			markTail(node.ReturnValue)
+		}
+		return true
+	})
+	markTailValue(body)
+}
+
+// markTailValue marks the calls giving a block its value, that's its last statement when it's an expression
+func markTailValue(block *ast.BlockStatement) {
+	if block == nil || len(block.Statements) == 0 {
+		return
+	}
+	if es, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement); ok {
+		markTail(es.Expression)
+	}
+}
+
+func markTail(e ast.Expression) {
+	switch e := e.(type) {
+	case *ast.CallExpression:
+		e.Tail = true
+	case *ast.IfExpression:
+		for ie := e; ie != nil; ie = ie.ElseIf {
+			markTailValue(ie.Consequence)
+			markTailValue(ie.Alternative)
+		}
+	}
+}
+
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	identifier := []*ast.Identifier{}
 
@@ -449,6 +742,9 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	if p.curTokenIs(token.RPAREN) {
+		exp.Closing = p.curToken
+	}
 	return exp
 }
 
@@ -486,6 +782,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	exp.Closing = p.curToken
 
 	return exp
 }
@@ -499,8 +796,7 @@ func (p *Parser) parseBoolean() ast.Expression {
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.errorAt(diagnostics.ExpectedExpr, p.curToken.Span, "no prefix parse function for %s found", t)
 }
 
 func (p *Parser) peekPrecedence() int {
@@ -564,10 +860,49 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseInterpolatedString() ast.Expression {
+	str := &ast.InterpolatedString{Token: p.curToken}
+	str.Parts = appendText(str.Parts, p.curToken)
+
+	for {
+		if p.PeekTokenIs(token.STRING_MID, token.STRING_TAIL) {
+			p.errorAt(diagnostics.ExpectedExpr, p.peekToken.Span, "expected an expression inside ${}")
+			return nil
+		}
+		p.ShiftToken()
+		str.Parts = append(str.Parts, p.parseExpression(LOWEST))
+
+		switch {
+		case p.PeekTokenIs(token.STRING_MID):
+			p.ShiftToken()
+			str.Parts = appendText(str.Parts, p.curToken)
+		case p.PeekTokenIs(token.STRING_TAIL):
+			p.ShiftToken()
+			str.Parts = appendText(str.Parts, p.curToken)
+			str.Closing = p.curToken
+			return str
+		default:
+			p.errorAt(diagnostics.UnexpectedToken, p.peekToken.Span, "expected } to close ${ in string, got %s instead", p.peekToken.Type)
+			return nil
+		}
+	}
+}
+
+// appendText adds the text of a piece of an interpolated string, unless there's none
+func appendText(parts []ast.Expression, tok token.Token) []ast.Expression {
+	if tok.Literal == "" {
+		return parts
+	}
+	return append(parts, &ast.StringLiteral{Token: tok, Value: tok.Literal})
+}
+
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 
 	array.Elements = p.parseExpressionList(token.RBRACKET)
+	if p.curTokenIs(token.RBRACKET) {
+		array.Closing = p.curToken
+	}
 
 	return array
 }
@@ -578,8 +913,7 @@ func (p *Parser) parseCompoundAssignStatement() ast.Statement {
 	if p.curToken.Type == token.IDENT {
 		pleql.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 	} else {
-		msg := fmt.Sprintf("expected identifier, got %s", p.curToken.Type)
-		p.errors = append(p.errors, msg)
+		p.errorAt(diagnostics.ExpectedIdent, p.curToken.Span, "expected identifier, got %s", p.curToken.Type)
 	}
 
 	p.ShiftToken()
@@ -590,7 +924,7 @@ func (p *Parser) parseCompoundAssignStatement() ast.Statement {
 
 	pleql.Value = p.parseExpression(LOWEST)
 
-	for !p.curTokenIs(token.SEMICOLON) {
+	if p.PeekTokenIs(token.SEMICOLON) {
 		p.ShiftToken()
 	}
 
@@ -621,12 +955,17 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.Closing = p.curToken
 
 	return hash
 }
 
 func (p *Parser) parseWhileLoop() ast.Expression {
-	WLoop := &ast.WhileLoop{Token: p.curToken}
+	WLoop := &ast.WhileLoop{Token: p.curToken, Label: p.label}
+	p.label = nil
+
+	p.enterLoop(WLoop.Label)
+	defer p.leaveLoop()
 
 	if !p.expectPeek(token.LPAREN) {
 		return nil
@@ -652,61 +991,321 @@ func (p *Parser) parseWhileLoop() ast.Expression {
 	return WLoop
 }
 
-func (p *Parser) ConstantFolding(leftnum int64, Operator string, rightnum int64) ast.Expression {
-	//Constant Folding is a function added to optimize the interpreter
-	//even for simple operations, the input goes through lexing, parsing and evaluation
-	//By implementing ConstantFolding, we can skip the entire parsing and evaluation phase and return the integer object straight up
-	//In average, Constant Folding saves about 10ms in the entire process
+// parseForLoop parses both kinds of for, "for (init; condition; post) {...}" and "for (key, value in iterable) {...}"
+// the header is a for-in when it starts with a name followed by "in" or ","
+func (p *Parser) parseForLoop() ast.Expression {
+	tok, label := p.curToken, p.label
+	p.label = nil
+
+	p.enterLoop(label)
+	defer p.leaveLoop()
 
-	//Additionally, I'm experimenting with strength reduction alternatives for common arithmetic operations
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.ShiftToken()
 
-	switch Operator {
-	case "+":
-		result := leftnum + rightnum
-		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: strconv.FormatInt(result, 10)}, Value: result}
-	case "-":
-		result := leftnum - rightnum
-		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: strconv.FormatInt(result, 10)}, Value: result}
+	if p.curTokenIs(token.IDENT) && p.PeekTokenIs(token.IN, token.COMMA) {
+		return p.parseForInLoop(tok, label)
+	}
 
-	case "*":
-		result := leftnum * rightnum
-		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: strconv.FormatInt(result, 10)}, Value: result}
+	loop := &ast.ForLoop{Token: tok, Label: label}
 
-	case "/":
-		if rightnum == 0 {
+	if !p.curTokenIs(token.SEMICOLON) {
+		if loop.Init = p.parseStatement(); loop.Init == nil {
+			return nil
+		}
+		//let and expression statements already ate their ';'
+		if !p.curTokenIs(token.SEMICOLON) && !p.expectPeek(token.SEMICOLON) {
 			return nil
 		}
-		result := leftnum / rightnum
-		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: strconv.FormatInt(result, 10)}, Value: result}
+	}
+	p.ShiftToken()
 
-	case ">":
-		result := leftnum > rightnum
-		if result {
-			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "True"}, Value: result}
-		} else {
-			return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "False"}, Value: result}
+	if !p.curTokenIs(token.SEMICOLON) {
+		loop.Condition = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.SEMICOLON) {
+			return nil
 		}
-	case "<":
-		result := leftnum < rightnum
-		if result {
-			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "True"}, Value: result}
-		} else {
-			return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "False"}, Value: result}
+	}
+	p.ShiftToken()
+
+	if !p.curTokenIs(token.RPAREN) {
+		if loop.Post = p.parseStatement(); loop.Post == nil {
+			return nil
 		}
-	case "==":
-		result := leftnum == rightnum
-		if result {
-			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "True"}, Value: result}
-		} else {
-			return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "False"}, Value: result}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
 		}
-	case "!=":
-		result := leftnum != rightnum
-		if result {
-			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "True"}, Value: result}
-		} else {
-			return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "False"}, Value: result}
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	loop.Body = p.parseBlockStatement()
+
+	if !p.curTokenIs(token.RBRACE) {
+		return nil
+	}
+
+	return loop
+}
+
+func (p *Parser) parseForInLoop(tok token.Token, label *ast.Identifier) ast.Expression {
+	loop := &ast.ForInLoop{Token: tok, Label: label}
+	loop.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if p.PeekTokenIs(token.COMMA) {
+		p.ShiftToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		loop.Key = loop.Value
+		loop.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.ShiftToken()
+
+	loop.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	loop.Body = p.parseBlockStatement()
+
+	if !p.curTokenIs(token.RBRACE) {
+		return nil
+	}
+
+	return loop
+}
+
+// parseLabeledLoop reads "name:" and hands the name to the loop that has to come right after it
+func (p *Parser) parseLabeledLoop() ast.Statement {
+	label := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	p.ShiftToken()
+
+	if !p.PeekTokenIs(token.WHILE, token.FOR) {
+		p.errorAt(diagnostics.BadLabel, p.peekToken.Span, "label %s must be followed by a loop, got %s instead", label.Value, p.peekToken.Type)
+		return nil
+	}
+	for _, outer := range p.loops {
+		if outer == label.Value {
+			p.errorAt(diagnostics.BadLabel, label.Token.Span, "label %s is already used by an enclosing loop", label.Value)
+			return nil
 		}
 	}
+
+	p.ShiftToken()
+	p.label = label
+	if stmt := p.parseExpressionStatement(); stmt != nil {
+		return stmt
+	}
 	return nil
 }
+
+// parseBranchStatement parses break and continue, they're only allowed inside a loop of the same function
+func (p *Parser) parseBranchStatement() ast.Statement {
+	tok := p.curToken
+
+	//The label has to be on the same line, otherwise "break" followed by an expression statement would eat its first word
+	var label *ast.Identifier
+	if p.PeekTokenIs(token.IDENT) && p.peekToken.Span.Start.Line == tok.Span.Start.Line {
+		p.ShiftToken()
+		label = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+
+	if len(p.loops) == 0 {
+		p.errorAt(diagnostics.OutsideLoop, tok.Span, "%s outside of a loop", tok.Literal)
+		return nil
+	}
+	if label != nil && !p.inLoop(label.Value) {
+		p.errorAt(diagnostics.BadLabel, label.Token.Span, "%s to unknown label %s, no enclosing loop has that name", tok.Literal, label.Value)
+		return nil
+	}
+
+	if p.PeekTokenIs(token.SEMICOLON) {
+		p.ShiftToken()
+	}
+
+	if tok.Type == token.BREAK {
+		return &ast.BreakStatement{Token: tok, Label: label}
+	}
+	return &ast.ContinueStatement{Token: tok, Label: label}
+}
+
+// checkJumps reports the breaks and continues in stmt that would leave an expression half evaluated,
+// like the one in 1 + if (c) { break } else { 0 }: the engines would have nothing to add 1 to
+// A jump can only be a statement of its loop, or of ifs and loops that are statements themselves
+func (p *Parser) checkJumps(stmt ast.Statement) {
+	c := &jumpChecker{p: p}
+	c.statement(stmt)
+
+	// The statement is whole, there's nothing to skip, without this the next statement's first error is lost
+	p.panicking = false
+}
+
+type jumpChecker struct {
+	p      *Parser
+	frames []jumpFrame // What's around the node being checked, innermost last
+}
+
+// jumpFrame is a loop, or an expression (loop false) that no jump can get out of
+type jumpFrame struct {
+	loop  bool
+	label string
+}
+
+func (c *jumpChecker) statement(stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.ExpressionStatement:
+		c.statementExpression(stmt.Expression)
+	case *ast.BreakStatement:
+		c.jump(stmt.Token, stmt.Label)
+	case *ast.ContinueStatement:
+		c.jump(stmt.Token, stmt.Label)
+	case *ast.LetStatement:
+		c.value(stmt.Value)
+	case *ast.ReturnStatement:
+		c.value(stmt.ReturnValue)
+	case *ast.Assignment:
+		c.value(stmt.Value)
+	case *ast.CompoundAssignment:
+		c.value(stmt.Value)
+	case *ast.IndexAssignment:
+		c.value(stmt.Target)
+		c.value(stmt.Value)
+	}
+}
+
+func (c *jumpChecker) block(b *ast.BlockStatement) {
+	if b == nil {
+		return
+	}
+	for _, stmt := range b.Statements {
+		c.statement(stmt)
+	}
+}
+
+// statementExpression checks the expression of an expression statement, its value is thrown away
+// so an if or a loop there can be left from inside its blocks
+func (c *jumpChecker) statementExpression(e ast.Expression) {
+	switch e := e.(type) {
+	case *ast.IfExpression:
+		for ie := e; ie != nil; ie = ie.ElseIf {
+			c.value(ie.Condition)
+			c.block(ie.Consequence)
+			c.block(ie.Alternative)
+		}
+	default:
+		if !c.loop(e) {
+			c.value(e)
+		}
+	}
+}
+
+// loop checks e when it's a loop and tells if it was one, its body is the only part a jump can be a statement of
+func (c *jumpChecker) loop(e ast.Expression) bool {
+	var label *ast.Identifier
+	var body *ast.BlockStatement
+
+	switch e := e.(type) {
+	case *ast.WhileLoop:
+		c.value(e.Condition)
+		label, body = e.Label, e.Consequence
+	case *ast.ForLoop:
+		if e.Init != nil {
+			c.statement(e.Init)
+		}
+		c.value(e.Condition)
+		if e.Post != nil {
+			c.statement(e.Post)
+		}
+		label, body = e.Label, e.Body
+	case *ast.ForInLoop:
+		c.value(e.Iterable)
+		label, body = e.Label, e.Body
+	default:
+		return false
+	}
+
+	frame := jumpFrame{loop: true}
+	if label != nil {
+		frame.label = label.Value
+	}
+	c.frames = append(c.frames, frame)
+	c.block(body)
+	c.frames = c.frames[:len(c.frames)-1]
+	return true
+}
+
+// value checks an expression whose value is used, a jump inside it can't get out of it
+func (c *jumpChecker) value(e ast.Expression) {
+	if e == nil {
+		return
+	}
+
+	c.frames = append(c.frames, jumpFrame{})
+	ast.Inspect(e, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.BreakStatement:
+			c.jump(node.Token, node.Label)
+		case *ast.ContinueStatement:
+			c.jump(node.Token, node.Label)
+		case *ast.FunctionLiteral:
+			// Its loops are its own, nothing around it matters
+			outer := c.frames
+			c.frames = nil
+			c.block(node.Body)
+			c.frames = outer
+			return false
+		case ast.Expression:
+			return !c.loop(node)
+		}
+		return true
+	})
+	c.frames = c.frames[:len(c.frames)-1]
+}
+
+func (c *jumpChecker) jump(tok token.Token, label *ast.Identifier) {
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		frame := c.frames[i]
+		if !frame.loop {
+			c.p.errorAt(diagnostics.OutsideLoop, tok.Span, "%s can't jump out of the middle of an expression", tok.Literal)
+			return
+		}
+		if label == nil || frame.label == label.Value {
+			return
+		}
+	}
+}
+
+func (p *Parser) enterLoop(label *ast.Identifier) {
+	name := ""
+	if label != nil {
+		name = label.Value
+	}
+	p.loops = append(p.loops, name)
+}
+
+func (p *Parser) leaveLoop() {
+	p.loops = p.loops[:len(p.loops)-1]
+}
+
+func (p *Parser) inLoop(label string) bool {
+	for _, name := range p.loops {
+		if name == label {
+			return true
+		}
+	}
+	return false
+}
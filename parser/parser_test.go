@@ -2,6 +2,7 @@ package parser
 
 import (
 	"MyInterpreter/ast"
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/lexer"
 	"encoding/csv"
 	"fmt"
@@ -172,6 +173,136 @@ func TestIntegerLiteralExpression(t *testing.T) {
 
 }
 
+func TestBigIntegerLiteral(t *testing.T) {
+	p := NewParser(lexer.NewLexer("123456789012345678901234567890;"))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Big == nil || literal.Big.String() != "123456789012345678901234567890" {
+		t.Errorf("literal.Big wrong. got=%v", literal.Big)
+	}
+
+	//Folding would wrap around, so it's left to the evaluator
+	p = NewParser(lexer.NewLexer("9223372036854775807 + 1;"))
+	program = p.ParseProgram()
+	checkParseErrors(t, p)
+
+	if got := program.String(); got != "(9223372036854775807 + 1)" {
+		t.Errorf("overflowing expression was folded. got=%s", got)
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"1e3;", 1000},
+		{"2.5e-1;", 0.25},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g, got %g", tt.expected, literal.Value)
+		}
+	}
+
+	p := NewParser(lexer.NewLexer("1e999;"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], `could not parse "1e999" as float`) {
+		t.Errorf("out of range float should be a parser error, got=%v", p.Errors())
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0xFF", 255},
+		{"0Xff", 255},
+		{"0o755", 493},
+		{"0b1010", 10},
+		{"1_000_000", 1000000},
+		{"0x_dead_beef", 0xdeadbeef},
+		{"0b_1111_0000", 240},
+		{"0755", 493},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("%s: exp not *ast.IntegerLiteral. got=%T", tt.input, stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("%s: literal.Value not %d, got %d", tt.input, tt.expected, literal.Value)
+		}
+		// The literal is printed the way it was written
+		if literal.String() != tt.input {
+			t.Errorf("literal.String() not %q, got %q", tt.input, literal.String())
+		}
+	}
+
+	p := NewParser(lexer.NewLexer("0x1_0000_0000_0000_0000"))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+	if literal := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IntegerLiteral); literal.Big == nil || literal.Big.String() != "18446744073709551616" {
+		t.Errorf("0x1_0000_0000_0000_0000 should be a big literal, got %v", literal.Big)
+	}
+}
+
+func TestMalformedNumberLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0x", "1:1: hexadecimal literal 0x has no digits"},
+		{"0b", "1:1: binary literal 0b has no digits"},
+		{"0xFG", "1:1: invalid digit 'G' in hexadecimal literal 0xFG"},
+		{"0b102", "1:1: invalid digit '2' in binary literal 0b102"},
+		{"0o78", "1:1: invalid digit '8' in octal literal 0o78"},
+		{"089", "1:1: invalid digit '8' in octal literal 089"},
+		{"1__000", "1:1: '_' must separate successive digits in 1__000"},
+		{"let x = 1_000_", "1:9: '_' must separate successive digits in 1_000_"},
+		{"0x__1", "1:1: '_' must separate successive digits in 0x__1"},
+		{"1_.5", "1:1: '_' must separate successive digits in 1_.5"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		p.ParseProgram()
+
+		if len(p.Diagnostics()) == 0 {
+			t.Errorf("expected errors for %q, got none", tt.input)
+			continue
+		}
+		if p.Errors()[0] != tt.expected || p.Diagnostics()[0].Code != diagnostics.InvalidNumber {
+			t.Errorf("wrong error for %q. expected=%q, got=%s %q", tt.input, tt.expected, p.Diagnostics()[0].Code, p.Errors()[0])
+		}
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input        string
@@ -517,6 +648,66 @@ func testBooleanLiteral(t *testing.T, exp ast.Expression, value bool) bool {
 
 }
 
+func TestLogicalOperatorPrecedence(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a || b && c", "(a || (b && c))"},
+		{"a && b || c && d", "((a && b) || (c && d))"},
+		{"x >= 0 && x < n", "((x >= 0) && (x < n))"},
+		{"a == b || c != d", "((a == b) || (c != d))"},
+		{"a <= b == c >= d", "((a <= b) == (c >= d))"},
+		{"a + b % c * d", "(a + ((b % c) * d))"},
+		{"!a && -b", "((!a) && (-b))"},
+		// Folding is the optimizer's job, the parser keeps what was written
+		{"7 % 3", "(7 % 3)"},
+		{"-7 % 3", "((-7) % 3)"},
+		{"2 <= 3", "(2 <= 3)"},
+		{"0 && 0", "(0 && 0)"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestBitwiseOperatorPrecedence(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a | b & c", "(a | (b & c))"},
+		{"a ^ b | c", "((a ^ b) | c)"},
+		{"a + b << c", "(a + (b << c))"},
+		{"a & b == c", "((a & b) == c)"},
+		{"a >> b * c", "((a >> b) * c)"},
+		{"~a & b", "((~a) & b)"},
+		{"a < b << c", "(a < (b << c))"},
+		{"x <<= 2", "x <<= 2"},
+		{"x &= y | 1", "x &= (y | 1)"},
+		{"x ^= ~y", "x ^= (~y)"},
+		{"12 & 10 | 3", "((12 & 10) | 3)"},
+		{"1 << 3", "(1 << 3)"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	input := `if (x < y) { x }`
 
@@ -561,9 +752,201 @@ func TestIfExpression(t *testing.T) {
 	}
 }
 
+func TestAssignmentParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5;", "x = 5"},
+		{"x = y * 2", "x = (y * 2)"},
+		{"a[1] = b + 1", "(a[1]) = (b + 1)"},
+		{`h["k"][0] = [x]`, `((h[k])[0]) = [x]`},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		switch program.Statements[0].(type) {
+		case *ast.Assignment, *ast.IndexAssignment:
+		default:
+			t.Fatalf("%q: statement is not an assignment. got=%T", tt.input, program.Statements[0])
+		}
+		if program.Statements[0].String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.Statements[0].String())
+		}
+	}
+
+	p := NewParser(lexer.NewLexer("f(x) = 2"))
+	p.ParseProgram()
+	if len(p.Diagnostics()) == 0 || p.Diagnostics()[0].Code != diagnostics.BadAssignment || p.Errors()[0] != "1:1: cannot assign to f(x)" {
+		t.Errorf("wrong errors for an assignment to a call. got %q", p.Errors())
+	}
+}
+
+func TestElseIfParsing(t *testing.T) {
+	input := `if (a) { 1 } else if (b) { 2 } else if (c) { 3 } else { 4 }`
+
+	p := NewParser(lexer.NewLexer(input))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got %d", len(program.Statements))
+	}
+	exp, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.IfExpression. got=%T", program.Statements[0].(*ast.ExpressionStatement).Expression)
+	}
+
+	//Every link but the last has an ElseIf and no Alternative
+	conditions := []string{}
+	last := exp
+	for ie := exp; ie != nil; ie = ie.ElseIf {
+		conditions = append(conditions, ie.Condition.String())
+		if ie.ElseIf != nil && ie.Alternative != nil {
+			t.Errorf("link %q has both ElseIf and Alternative", ie.Condition.String())
+		}
+		last = ie
+	}
+	if strings.Join(conditions, " ") != "a b c" {
+		t.Errorf("wrong chain. expected=%q, got=%q", "a b c", strings.Join(conditions, " "))
+	}
+	if last.Alternative == nil || last.Alternative.String() != "4" {
+		t.Errorf("last link should have the else block 4, got %v", last.Alternative)
+	}
+
+	expected := "if a 1 else if b 2 else if c 3 else 4 "
+	if exp.String() != expected {
+		t.Errorf("exp.String() wrong. expected=%q, got=%q", expected, exp.String())
+	}
+	if exp.End() != last.Alternative.End() {
+		t.Errorf("exp.End() wrong. expected=%s, got=%s", last.Alternative.End(), exp.End())
+	}
+}
+
 func TestWhileParsing(t *testing.T) {
-	//TODO Create While Statements Tests
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"while (x < 10) { x += 1 }", "while((x < 10)){x += 1}"},
+		{"while (True) { break; }", "while(True){break;}"},
+		{"while (True) { continue }", "while(True){continue;}"},
+		{"outer: while (a) { while (b) { break outer; continue outer } }", "outer: while(a){while(b){break outer;continue outer;}}"},
+		//A label on the next line is an expression statement of its own
+		{"while (a) { break\nx }", "while(a){break;x}"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		loop, ok := stmt.Expression.(*ast.WhileLoop)
+		if !ok {
+			t.Fatalf("%q: exp not *ast.WhileLoop. got=%T", tt.input, stmt.Expression)
+		}
+		if loop.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, loop.String())
+		}
+	}
+}
+
+func TestForParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"for (let i = 0; i < 10; i += 1) { x += i }", "for(leti = 0; (i < 10); i += 1){x += i}"},
+		{"for (f(); ; g()) { }", "for(f(); ; g()){}"},
+		{"for (;;) { break }", "for(; ; ){break;}"},
+		{"for (x in xs) { f(x) }", "for(x in xs){f(x)}"},
+		{"for (k, v in {1: 2}) { }", "for(k, v in {1:2}){}"},
+		{"outer: for (x in range(3)) { for (; x < 2;) { continue outer } }", "outer: for(x in range(3)){for(; (x < 2); ){continue outer;}}"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		program := p.ParseProgram()
+		checkParseErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("%q: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		switch stmt.Expression.(type) {
+		case *ast.ForLoop, *ast.ForInLoop:
+		default:
+			t.Fatalf("%q: exp not a for loop. got=%T", tt.input, stmt.Expression)
+		}
+		if stmt.Expression.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, stmt.Expression.String())
+		}
+	}
+}
+
+func TestLoopControlErrors(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedCode string
+		expected     string
+	}{
+		{"break;", diagnostics.OutsideLoop, "1:1: break outside of a loop"},
+		{"if (x) { continue }", diagnostics.OutsideLoop, "1:10: continue outside of a loop"},
+		{"while (x) { let f = fn() { break }; }", diagnostics.OutsideLoop, "1:28: break outside of a loop"},
+		{"while (x) { break inner }", diagnostics.BadLabel, "1:19: break to unknown label inner, no enclosing loop has that name"},
+		{"a: while (x) { a: while (y) { } }", diagnostics.BadLabel, "1:16: label a is already used by an enclosing loop"},
+		{"a: 5", diagnostics.BadLabel, "1:4: label a must be followed by a loop, got INT instead"},
+		{"for (x in xs) { let f = fn() { continue } }", diagnostics.OutsideLoop, "1:32: continue outside of a loop"},
+		{"a: for (x in y) { a: for (;;) { } }", diagnostics.BadLabel, "1:19: label a is already used by an enclosing loop"},
+		{"for (i in xs) { let y = 1 + if (i == 2) { continue; } else { 0 } }", diagnostics.OutsideLoop, "1:43: continue can't jump out of the middle of an expression"},
+		{"for (i in xs) { let y = [i, if (i == 2) { break; } else { 0 }] }", diagnostics.OutsideLoop, "1:43: break can't jump out of the middle of an expression"},
+		{"while (x) { f(if (y) { break }) }", diagnostics.OutsideLoop, "1:24: break can't jump out of the middle of an expression"},
+		{"while (x) { if (y) { break } else { 1 } + 2 }", diagnostics.OutsideLoop, "1:22: break can't jump out of the middle of an expression"},
+		{"a: while (x) { let y = while (z) { break a } }", diagnostics.OutsideLoop, "1:36: break can't jump out of the middle of an expression"},
+		{"while (x) { return if (y) { continue } }", diagnostics.OutsideLoop, "1:29: continue can't jump out of the middle of an expression"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		p.ParseProgram()
+
+		if len(p.Diagnostics()) == 0 {
+			t.Errorf("expected errors for %q, got none", tt.input)
+			continue
+		}
+		if p.Errors()[0] != tt.expected || p.Diagnostics()[0].Code != tt.expectedCode {
+			t.Errorf("wrong error for %q. expected=%s %q, got=%s %q", tt.input, tt.expectedCode, tt.expected, p.Diagnostics()[0].Code, p.Errors()[0])
+		}
+	}
+}
+
+// Jumps that leave nothing half evaluated behind are fine
+func TestLoopControlInExpressions(t *testing.T) {
+	tests := []string{
+		"while (x) { if (y) { break } else if (z) { continue } else { if (w) { break } } }",
+		"while (x) { let y = while (z) { break }; let f = fn() { for (i in xs) { if (i) { continue } } } }",
+		"a: while (x) { while (y) { if (z) { break a } } }",
+		"for (let i = 0; i < 3; i += 1) { let y = 1 + while (True) { if (i) { break } }; for (j in xs) { continue } }",
+	}
 
+	for _, input := range tests {
+		p := NewParser(lexer.NewLexer(input))
+		p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Errorf("%q: unexpected errors %v", input, p.Errors())
+		}
+	}
 }
 
 func TestFunctionLiteralParsing(t *testing.T) {
@@ -692,6 +1075,54 @@ func TestStringLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestInterpolatedStringParsing(t *testing.T) {
+	p := NewParser(lexer.NewLexer(`"total: ${sum(xs)} items, ${a + b}"`))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	str, ok := stmt.Expression.(*ast.InterpolatedString)
+	if !ok {
+		t.Fatalf("exp not *ast.InterpolatedString. got=%T", stmt.Expression)
+	}
+
+	if len(str.Parts) != 4 {
+		t.Fatalf("wrong number of parts. expected=4, got=%d", len(str.Parts))
+	}
+	if text, ok := str.Parts[0].(*ast.StringLiteral); !ok || text.Value != "total: " {
+		t.Errorf("parts[0] is not the text \"total: \". got=%s", str.Parts[0])
+	}
+	if _, ok := str.Parts[1].(*ast.CallExpression); !ok {
+		t.Errorf("parts[1] is not *ast.CallExpression. got=%T", str.Parts[1])
+	}
+	testInfixExpression(t, str.Parts[3], "a", "+", "b")
+
+	if str.String() != "total: ${sum(xs)} items, ${(a + b)}" {
+		t.Errorf("str.String() wrong. got=%q", str.String())
+	}
+	if str.Pos().Column != 1 || str.End().Column != 36 {
+		t.Errorf("wrong span. got=%s to %s", str.Pos(), str.End())
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a ${} b"`, "1:6: expected an expression inside ${}"},
+		{`"a ${x y} b"`, "1:8: expected } to close ${ in string, got IDENT instead"},
+		{`"a ${x`, "1:7: expected } to close ${ in string, got EOF instead"},
+	}
+
+	for _, tt := range tests {
+		p := NewParser(lexer.NewLexer(tt.input))
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("wrong error for %q. expected=%q, got=%v", tt.input, tt.expected, p.Errors())
+		}
+	}
+}
+
 func TestParsingArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3+3]"
 
@@ -840,6 +1271,150 @@ func TestParsingHashLiteralWithExpressions(t *testing.T) {
 
 }
 
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x 5;", "1:7: expected next token to be =, got INT instead"},
+		{"let x = 1;\nlet = 2;", "2:5: expected next token to be IDENT, got = instead"},
+		{"add(1, 2;", "1:9: expected next token to be ), got ; instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected errors for %q, got none", tt.input)
+			continue
+		}
+		if p.Errors()[0] != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, p.Errors()[0])
+		}
+		if len(p.Diagnostics()) != len(p.Errors()) || p.Diagnostics()[0].Code != diagnostics.UnexpectedToken {
+			t.Errorf("diagnostics don't match errors. got=%+v", p.Diagnostics())
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	p := NewParser(lexer.NewLexer("let a = \"bad \\q\";\nlet b = 5 +;\nlet c = \"open"))
+	p.ParseProgram()
+
+	expected := []struct {
+		code    string
+		message string
+	}{
+		{diagnostics.InvalidEscape, `1:14: unknown escape sequence \q`},
+		{diagnostics.ExpectedExpr, "2:12: no prefix parse function for ; found"},
+		{diagnostics.UnterminatedString, "3:9: string literal not terminated"},
+	}
+
+	if len(p.Diagnostics()) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), p.Errors())
+	}
+	for i, tt := range expected {
+		if p.Diagnostics()[i].Code != tt.code || p.Errors()[i] != tt.message {
+			t.Errorf("error %d wrong. expected=%s %q, got=%s %q", i, tt.code, tt.message, p.Diagnostics()[i].Code, p.Errors()[i])
+		}
+	}
+}
+
+func TestCommentsAreKept(t *testing.T) {
+	input := `// square returns n * n
+/* it works on floats too */
+let square = fn(n) { n * n }; // not this one
+let x = square(2 /* two */);`
+
+	p := NewParser(lexer.NewLexer(input))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(program.Statements), program.String())
+	}
+
+	doc := program.Statements[0].(*ast.LetStatement).Token.Comments
+	if len(doc) != 2 || doc[0].Text != "// square returns n * n" || doc[1].Text != "/* it works on floats too */" {
+		t.Errorf("wrong comments on the first let. got=%+v", doc)
+	}
+	next := program.Statements[1].(*ast.LetStatement).Token.Comments
+	if len(next) != 1 || next[0].Text != "// not this one" {
+		t.Errorf("wrong comments on the second let. got=%+v", next)
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	input := "let total = add(a,\n  b[1]);"
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.LetStatement)
+	call, ok := stmt.Value.(*ast.CallExpression)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.CallExpression. got=%T", stmt.Value)
+	}
+
+	if stmt.Pos().Line != 1 || stmt.Pos().Column != 1 {
+		t.Errorf("let statement starts at wrong place. got=%s", stmt.Pos())
+	}
+	if call.Pos().Line != 1 || call.Pos().Column != 13 {
+		t.Errorf("call starts at wrong place. got=%s", call.Pos())
+	}
+	if call.End().Line != 2 || call.End().Column != 8 {
+		t.Errorf("call ends at wrong place. got=%s", call.End())
+	}
+
+	index := call.Arguments[1]
+	if index.Pos().Column != 3 || index.End().Column != 7 {
+		t.Errorf("index expression has wrong span. got=%s-%s", index.Pos(), index.End())
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors int
+		expectedStmts  []string // String() of every statement that made it into the AST
+	}{
+		{"let x = 5", 0, []string{"letx = 5;"}},
+		{"x += 1", 0, []string{"x += 1"}},
+		{"let x = ;\nlet y = 5;", 1, []string{"letx = <bad expression>;", "lety = 5;"}},
+		{"let = 5; let z = 1 * ; z", 2, []string{"<bad statement>", "letz = (1 * <bad expression>);", "z"}},
+		{"let a = (1 + 2; let b = 3; b", 1, []string{"leta = <bad expression>;", "letb = 3;", "b"}},
+		{"if (x) { 1 + } let y = 2;", 1, []string{"if x (1 + <bad expression>) ", "lety = 2;"}},
+		{"if (x) { let = } y", 1, []string{"if x <bad statement> ", "y"}},
+		{"} let y = 2;", 1, []string{"<bad expression>", "lety = 2;"}},
+		{"add(1, 2; let y = 2;", 1, []string{"add()", "lety = 2;"}},
+		{"if (x) { 1", 1, []string{"if x 1 "}},
+		{"let f = fn(x { x }; f", 1, []string{"letf = fn()x/n};", "f"}},
+		{"while (x) { 1 + if (y) { break } else { 0 } }\nlet b = ;", 2, []string{"while(x){(1 + if y break; else 0 )}", "letb = <bad expression>;"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != tt.expectedErrors {
+			t.Errorf("wrong number of errors for %q. expected=%d, got=%d (%q)", tt.input, tt.expectedErrors, len(p.Errors()), p.Errors())
+		}
+
+		statements := []string{}
+		for _, stmt := range program.Statements {
+			statements = append(statements, stmt.String())
+		}
+		if strings.Join(statements, "|") != strings.Join(tt.expectedStmts, "|") {
+			t.Errorf("wrong statements for %q. expected=%q, got=%q", tt.input, tt.expectedStmts, statements)
+		}
+	}
+}
+
 func BenchmarkParser(b *testing.B) {
 	b.StartTimer()
 	for i := 0; i < 1000; i++ {
@@ -882,3 +1457,29 @@ func BenchmarkParser(b *testing.B) {
 
 	writer.Write([]string{date + " | " + Process + " | " + "Duration: " + Duration})
 }
+
+func TestTailCalls(t *testing.T) {
+	input := `fn(f) {
+		f(1);
+		if (f) { return f(2) };
+		let g = fn() { f(3); f(4) };
+		if (f) { f(5) } else if (f) { 6 + f(6) } else { f(f(7)) }
+	}`
+
+	p := NewParser(lexer.NewLexer(input))
+	program := p.ParseProgram()
+	checkParseErrors(t, p)
+
+	// Calls are told apart by their argument, f(4) is g's tail call and f(7) is only an argument
+	var tail []string
+	ast.Inspect(program, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpression); ok && call.Tail {
+			tail = append(tail, call.Arguments[0].String())
+		}
+		return true
+	})
+
+	if strings.Join(tail, " ") != "2 4 5 f(7)" {
+		t.Errorf("wrong tail calls. got=%v", tail)
+	}
+}
@@ -1,13 +1,19 @@
 package repl
 
 import (
+	"MyInterpreter/ast"
+	"MyInterpreter/compiler"
+	"MyInterpreter/diagnostics"
 	"MyInterpreter/evaluator"
 	"MyInterpreter/lexer"
 	"MyInterpreter/object"
+	"MyInterpreter/optimizer"
 	"MyInterpreter/parser"
+	"MyInterpreter/vm"
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 )
 
 const PROMPT = ">>"
@@ -25,9 +31,37 @@ const MONKEY_FACE = `
           '-----'
 `
 
+// The two ways of running code, both give the same results
+const (
+	EngineEval = "eval" // Tree-walking evaluator
+	EngineVM   = "vm"   // Bytecode compiler + virtual machine
+)
+
+type Options struct {
+	Format     diagnostics.Format // How parser and runtime errors are printed
+	Engine     string             // EngineEval or EngineVM, empty means EngineEval
+	Checked    bool               // Integer overflow is an error instead of switching to big numbers
+	Verbose    bool               // Print a note for every piece of code the optimizer removed
+	InlineSize int                // Largest function the optimizer inlines, see optimizer.Options
+	MaxDepth   int                // Most function calls running at once, see object.Options
+}
+
+// Start runs the REPL with the evaluator and DefaultFormat diagnostics
 func Start(in io.Reader, out io.Writer) {
+	StartWithOptions(in, out, Options{Format: DefaultFormat(out), Engine: EngineEval, InlineSize: optimizer.DefaultInlineSize})
+}
+
+// DefaultFormat is colored diagnostics when talking to a terminal, plain ones otherwise
+func DefaultFormat(out io.Writer) diagnostics.Format {
+	if isTerminal(out) {
+		return diagnostics.Color
+	}
+	return diagnostics.Plain
+}
+
+func StartWithOptions(in io.Reader, out io.Writer, opts Options) {
 	scanner := bufio.NewScanner(in)
-	env := object.NewEnvironment()
+	run := newRunner(opts.Engine, object.Options{CheckedArithmetic: opts.Checked, MaxDepth: opts.MaxDepth})
 
 	for {
 		fmt.Printf(PROMPT)
@@ -37,15 +71,26 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		line := scanner.Text()
+		renderer := diagnostics.NewRenderer(opts.Format, line)
 		l := lexer.NewLexer(line)
 		p := parser.NewParser(l)
 		program := p.ParseProgram()
 
 		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+			printParserErrors(out, renderer, p.Diagnostics())
+			continue
+		}
+
+		optimize := optimizer.Options{InlineSize: opts.InlineSize}
+		if opts.Verbose {
+			optimize.Report = func(note diagnostics.Diagnostic) { renderer.Render(out, note) }
+		}
+		evaluated := safeRun(run, program, optimize)
+
+		if errObj, ok := evaluated.(*object.Error); ok {
+			renderer.Render(out, errObj.Diagnostic())
 			continue
 		}
-		evaluated := evaluator.Eval(program, env)
 
 		if evaluated != nil {
 			io.WriteString(out, evaluated.Inspect())
@@ -55,10 +100,63 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	io.WriteString(out, MONKEY_FACE)
-	io.WriteString(out, "WOMP WOMP! PARSER IS NOT HAPPY")
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+// newRunner gives a function that runs one line at a time, keeping the variables of the previous lines around
+func newRunner(engine string, options object.Options) func(*ast.Program) object.Object {
+	if engine != EngineVM {
+		env := object.NewEnvironment()
+		*env.Options() = options
+		return func(program *ast.Program) object.Object {
+			return evaluator.Eval(program, env)
+		}
+	}
+
+	state := compiler.NewState()
+	globals := make([]object.Object, vm.GlobalsSize)
+
+	return func(program *ast.Program) object.Object {
+		comp := compiler.NewWithState(state)
+		if err := comp.Compile(program); err != nil {
+			diag := diagnostics.FromError(err)
+			return &object.Error{Message: diag.Message, Code: diag.Code, Span: diag.Span}
+		}
+		state = comp.State()
+
+		machine := vm.NewWithGlobalsStore(comp.Bytecode(), globals)
+		machine.SetOptions(options)
+		if err := machine.Run(); err != nil {
+			return evaluator.NewError("vm: %s", err)
+		}
+		return machine.Result()
+	}
+}
+
+// safeRun optimizes and runs one input, a panic in either turns into an error, a bug in the interpreter shouldn't end the session and lose every variable typed so far
+func safeRun(run func(*ast.Program) object.Object, program *ast.Program, optimize optimizer.Options) (result object.Object) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = evaluator.NewError("internal error: %v", r)
+		}
+	}()
+	optimize.Session = true
+	return run(optimizer.OptimizeWith(program, optimize))
+}
+
+func printParserErrors(out io.Writer, renderer *diagnostics.Renderer, diags []diagnostics.Diagnostic) {
+	if renderer.Format != diagnostics.JSON {
+		io.WriteString(out, MONKEY_FACE)
+		io.WriteString(out, "WOMP WOMP! PARSER IS NOT HAPPY\n")
+	}
+	renderer.Render(out, diags...)
+}
+
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
 	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
@@ -1,5 +1,7 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 // Not Perfomant but easy to use
@@ -9,17 +11,68 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	Span    Span // Where the token starts and ends in the source
+
+	// Comments written between the previous token and this one, the lexer skips them but keeps them here
+	// for tools that need them back (a formatter, a doc generator reading the comments above a let)
+	Comments []Comment
 }
 
+// Comment is a // or /* */ comment, Text is the whole comment with its markers
+type Comment struct {
+	Text string
+	Span Span
+}
+
+// Position is a place in the source code
+// Line and Column start at 1, Offset is the byte offset and starts at 0
+// A zero Position means "unknown", nodes built by hand (tests, optimizations) don't have one
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Span goes from Start (inclusive) to End (exclusive)
+type Span struct {
+	Start Position
+	End   Position
+}
+
+func (s Span) IsValid() bool { return s.Start.IsValid() }
+
+func (s Span) String() string { return s.Start.String() }
+
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"True":   TRUE,
-	"False":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
-	"while":  WHILE,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"True":     TRUE,
+	"False":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"while":    WHILE,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"for":      FOR,
+	"in":       IN,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -38,8 +91,14 @@ const (
 
 	IDENT  = "IDENT" //TokenType for a Variable
 	INT    = "INT"
+	FLOAT  = "FLOAT"
 	STRING = "STRING"
 
+	// "a ${x} b ${y} c" is lexed as STRING_HEAD "a ", x, STRING_MID " b ", y, STRING_TAIL " c"
+	STRING_HEAD = "STRING_HEAD"
+	STRING_MID  = "STRING_MID"
+	STRING_TAIL = "STRING_TAIL"
+
 	ASSIGN   = "="
 	PLUS     = "+"
 	MINUS    = "-"
@@ -48,6 +107,17 @@ const (
 	SLASH    = "/"
 	LT       = "<"
 	GT       = ">"
+	LTE      = "<="
+	GTE      = ">="
+	MODULO   = "%"
+	AND      = "&&"
+	OR       = "||"
+	BIT_AND  = "&"
+	BIT_OR   = "|"
+	BIT_XOR  = "^"
+	BIT_NOT  = "~"
+	SHL      = "<<"
+	SHR      = ">>"
 	EQ       = "=="
 	NOT_EQ   = "!="
 	PE       = "+="
@@ -55,6 +125,11 @@ const (
 	DE       = "/="
 	LE       = "-="
 	EXPONENT = "**"
+	ANDE     = "&="
+	ORE      = "|="
+	XORE     = "^="
+	SHLE     = "<<="
+	SHRE     = ">>="
 
 	COMMA     = ","
 	SEMICOLON = ";"
@@ -77,5 +152,9 @@ const (
 	TRUE  = "TRUE"
 	FALSE = "FALSE"
 
-	WHILE = "WHILE"
+	WHILE    = "WHILE"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	FOR      = "FOR"
+	IN       = "IN"
 )
@@ -0,0 +1,21 @@
+package vm
+
+import (
+	"MyInterpreter/code"
+	"MyInterpreter/object"
+)
+
+// Frame is one function call, its locals live on the stack starting at basePointer
+type Frame struct {
+	cl          *object.Closure
+	ip          int
+	basePointer int
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
@@ -0,0 +1,562 @@
+package vm
+
+import (
+	"MyInterpreter/code"
+	"MyInterpreter/compiler"
+	"MyInterpreter/evaluator"
+	"MyInterpreter/object"
+	"fmt"
+)
+
+// StackSize is how many slots the stack starts with, it grows as deep as the calls go (see object.Options.MaxDepth)
+const StackSize = 2048
+const GlobalsSize = 65536
+
+// The vm only moves values around, what an operator means is always decided by the evaluator's helpers
+var infixOperators = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpMod:          "%",
+	code.OpPow:          "**",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpGreaterThan:  ">",
+	code.OpLessThan:     "<",
+	code.OpGreaterEqual: ">=",
+	code.OpLessEqual:    "<=",
+	code.OpBitAnd:       "&",
+	code.OpBitOr:        "|",
+	code.OpBitXor:       "^",
+	code.OpShiftLeft:    "<<",
+	code.OpShiftRight:   ">>",
+}
+
+type VM struct {
+	constants    []object.Object
+	globals      []object.Object
+	globalNames  []string
+	builtinNames []string
+	builtins     []*object.Builtin
+	options      object.Options
+
+	stack []object.Object
+	sp    int // Always points to the next free slot, the top of the stack is stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	lastPopped object.Object
+	halted     bool
+	result     object.Object // Set when the program stops early, a runtime error or a top level return
+}
+
+func New(bytecode *compiler.Bytecode) *VM {
+	return NewWithGlobalsStore(bytecode, make([]object.Object, GlobalsSize))
+}
+
+// NewWithGlobalsStore lets the REPL keep its globals from one line to the next
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, SourceMap: bytecode.SourceMap}
+	mainClosure := &object.Closure{Fn: mainFn}
+
+	frames := []*Frame{NewFrame(mainClosure, 0)}
+
+	builtins := make([]*object.Builtin, len(bytecode.Builtins))
+	for i, name := range bytecode.Builtins {
+		builtins[i], _ = evaluator.LookupBuiltin(name)
+	}
+
+	return &VM{
+		constants:    bytecode.Constants,
+		globals:      globals,
+		globalNames:  bytecode.Globals,
+		builtinNames: bytecode.Builtins,
+		builtins:     builtins,
+
+		stack: make([]object.Object, StackSize),
+		sp:    0,
+
+		frames:      frames,
+		framesIndex: 1,
+	}
+}
+
+// SetOptions has to be called before Run, the defaults are the zero Options
+func (vm *VM) SetOptions(options object.Options) {
+	vm.options = options
+}
+
+// Result is what the program evaluated to, the same value evaluator.Eval would give back
+// runtime errors are *object.Error results, not Go errors
+func (vm *VM) Result() object.Object {
+	if vm.halted {
+		return vm.result
+	}
+	return vm.lastPopped
+}
+
+// LastPoppedStackElem is the value of the last expression statement that ran
+func (vm *VM) LastPoppedStackElem() object.Object {
+	return vm.lastPopped
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) {
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = append(vm.frames, f)
+	} else {
+		vm.frames[vm.framesIndex] = f
+	}
+	vm.framesIndex++
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+// Run only returns an error when the bytecode itself is broken, errors in the program end up in Result
+func (vm *VM) Run() error {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+
+	for !vm.halted && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.currentFrame().ip++
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		op = code.Opcode(ins[ip])
+
+		var err *object.Error
+
+		switch op {
+		case code.OpConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			err = vm.push(vm.constants[constIndex])
+
+		case code.OpPop:
+			vm.lastPopped = vm.pop()
+
+		case code.OpDrop:
+			vm.pop()
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+			code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan, code.OpGreaterEqual, code.OpLessEqual,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
+			right := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.EvalInfix(infixOperators[op], left, right, &vm.options))
+
+		case code.OpBang:
+			err = vm.pushResult(evaluator.EvalPrefix("!", vm.pop(), &vm.options))
+
+		case code.OpMinus:
+			err = vm.pushResult(evaluator.EvalPrefix("-", vm.pop(), &vm.options))
+
+		case code.OpBitNot:
+			err = vm.pushResult(evaluator.EvalPrefix("~", vm.pop(), &vm.options))
+
+		case code.OpTrue:
+			err = vm.push(evaluator.TRUE)
+
+		case code.OpFalse:
+			err = vm.push(evaluator.FALSE)
+
+		case code.OpNull:
+			err = vm.push(evaluator.NULL)
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			if !evaluator.IsTruthy(vm.pop()) {
+				vm.currentFrame().ip = pos - 1
+			}
+
+		case code.OpIter:
+			withKeys := ins[ip+1] == 1
+			vm.currentFrame().ip += 1
+
+			err = vm.pushResult(evaluator.MakeIterator(vm.pop(), withKeys))
+
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			// The iterator stays where it is, the loop's exit pops it
+			it, isIter := vm.peek().(*object.Iterator)
+			if !isIter {
+				err = internalError("OpIterNext", "an iterator", vm.peek())
+				break
+			}
+			key, value, ok := it.Next()
+			if !ok {
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+			err = vm.push(value)
+			if err == nil && key != nil {
+				err = vm.push(key)
+			}
+
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			vm.globals[globalIndex] = vm.pop()
+
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			err = vm.pushVariable(vm.globals[globalIndex], vm.globalNames, int(globalIndex))
+
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			vm.stack[vm.currentFrame().basePointer+int(localIndex)] = vm.pop()
+
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			frame := vm.currentFrame()
+			err = vm.pushVariable(vm.stack[frame.basePointer+int(localIndex)], frame.cl.Fn.Locals, int(localIndex))
+
+		case code.OpSetCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			slot := vm.stack[vm.currentFrame().basePointer+int(localIndex)]
+			cell, isCell := slot.(*object.Cell)
+			if !isCell {
+				err = internalError("OpSetCell", "a cell", slot)
+				break
+			}
+			cell.Value = vm.pop()
+
+		case code.OpGetCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			frame := vm.currentFrame()
+			slot := vm.stack[frame.basePointer+int(localIndex)]
+			cell, isCell := slot.(*object.Cell)
+			if !isCell {
+				err = internalError("OpGetCell", "a cell", slot)
+				break
+			}
+			err = vm.pushVariable(cell.Value, frame.cl.Fn.Locals, int(localIndex))
+
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			vm.currentFrame().cl.Free[freeIndex].Value = vm.pop()
+
+		case code.OpGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			cl := vm.currentFrame().cl
+			err = vm.pushVariable(cl.Free[freeIndex].Value, cl.Fn.Free, int(freeIndex))
+
+		case code.OpLoadFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			err = vm.push(vm.currentFrame().cl.Free[freeIndex])
+
+		case code.OpGetBuiltin:
+			builtinIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			err = vm.push(vm.builtins[builtinIndex])
+
+		case code.OpUndefined:
+			builtinIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			err = vm.pushVariable(nil, vm.builtinNames, int(builtinIndex))
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			elements := make([]object.Object, numElements)
+			copy(elements, vm.stack[vm.sp-numElements:vm.sp])
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(&object.Array{Elements: elements})
+
+		case code.OpInterpolate:
+			numParts := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			str := evaluator.Interpolate(vm.stack[vm.sp-numParts : vm.sp])
+			vm.sp = vm.sp - numParts
+
+			err = vm.push(str)
+
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			var hash object.Object
+			hash, err = vm.buildHash(vm.sp-numElements, vm.sp)
+			if err == nil {
+				vm.sp = vm.sp - numElements
+				err = vm.push(hash)
+			}
+
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.EvalIndex(left, index))
+
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err = evaluator.SetIndex(left, index, value)
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			err = vm.executeCall(int(numArgs))
+
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+			err = vm.executeTailCall(int(numArgs))
+
+		case code.OpReturnValue:
+			vm.returnFromFrame(vm.pop())
+
+		case code.OpReturn:
+			vm.returnFromFrame(evaluator.NULL)
+
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+			err = vm.pushClosure(int(constIndex), int(numFree))
+
+		default:
+			def, lookupErr := code.Lookup(byte(op))
+			if lookupErr != nil {
+				return lookupErr
+			}
+			return fmt.Errorf("opcode %s not implemented", def.Name)
+		}
+
+		if err != nil {
+			vm.fail(err)
+		}
+	}
+
+	return nil
+}
+
+// fail stops the program, the error points at the code of the instruction that was running unless it already knows where it came from
+func (vm *VM) fail(err *object.Error) {
+	if !err.Span.IsValid() {
+		frame := vm.currentFrame()
+		err.Span = frame.cl.Fn.SourceMap.Lookup(frame.ip)
+	}
+	vm.halted = true
+	vm.result = err
+}
+
+func (vm *VM) push(o object.Object) *object.Error {
+	if vm.sp >= len(vm.stack) {
+		vm.grow(vm.sp + 1)
+	}
+
+	vm.stack[vm.sp] = o
+	vm.sp++
+	return nil
+}
+
+// grow makes room for at least size slots on the stack
+func (vm *VM) grow(size int) {
+	stack := make([]object.Object, max(size, 2*len(vm.stack)))
+	copy(stack, vm.stack)
+	vm.stack = stack
+}
+
+// pushResult pushes what an evaluator helper gave back, unless it's an error
+func (vm *VM) pushResult(o object.Object) *object.Error {
+	if err, ok := o.(*object.Error); ok {
+		return err
+	}
+	return vm.push(o)
+}
+
+// pushVariable pushes a variable's value, variables that were never set are nil and reading one is an error
+func (vm *VM) pushVariable(value object.Object, names []string, index int) *object.Error {
+	if value == nil {
+		name := "?"
+		if index < len(names) {
+			name = names[index]
+		}
+		return evaluator.NewError("identifier not found: " + name)
+	}
+	return vm.push(value)
+}
+
+// peek is the top of the stack, nil when it's empty
+func (vm *VM) peek() object.Object {
+	if vm.sp == 0 {
+		return nil
+	}
+	return vm.stack[vm.sp-1]
+}
+
+// internalError is for bytecode that doesn't hold what an instruction expects,
+// only a compiler bug gets there so it's reported instead of crashing the vm
+func internalError(op, want string, got object.Object) *object.Error {
+	if got == nil {
+		return evaluator.NewError("internal error: %s expects %s, the stack is empty", op, want)
+	}
+	return evaluator.NewError("internal error: %s expects %s, got %s", op, want, got.Type())
+}
+
+func (vm *VM) pop() object.Object {
+	o := vm.stack[vm.sp-1]
+	vm.sp--
+	return o
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, *object.Error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair)
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, evaluator.NewError("unusable as hash key: %s", key.Type())
+		}
+
+		hashedPairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+
+	return &object.Hash{Pairs: hashedPairs}, nil
+}
+
+func (vm *VM) executeCall(numArgs int) *object.Error {
+	callee := vm.stack[vm.sp-1-numArgs]
+
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return evaluator.NewError("not a function %s", callee.Type())
+	}
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) *object.Error {
+	fn := cl.Fn
+	if numArgs != fn.NumParameters {
+		return evaluator.NewError("wrong number of arguments: want=%d, got=%d", fn.NumParameters, numArgs)
+	}
+
+	// The main frame isn't a call, framesIndex is how many calls there are once this one starts
+	if vm.framesIndex > vm.options.Limit() {
+		return vm.recursionError()
+	}
+
+	basePointer := vm.sp - numArgs
+	if basePointer+fn.NumLocals > len(vm.stack) {
+		vm.grow(basePointer + fn.NumLocals)
+	}
+
+	// The slots may still hold values of an earlier call, a let that hasn't run yet must read as undefined
+	for i := basePointer + numArgs; i < basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	for _, slot := range fn.Cells {
+		vm.stack[basePointer+slot] = &object.Cell{Value: vm.stack[basePointer+slot]}
+	}
+
+	vm.pushFrame(NewFrame(cl, basePointer))
+	vm.sp = basePointer + fn.NumLocals
+	return nil
+}
+
+// recursionError is the error for a call there's no room for, it lists the innermost calls that were running
+// each frame's function was called from the instruction its caller's frame stopped at
+func (vm *VM) recursionError() *object.Error {
+	err := evaluator.NewError("maximum recursion depth exceeded")
+	for i := vm.framesIndex - 1; i > 0 && len(err.Notes) < object.TraceFrames; i-- {
+		caller := vm.frames[i-1]
+		err.AddFrame(vm.frames[i].cl.Fn.Name, caller.cl.Fn.SourceMap.Lookup(caller.ip).Start)
+	}
+	return err
+}
+
+// executeTailCall is executeCall for a call whose value the current function returns right away
+// a closure takes over the current frame instead of getting one on top of it, anything else is an ordinary call
+func (vm *VM) executeTailCall(numArgs int) *object.Error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	cl, ok := callee.(*object.Closure)
+	if !ok || numArgs != cl.Fn.NumParameters || vm.framesIndex == 1 {
+		// Errors have to be reported from the caller's frame, and the main frame is never left
+		return vm.executeCall(numArgs)
+	}
+
+	// The callee and its arguments go where the caller's callee was, the caller's locals are done with
+	frame := vm.popFrame()
+	start := frame.basePointer - 1
+	copy(vm.stack[start:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = start + 1 + numArgs
+
+	return vm.callClosure(cl, numArgs)
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) *object.Error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	result := builtin.Fn(args...)
+	vm.sp = vm.sp - numArgs - 1
+
+	return vm.pushResult(result)
+}
+
+// returnFromFrame leaves the current function, a return outside of any function ends the program like it does in the evaluator
+func (vm *VM) returnFromFrame(value object.Object) {
+	if vm.framesIndex == 1 {
+		vm.halted = true
+		vm.result = value
+		return
+	}
+
+	frame := vm.popFrame()
+	vm.sp = frame.basePointer - 1
+	vm.push(value)
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) *object.Error {
+	fn, ok := vm.constants[constIndex].(*object.CompiledFunction)
+	if !ok {
+		return evaluator.NewError("not a function: %+v", vm.constants[constIndex])
+	}
+
+	free := make([]*object.Cell, numFree)
+	for i := 0; i < numFree; i++ {
+		cell, ok := vm.stack[vm.sp-numFree+i].(*object.Cell)
+		if !ok {
+			return internalError("OpClosure", "a cell", vm.stack[vm.sp-numFree+i])
+		}
+		free[i] = cell
+	}
+	vm.sp = vm.sp - numFree
+
+	return vm.push(&object.Closure{Fn: fn, Free: free})
+}
@@ -0,0 +1,214 @@
+package vm
+
+import (
+	"MyInterpreter/code"
+	"MyInterpreter/compiler"
+	"MyInterpreter/lexer"
+	"MyInterpreter/object"
+	"MyInterpreter/parser"
+	"testing"
+)
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+// Most of the language is checked against the evaluator in evaluator_test.go
+// these are the parts only the vm has to get right (frames, cells, the globals store)
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`let fib = fn(n) { if (n < 2) { return n }; fib(n - 1) + fib(n - 2) }; fib(15)`, 610},
+		{`let wrapper = fn() { let countDown = fn(x) { if (x == 0) { return 0 }; countDown(x - 1) }; countDown(5) }; wrapper()`, 0},
+		{`let f = fn(n) { let g = fn() { n }; if (n == 0) { return g() }; f(n - 1) + g() }; f(3)`, 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosureCells(t *testing.T) {
+	tests := []vmTestCase{
+		{`let counter = fn() { let n = 0; fn() { n += 1; n } }; let c = counter(); c(); c(); c()`, 3},
+		{`let counter = fn() { let n = 0; fn() { n += 1; n } }; let a = counter(); let b = counter(); a(); a(); b()`, 1},
+		{`let f = fn() { let get = fn() { x }; let x = 5; get() }; f()`, 5},
+		{`let f = fn(x) { let set = fn(v) { x += v }; set(2); set(3); x }; f(1)`, 6},
+		{`let f = fn(a) { fn() { fn() { a } } }; f(7)()()`, 7},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLocalsAreClearedBetweenCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn(first) { if (first) { let x = 1; x } else { x } }; f(True); f(False)`, "identifier not found: x"},
+	}
+
+	runVmTests(t, tests)
+}
+
+// A for-in keeps its iterator on the stack, leaving the loop any way at all has to take it off
+func TestIteratorsLeaveTheStack(t *testing.T) {
+	tests := []vmTestCase{
+		{`let n = 0; for (x in range(5000)) { for (y in range(3)) { n += 1 } }; n`, 15000},
+		{`let n = 0; o: for (x in range(5000)) { for (y in range(3)) { n += 1; continue o } }; n`, 5000},
+		{`let n = 0; for (x in range(5000)) { o: for (y in range(3)) { for (z in "ab") { n += 1; break o } } }; n`, 5000},
+		{`let f = fn() { for (x in [1, 2]) { for (y in [3, 4]) { return x + y } } }; let n = 0; for (i in range(5000)) { n += f() }; n`, 20000},
+	}
+
+	runVmTests(t, tests)
+}
+
+// The read that checks the variable exists isn't the program's value, like in the evaluator nothing is
+func TestAssignmentsHaveNoValue(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; x = 2`, nil},
+		{`let x = 1; x = 2; x`, 2},
+		{`let f = fn() { let y = 1; y = 2; y }; let z = f(); z = z + 1`, nil},
+		{`let f = fn() { let y = 1; y = 2; y }; let z = f(); z = z + 1; z`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{`fn(a) { a }()`, "wrong number of arguments: want=1, got=0"},
+		{`let f = fn() { 1 + f() }; f()`, "maximum recursion depth exceeded"},
+		{`5()`, "not a function INTEGER"},
+		{`let x = 1; x += True; x`, "type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	runVmTests(t, tests)
+}
+
+// Bytecode the compiler shouldn't make, like the stack a continue in the middle of
+// `1 + if (c) { continue }` used to leave behind, is an error instead of a panic
+func TestBrokenBytecode(t *testing.T) {
+	one := []object.Object{&object.Integer{Value: 1}}
+	tests := []struct {
+		name         string
+		instructions []code.Instructions
+		constants    []object.Object
+		expected     string
+	}{
+		{
+			"no iterator under the loop",
+			[]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpIterNext, 6)},
+			one,
+			"internal error: OpIterNext expects an iterator, got INTEGER",
+		},
+		{
+			"empty stack",
+			[]code.Instructions{code.Make(code.OpIterNext, 3)},
+			nil,
+			"internal error: OpIterNext expects an iterator, the stack is empty",
+		},
+		{
+			"no cell in the slot",
+			[]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpGetCell, 0)},
+			one,
+			"internal error: OpGetCell expects a cell, got INTEGER",
+		},
+	}
+
+	for _, tt := range tests {
+		ins := code.Instructions{}
+		for _, in := range tt.instructions {
+			ins = append(ins, in...)
+		}
+
+		machine := New(&compiler.Bytecode{Instructions: ins, Constants: tt.constants})
+		if err := machine.Run(); err != nil {
+			t.Fatalf("%s: vm error: %s", tt.name, err)
+		}
+		testExpectedObject(t, tt.name, tt.expected, machine.Result())
+	}
+}
+
+func TestErrorsPointAtTheFailingCode(t *testing.T) {
+	input := "let f = fn(x) {\n  x + True\n};\nf(1);"
+
+	result := run(t, input)
+	err, ok := result.(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error, got=%T (%+v)", result, result)
+	}
+
+	if err.Span.Start.String() != "2:3" || err.Span.End.String() != "2:11" {
+		t.Errorf("wrong span. want=2:3-2:11, got=%s-%s", err.Span.Start, err.Span.End)
+	}
+}
+
+func TestGlobalsStore(t *testing.T) {
+	globals := make([]object.Object, GlobalsSize)
+	state := compiler.NewState()
+
+	for _, tt := range []vmTestCase{
+		{"let a = 1;", nil},
+		{"let b = fn() { a + 1 };", nil},
+		{"b()", 2},
+		{"a = 5;", nil},
+		{"b()", 6},
+	} {
+		comp := compiler.NewWithState(state)
+		if err := comp.Compile(parse(tt.input).ParseProgram()); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		state = comp.State()
+
+		machine := NewWithGlobalsStore(comp.Bytecode(), globals)
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.input, tt.expected, machine.Result())
+	}
+}
+
+func parse(input string) *parser.Parser {
+	return parser.NewParser(lexer.NewLexer(input))
+}
+
+func run(t *testing.T, input string) object.Object {
+	t.Helper()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input).ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New(comp.Bytecode())
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	return machine.Result()
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		testExpectedObject(t, tt.input, tt.expected, run(t, tt.input))
+	}
+}
+
+func testExpectedObject(t *testing.T, input string, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		integer, ok := actual.(*object.Integer)
+		if !ok || integer.Value != int64(expected) {
+			t.Errorf("%q: want=%d, got=%T (%+v)", input, expected, actual, actual)
+		}
+	case string:
+		err, ok := actual.(*object.Error)
+		if !ok || err.Message != expected {
+			t.Errorf("%q: want error %q, got=%T (%+v)", input, expected, actual, actual)
+		}
+	case nil:
+		if actual != nil {
+			t.Errorf("%q: want no value, got=%T (%+v)", input, actual, actual)
+		}
+	}
+}